@@ -0,0 +1,505 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Parameters of the age-partitioned Bloom filters: the largest number of
+// slices picked by EstimateAgePartitionedParameters, bounding the bits read
+// by a test, and the size of the header written by WriteTo.
+const (
+	apbfMaxSlices  = 64
+	apbfHeaderSize = 48
+)
+
+// ErrInvalidAgePartitionedFilter is returned when reading an
+// AgePartitionedBloomFilter from a stream that does not hold one.
+var ErrInvalidAgePartitionedFilter = errors.New("bloom: invalid age-partitioned bloom filter")
+
+// AgePartitionedBloomFilter is an Age-Partitioned Bloom Filter (Shtul,
+// Baquero and Almeida, "Age-Partitioned Bloom Filters"), telling whether a
+// key was added among the last keys of a stream, a sliding window.
+//
+// The filter has k+l slices of m bits, each with its own hash function, in a
+// ring ordered by age. A key is added to the k newest slices. Every g keys,
+// a generation, the oldest slice is cleared and becomes the newest, so each
+// slice holds the keys of k generations and ages out l generations later. A
+// key is in the filter if its bits are set in k consecutive slices. A key
+// added in the last l*g keys is always found, one added between l*g and
+// (l+1)*g keys ago may be, older keys are forgotten: unlike rotating whole
+// filters, keys age out one generation at a time, and l sets the precision
+// of the window.
+//
+// The slices are BitSets, so that the filter works in memory or in Redis
+// (NewRedisAgePartitioned). The position of the newest slice and the number
+// of keys of the current generation are kept by the filter value, and, for
+// a filter created by NewRedisAgePartitioned, in a Redis hash next to the
+// slices: each Add writes them with its bits, each Test reads them with its
+// bits, so that a filter picks up where it left off after a restart and
+// filters of other processes test the slices by their current age. Keys
+// should still be added by a single filter at a time. A filter is not safe
+// for concurrent use.
+type AgePartitionedBloomFilter struct {
+	k, l, g, m uint
+	// the physical index of the newest slice, and the number of keys added
+	// to the current generation
+	head, count uint
+	newSlice    func(i uint) BitSet
+	slices      []BitSet
+	// the hash holding head and count in Redis, if any, and whether they
+	// were read from it
+	redisClient redis.UniversalClient
+	stateKey    string
+	loaded      bool
+}
+
+// AgePartitionedFalsePositiveRate returns the false positive rate of an
+// age-partitioned Bloom filter of k and l slices, at the end of a
+// generation, when its slices are the most filled. The slices are sized so
+// that a slice holding k generations is half full.
+func AgePartitionedFalsePositiveRate(k, l uint) float64 {
+	k = max(1, k)
+	// run[j] is the probability that the j newest slices tested end with j
+	// set bits and no run of k set bits was found
+	run, next := make([]float64, k), make([]float64, k)
+	run[0] = 1
+	found := 0.0
+	for i := uint(0); i < k+l; i++ {
+		generations := i + 1
+		if generations > k {
+			generations = k
+		}
+		fill := 1 - math.Pow(2, -float64(generations)/float64(k))
+		found += run[k-1] * fill
+		for j := range next {
+			next[j] = 0
+		}
+		for j, p := range run {
+			next[0] += p * (1 - fill)
+			if j+1 < int(k) {
+				next[j+1] += p * fill
+			}
+		}
+		run, next = next, run
+	}
+	return found
+}
+
+// EstimateAgePartitionedParameters returns the numbers of slices k and l of
+// the smallest age-partitioned Bloom filter of fp false positive rate, with
+// at most 64 slices. For a window of n keys, a filter takes about
+// k*(k+l)/l*n/ln(2) bits.
+func EstimateAgePartitionedParameters(fp float64) (k, l uint) {
+	best := math.Inf(1)
+	for kk := uint(1); kk < apbfMaxSlices; kk++ {
+		// the false positive rate grows with l
+		ll := uint(0)
+		for kk+ll+1 <= apbfMaxSlices && AgePartitionedFalsePositiveRate(kk, ll+1) <= fp {
+			ll++
+		}
+		if ll == 0 {
+			continue
+		}
+		if size := float64(kk) * float64(kk+ll) / float64(ll); size < best {
+			best, k, l = size, kk, ll
+		}
+	}
+	if k == 0 {
+		return apbfMaxSlices - 1, 1
+	}
+	return k, l
+}
+
+// NewAgePartitioned creates an age-partitioned Bloom filter of k+l slices
+// and generations of g keys. The slices are created by newSlice, called with
+// the index of the slice, and sized to be at most half full. Keys are
+// remembered for l*g to (l+1)*g keys.
+func NewAgePartitioned(k, l, g uint, newSlice func(i uint) BitSet) *AgePartitionedBloomFilter {
+	f := &AgePartitionedBloomFilter{k: max(1, k), l: l, g: max(1, g), newSlice: newSlice}
+	f.m = max(1, uint(math.Ceil(float64(f.k)*float64(f.g)/math.Ln2)))
+	f.slices = make([]BitSet, f.k+f.l)
+	for i := range f.slices {
+		f.slices[i] = newSlice(uint(i)).Init(f.m)
+	}
+	return f
+}
+
+// NewAgePartitionedWithEstimates creates an age-partitioned Bloom filter
+// remembering at least the last n keys with fp false positive rate.
+func NewAgePartitionedWithEstimates(n uint, fp float64, newSlice func(i uint) BitSet) *AgePartitionedBloomFilter {
+	k, l := EstimateAgePartitionedParameters(fp)
+	return NewAgePartitioned(k, l, (max(1, n)+l-1)/l, newSlice)
+}
+
+// NewRedisAgePartitioned creates an age-partitioned Bloom filter of k+l
+// slices and generations of g keys, whose slices are RedisBitSets stored
+// under "prefix:i", and the position of the newest slice and the number of
+// keys of the current generation in the hash "prefix:state". An Add sets the
+// bits of all its slices in a single pipeline, and a Test reads them in a
+// single pipeline.
+func NewRedisAgePartitioned(redisClient redis.UniversalClient, prefix string, k, l, g uint) *AgePartitionedBloomFilter {
+	f := NewAgePartitioned(k, l, g, func(i uint) BitSet {
+		return NewRedisBitSet(redisClient, prefix+":"+strconv.FormatUint(uint64(i), 10), 0)
+	})
+	f.redisClient, f.stateKey = redisClient, prefix+":state"
+	return f
+}
+
+// K returns the number of slices a key is added to.
+func (f *AgePartitionedBloomFilter) K() uint {
+	return f.k
+}
+
+// L returns the number of additional slices, the generations a key is
+// remembered for.
+func (f *AgePartitionedBloomFilter) L() uint {
+	return f.l
+}
+
+// Generation returns the number of keys of a generation, g.
+func (f *AgePartitionedBloomFilter) Generation() uint {
+	return f.g
+}
+
+// Window returns the number of latest keys, l*g, the filter always
+// remembers.
+func (f *AgePartitionedBloomFilter) Window() uint {
+	return f.l * f.g
+}
+
+// SliceCap returns the number of bits of a slice, m.
+func (f *AgePartitionedBloomFilter) SliceCap() uint {
+	return f.m
+}
+
+// FalsePositiveRate returns the false positive rate of the filter once its
+// slices are filled, see AgePartitionedFalsePositiveRate.
+func (f *AgePartitionedBloomFilter) FalsePositiveRate() float64 {
+	return AgePartitionedFalsePositiveRate(f.k, f.l)
+}
+
+// slice returns the physical index of the slice of age i, 0 being the
+// newest.
+func (f *AgePartitionedBloomFilter) slice(i uint) uint {
+	return f.sliceAt(f.head, i)
+}
+
+// sliceAt returns the physical index of the slice of age i when the newest
+// slice is head.
+func (f *AgePartitionedBloomFilter) sliceAt(head, i uint) uint {
+	return (head + i) % (f.k + f.l)
+}
+
+// queueState queues in pipe the commands reading head and count from Redis.
+func (f *AgePartitionedBloomFilter) queueState(ctx context.Context, pipe redis.Cmdable) *redis.SliceCmd {
+	return pipe.HMGet(ctx, f.stateKey, "head", "count")
+}
+
+// parseState returns head and count read by queueState, 0 if the filter is
+// new.
+func (f *AgePartitionedBloomFilter) parseState(cmd *redis.SliceCmd) (uint, uint, error) {
+	var v [2]uint64
+	for i, val := range cmd.Val() {
+		if val == nil {
+			continue
+		}
+		s, _ := val.(string)
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return 0, 0, ErrInvalidAgePartitionedFilter
+		}
+		v[i] = n
+	}
+	if v[0] >= uint64(f.k+f.l) || v[1] > uint64(f.g) {
+		return 0, 0, ErrInvalidAgePartitionedFilter
+	}
+	return uint(v[0]), uint(v[1]), nil
+}
+
+// load reads head and count from Redis, once.
+func (f *AgePartitionedBloomFilter) load(ctx context.Context) error {
+	if f.stateKey == "" || f.loaded {
+		return nil
+	}
+	cmd := f.queueState(ctx, f.redisClient)
+	if err := cmd.Err(); err != nil {
+		return err
+	}
+	head, count, err := f.parseState(cmd)
+	if err != nil {
+		return err
+	}
+	f.head, f.count, f.loaded = head, count, true
+	return nil
+}
+
+// saveState queues in pipe the command writing head and count to Redis.
+func (f *AgePartitionedBloomFilter) saveState(ctx context.Context, pipe redis.Cmdable) *redis.IntCmd {
+	return pipe.HSet(ctx, f.stateKey, "head", f.head, "count", f.count)
+}
+
+// location returns the location of the key of base hash values h in the
+// slice of physical index s.
+func (f *AgePartitionedBloomFilter) location(h [4]uint64, s uint) uint {
+	return uint(location(h, s) % uint64(f.m))
+}
+
+// Add adds data to the filter.
+func (f *AgePartitionedBloomFilter) Add(ctx context.Context, data []byte) error {
+	return f.AddHashes(ctx, baseHashes(data))
+}
+
+// AddString adds data to the filter.
+func (f *AgePartitionedBloomFilter) AddString(ctx context.Context, data string) error {
+	return f.AddHashes(ctx, HashesString(data))
+}
+
+// AddHashes adds the key of base hash values h to the filter, starting a
+// new generation first if the current one is full. If the key cannot be
+// added, the filter goes back to the generation it was in; the oldest slice,
+// cleared to start a new generation, only held keys older than the window.
+func (f *AgePartitionedBloomFilter) AddHashes(ctx context.Context, h [4]uint64) error {
+	if err := f.load(ctx); err != nil {
+		return err
+	}
+	head, count := f.head, f.count
+	if f.count == f.g {
+		f.head = f.slice(f.k + f.l - 1)
+		f.slices[f.head].ClearAll()
+		f.count = 0
+	}
+	f.count++
+	if err := f.setBits(ctx, h); err != nil {
+		f.head, f.count = head, count
+		return err
+	}
+	return nil
+}
+
+// setBits sets the bits of the key of base hash values h in the k newest
+// slices, and writes head and count to Redis.
+func (f *AgePartitionedBloomFilter) setBits(ctx context.Context, h [4]uint64) error {
+	if ok, err := f.redisSetBits(ctx, h); ok || err != nil {
+		return err
+	}
+	for i := uint(0); i < f.k; i++ {
+		s := f.slice(i)
+		if err := setBits(ctx, f.slices[s], []uint{f.location(h, s)}); err != nil {
+			return err
+		}
+	}
+	if f.stateKey != "" {
+		return f.saveState(ctx, f.redisClient).Err()
+	}
+	return nil
+}
+
+// redisSetBits sets the bits of the key of base hash values h in the k
+// newest slices, and writes head and count, with a single pipeline, if the
+// slices are all stored in Redis with the same client. It returns false
+// otherwise.
+func (f *AgePartitionedBloomFilter) redisSetBits(ctx context.Context, h [4]uint64) (bool, error) {
+	var pipe redis.Pipeliner
+	var client redis.UniversalClient
+	for i := uint(0); i < f.k; i++ {
+		s := f.slice(i)
+		bits, ok := f.slices[s].(redisBitWriter)
+		if !ok {
+			return false, nil
+		}
+		c, _, _ := bits.redisBit(0)
+		if pipe == nil {
+			client, pipe = c, c.Pipeline()
+		} else if c != client {
+			return false, nil
+		}
+		if err := bits.queueSetBits(ctx, pipe, []uint{f.location(h, s)}); err != nil {
+			return true, err
+		}
+	}
+	if f.stateKey != "" {
+		f.saveState(ctx, pipe)
+	}
+	_, err := pipe.Exec(ctx)
+	return true, err
+}
+
+// Test returns true if data may have been added among the latest keys,
+// false if it was not, or was forgotten.
+func (f *AgePartitionedBloomFilter) Test(ctx context.Context, data []byte) (bool, error) {
+	return f.TestHashes(ctx, baseHashes(data))
+}
+
+// TestString returns true if data may have been added among the latest
+// keys, see Test.
+func (f *AgePartitionedBloomFilter) TestString(ctx context.Context, data string) (bool, error) {
+	return f.TestHashes(ctx, HashesString(data))
+}
+
+// TestHashes returns true if the key of base hash values h may have been
+// added among the latest keys.
+func (f *AgePartitionedBloomFilter) TestHashes(ctx context.Context, h [4]uint64) (bool, error) {
+	bits, head, err := f.redisBits(ctx, h)
+	if err != nil {
+		return false, err
+	}
+	if bits == nil {
+		if err := f.load(ctx); err != nil {
+			return false, err
+		}
+		head = f.head
+	}
+	run := uint(0)
+	for i := uint(0); i < f.k+f.l; i++ {
+		s := f.sliceAt(head, i)
+		var set bool
+		if bits != nil {
+			set = bits[s]
+		} else {
+			set = f.slices[s].Test(f.location(h, s))
+		}
+		if !set {
+			run = 0
+			continue
+		}
+		if run++; run == f.k {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// redisBits reads the bits of the key of base hash values h in all the
+// slices, and the position of the newest slice, with a single pipeline, if
+// the slices are all stored in Redis with the same client. It returns nil
+// otherwise.
+func (f *AgePartitionedBloomFilter) redisBits(ctx context.Context, h [4]uint64) ([]bool, uint, error) {
+	var pipe redis.Pipeliner
+	var client redis.UniversalClient
+	cmds := make([]*redis.IntCmd, len(f.slices))
+	for s, slice := range f.slices {
+		bits, ok := slice.(redisBitLocator)
+		if !ok {
+			return nil, 0, nil
+		}
+		c, key, offset := bits.redisBit(f.location(h, uint(s)))
+		if pipe == nil {
+			client, pipe = c, c.Pipeline()
+		} else if c != client {
+			return nil, 0, nil
+		}
+		cmds[s] = pipe.GetBit(ctx, key, offset)
+	}
+	var state *redis.SliceCmd
+	if f.stateKey != "" && client == f.redisClient {
+		state = f.queueState(ctx, pipe)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, err
+	}
+	head := f.head
+	if state != nil {
+		var err error
+		if head, _, err = f.parseState(state); err != nil {
+			return nil, 0, err
+		}
+	}
+	bits := make([]bool, len(cmds))
+	for s, cmd := range cmds {
+		bits[s] = cmd.Val() == 1
+	}
+	return bits, head, nil
+}
+
+// ClearAll clears all the slices and starts a new generation, removing all
+// keys.
+func (f *AgePartitionedBloomFilter) ClearAll() {
+	for _, slice := range f.slices {
+		slice.ClearAll()
+	}
+	f.head, f.count = 0, 0
+	if f.stateKey != "" {
+		f.redisClient.Del(context.Background(), f.stateKey)
+		f.loaded = true
+	}
+}
+
+// WriteTo writes the filter to an i/o stream: k, l, g, m, the index of the
+// newest slice and the number of keys of the current generation as
+// big-endian uint64, then the slices, in the format of their BitSet. It
+// returns the number of bytes written.
+func (f *AgePartitionedBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	var header [apbfHeaderSize]byte
+	for i, v := range []uint{f.k, f.l, f.g, f.m, f.head, f.count} {
+		binary.BigEndian.PutUint64(header[8*i:], uint64(v))
+	}
+	n, err := stream.Write(header[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	for _, slice := range f.slices {
+		n, err := slice.WriteTo(stream)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom reads a filter written by WriteTo from an i/o stream, replacing
+// the parameters and the slices of the filter. The slices are read into the
+// BitSets of the filter, created as needed. It returns the number of bytes
+// read.
+func (f *AgePartitionedBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	var header [apbfHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	var v [6]uint64
+	for i := range v {
+		v[i] = binary.BigEndian.Uint64(header[8*i:])
+	}
+	k, l, g, m, head, count := v[0], v[1], v[2], v[3], v[4], v[5]
+	if k < 1 || k > 1<<16 || l > 1<<16 || g < 1 || m < 1 || m > 1<<40 || head >= k+l || count > g {
+		return total, ErrInvalidAgePartitionedFilter
+	}
+	slices := make([]BitSet, k+l)
+	for i := range slices {
+		if i < len(f.slices) {
+			slices[i] = f.slices[i]
+		} else {
+			slices[i] = f.newSlice(uint(i))
+		}
+		n, err := slices[i].ReadFrom(stream)
+		total += n
+		if err != nil {
+			return total, err
+		}
+		// the locations of a key go up to m, see patchBound for the number
+		// of bits of a slice
+		if patchBound(slices[i]) < m {
+			return total, ErrInvalidAgePartitionedFilter
+		}
+	}
+	f.k, f.l, f.g, f.m = uint(k), uint(l), uint(g), uint(m)
+	f.head, f.count = uint(head), uint(count)
+	f.slices = slices
+	if f.stateKey != "" {
+		f.loaded = true
+		if err := f.saveState(context.Background(), f.redisClient).Err(); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
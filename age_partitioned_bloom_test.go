@@ -0,0 +1,232 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func memorySlices(uint) BitSet {
+	return NewMemoryBitSet()
+}
+
+func TestAgePartitionedParameters(t *testing.T) {
+	for _, fp := range []float64{0.1, 0.01, 0.001, 0.0001} {
+		k, l := EstimateAgePartitionedParameters(fp)
+		if rate := AgePartitionedFalsePositiveRate(k, l); rate > fp {
+			t.Errorf("fp %f: k=%d l=%d give a false positive rate of %f", fp, k, l, rate)
+		}
+		if k+l > apbfMaxSlices {
+			t.Errorf("fp %f: too many slices k=%d l=%d", fp, k, l)
+		}
+	}
+	if rate := AgePartitionedFalsePositiveRate(10, 7); math.Abs(rate-0.0015) > 0.0002 {
+		t.Errorf("unexpected false positive rate %f for k=10 l=7", rate)
+	}
+}
+
+func testAgePartitioned(t *testing.T, f *AgePartitionedBloomFilter, n int) {
+	ctx := context.Background()
+	window := int(f.Window())
+	fp := 0
+	for i := 0; i < n; i++ {
+		key := "key" + strconv.Itoa(i)
+		if ok, err := f.TestString(ctx, key); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			fp++
+		}
+		if err := f.AddString(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+		// the whole window is remembered
+		if i%97 == 0 && i >= window {
+			for j := i - window + 1; j <= i; j++ {
+				if ok, _ := f.TestString(ctx, "key"+strconv.Itoa(j)); !ok {
+					t.Fatalf("after key%d, key%d should be in", i, j)
+				}
+			}
+		}
+	}
+	if rate := float64(fp) / float64(n); rate > 2*f.FalsePositiveRate()+0.002 {
+		t.Errorf("false positive rate %f over %f", rate, f.FalsePositiveRate())
+	}
+	// keys older than (l+1) generations are forgotten, but for false positives
+	forgotten := 0
+	for j := 0; j < n-window-int(f.Generation()); j++ {
+		if ok, _ := f.TestString(ctx, "key"+strconv.Itoa(j)); !ok {
+			forgotten++
+		}
+	}
+	if old := n - window - int(f.Generation()); float64(forgotten) < (1-2*f.FalsePositiveRate()-0.01)*float64(old) {
+		t.Errorf("only %d of %d old keys are forgotten", forgotten, old)
+	}
+
+	f.ClearAll()
+	if ok, _ := f.TestString(ctx, "key"+strconv.Itoa(n-1)); ok {
+		t.Error("the filter should be empty after ClearAll")
+	}
+}
+
+func TestAgePartitioned(t *testing.T) {
+	f := NewAgePartitionedWithEstimates(1000, 0.01, memorySlices)
+	if f.Window() < 1000 || f.Window() > 1000+f.L() {
+		t.Errorf("unexpected window %d", f.Window())
+	}
+	testAgePartitioned(t, f, 10000)
+}
+
+func TestRedisAgePartitioned(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	prefix := uuid.New().String()
+	f := NewRedisAgePartitioned(redisClient, prefix, 5, 4, 50)
+	defer func() {
+		for i := uint(0); i < f.K()+f.L(); i++ {
+			redisClient.Del(context.Background(), prefix+":"+strconv.Itoa(int(i)))
+		}
+		redisClient.Del(context.Background(), prefix+":state")
+	}()
+	testAgePartitioned(t, f, 1000)
+}
+
+// roundTrips counts the commands and pipelines sent to Redis.
+type roundTrips struct {
+	n int
+}
+
+func (r *roundTrips) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (r *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		r.n++
+		return next(ctx, cmd)
+	}
+}
+
+func (r *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		r.n++
+		return next(ctx, cmds)
+	}
+}
+
+func TestRedisAgePartitionedState(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	prefix := uuid.New().String()
+	f := NewRedisAgePartitioned(redisClient, prefix, 4, 3, 20)
+	defer func() {
+		for i := uint(0); i < f.K()+f.L(); i++ {
+			redisClient.Del(ctx, prefix+":"+strconv.Itoa(int(i)))
+		}
+		redisClient.Del(ctx, prefix+":state")
+	}()
+	memory := NewAgePartitioned(4, 3, 20, memorySlices)
+	for i := 0; i < 150; i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+		memory.AddString(ctx, strconv.Itoa(i))
+	}
+
+	// an add within a generation is a single round trip
+	counter := &roundTrips{}
+	redisClient.AddHook(counter)
+	f.AddString(ctx, "150")
+	memory.AddString(ctx, "150")
+	if counter.n != 1 {
+		t.Errorf("an add took %d round trips", counter.n)
+	}
+
+	// a filter created after a restart goes on where the previous one was,
+	// and the previous one tests the slices by their current age
+	g := NewRedisAgePartitioned(redisClient, prefix, 4, 3, 20)
+	for i := 151; i < 200; i++ {
+		g.AddString(ctx, strconv.Itoa(i))
+		memory.AddString(ctx, strconv.Itoa(i))
+	}
+	for i := 0; i < 300; i++ {
+		ok, _ := memory.TestString(ctx, strconv.Itoa(i))
+		if ok2, _ := g.TestString(ctx, strconv.Itoa(i)); ok != ok2 {
+			t.Fatalf("%d: the restarted filter differs", i)
+		}
+		if ok2, _ := f.TestString(ctx, strconv.Itoa(i)); ok != ok2 {
+			t.Fatalf("%d: the previous filter differs", i)
+		}
+	}
+}
+
+func TestRedisAgePartitionedFailedAdd(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	prefix := uuid.New().String()
+	f := NewRedisAgePartitioned(redisClient, prefix, 4, 3, 20)
+	for i := 0; i < 20; i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+	}
+	head, count := f.head, f.count
+	redisClient.Close()
+	if err := f.AddString(ctx, "20"); err == nil {
+		t.Fatal("adding with a closed client should fail")
+	}
+	if f.head != head || f.count != count {
+		t.Error("a failed add should not start a new generation")
+	}
+
+	redisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	for i := uint(0); i < f.K()+f.L(); i++ {
+		redisClient.Del(ctx, prefix+":"+strconv.Itoa(int(i)))
+	}
+	redisClient.Del(ctx, prefix+":state")
+}
+
+func TestAgePartitionedReadWrite(t *testing.T) {
+	ctx := context.Background()
+	f := NewAgePartitioned(4, 3, 20, memorySlices)
+	for i := 0; i < 150; i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g := NewAgePartitioned(1, 1, 1, memorySlices)
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	// the generation goes on where it was
+	for i := 150; i < 200; i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+		g.AddString(ctx, strconv.Itoa(i))
+	}
+	for i := 0; i < 300; i++ {
+		ok, _ := f.TestString(ctx, strconv.Itoa(i))
+		if ok2, _ := g.TestString(ctx, strconv.Itoa(i)); ok != ok2 {
+			t.Fatalf("%d: the filters differ", i)
+		}
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, apbfHeaderSize))); err != ErrInvalidAgePartitionedFilter {
+		t.Errorf("expected ErrInvalidAgePartitionedFilter, got %v", err)
+	}
+	// slices of fewer bits than m
+	buf.Reset()
+	f.WriteTo(&buf)
+	data := buf.Bytes()
+	binary.BigEndian.PutUint64(data[24:], 1<<20)
+	if _, err := g.ReadFrom(bytes.NewReader(data)); err != ErrInvalidAgePartitionedFilter {
+		t.Errorf("expected ErrInvalidAgePartitionedFilter, got %v", err)
+	}
+}
@@ -1,6 +1,9 @@
 package bloom
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 type BitSet interface {
 	// Init allocate bit set based on bit length
@@ -37,3 +40,37 @@ type BitSet interface {
 	// From is a constructor used to create a BitSet from an array of integers
 	From(buf []uint64) BitSet
 }
+
+// BatchBitSet is implemented by the BitSets that can set or test several bits
+// in a single operation, typically a single round trip to Redis.
+type BatchBitSet interface {
+	BitSet
+	// SetBits sets all the bits in idx.
+	SetBits(ctx context.Context, idx []uint) error
+	// TestBits returns true if all the bits in idx are set.
+	TestBits(ctx context.Context, idx []uint) (bool, error)
+}
+
+// setBits sets all the bits in idx, in one operation if b supports it.
+func setBits(ctx context.Context, b BitSet, idx []uint) error {
+	if bb, ok := b.(BatchBitSet); ok {
+		return bb.SetBits(ctx, idx)
+	}
+	for _, i := range idx {
+		b.Set(i)
+	}
+	return nil
+}
+
+// testBits tests all the bits in idx, in one operation if b supports it.
+func testBits(ctx context.Context, b BitSet, idx []uint) (bool, error) {
+	if bb, ok := b.(BatchBitSet); ok {
+		return bb.TestBits(ctx, idx)
+	}
+	for _, i := range idx {
+		if !b.Test(i) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
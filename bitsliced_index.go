@@ -0,0 +1,252 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"math/bits"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+// ErrIncompatibleFilter is returned when adding to a BitSlicedIndex a filter
+// whose parameters or hashing differ from the ones of the index.
+var ErrIncompatibleFilter = errors.New("bloom: filter incompatible with the index")
+
+// sliceStore stores the rows of a BitSlicedIndex: row r holds bit r of the
+// filter of every document, at the offset of the document, in Redis bit
+// order.
+type sliceStore interface {
+	// set sets the bit of doc in each of rows
+	set(ctx context.Context, rows []uint, doc uint) error
+	// unset clears the bit of doc in the m rows
+	unset(ctx context.Context, m uint, doc uint) error
+	// and returns the intersection of rows
+	and(ctx context.Context, rows []uint) ([]byte, error)
+}
+
+// BitSlicedIndex is a bit-sliced signature file, in the manner of BitFunnel:
+// many Bloom filters of the same m and k, one per document, stored
+// transposed. Row r holds bit r of every filter, so a query reads the k rows
+// of a key, ANDs them, and the bits left set are the IDs of the documents
+// whose filter may contain the key. A query costs k rows whatever the number
+// of documents.
+//
+// Document IDs are small integers, the offsets of the documents in the rows,
+// so they should be dense.
+type BitSlicedIndex struct {
+	locator bloomFilterImpl
+	store   sliceStore
+}
+
+// NewBitSlicedIndex creates an in-memory index of filters with m bits and k
+// hash functions.
+func NewBitSlicedIndex(m, k uint) *BitSlicedIndex {
+	return &BitSlicedIndex{
+		locator: bloomFilterImpl{m: max(1, m), k: max(1, k)},
+		store:   &memorySliceStore{rows: make(map[uint][]byte)},
+	}
+}
+
+// NewRedisBitSlicedIndex creates an index of filters with m bits and k hash
+// functions stored in Redis, one string per row. Queries AND the rows with
+// BITOP AND. The rows are stored under "{prefix}:row", sharing a hash tag so
+// that BITOP works on a Redis Cluster.
+func NewRedisBitSlicedIndex(redisClient redis.UniversalClient, prefix string, m, k uint) *BitSlicedIndex {
+	return &BitSlicedIndex{
+		locator: bloomFilterImpl{m: max(1, m), k: max(1, k)},
+		store:   &redisSliceStore{redisClient: redisClient, prefix: "{" + prefix + "}:"},
+	}
+}
+
+// Cap returns the number of bits, m, of the filters of the index.
+func (x *BitSlicedIndex) Cap() uint {
+	return x.locator.m
+}
+
+// K returns the number of hash functions of the filters of the index.
+func (x *BitSlicedIndex) K() uint {
+	return x.locator.k
+}
+
+// Add adds key to the filter of document doc.
+func (x *BitSlicedIndex) Add(ctx context.Context, doc uint, key []byte) error {
+	return x.AddHashes(ctx, doc, baseHashes(key))
+}
+
+// AddString adds key to the filter of document doc.
+func (x *BitSlicedIndex) AddString(ctx context.Context, doc uint, key string) error {
+	return x.AddHashes(ctx, doc, HashesString(key))
+}
+
+// AddHashes adds the key of base hash values h to the filter of document
+// doc.
+func (x *BitSlicedIndex) AddHashes(ctx context.Context, doc uint, h [4]uint64) error {
+	var buf [32]uint
+	return x.store.set(ctx, x.locator.hashLocations(h, buf[:0]), doc)
+}
+
+// AddFilter adds the keys of f, a filter created by New with the m and k of
+// the index, to the filter of document doc.
+func (x *BitSlicedIndex) AddFilter(ctx context.Context, doc uint, f BloomFilter) error {
+	if _, ok := f.(*bloomFilterImpl); !ok || f.Cap() != x.Cap() || f.K() != x.K() {
+		return ErrIncompatibleFilter
+	}
+	data := bitSetBytes(f.BitSet())
+	if data == nil {
+		return ErrIncompatibleFilter
+	}
+	var rows []uint
+	for i, b := range data {
+		for ; b != 0; b &= b - 1 {
+			row := uint(i)*8 + uint(bits.LeadingZeros8(b))
+			if row < x.Cap() {
+				rows = append(rows, row)
+			}
+		}
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	return x.store.set(ctx, rows, doc)
+}
+
+// Remove clears the filter of document doc. It rewrites the m rows.
+func (x *BitSlicedIndex) Remove(ctx context.Context, doc uint) error {
+	return x.store.unset(ctx, x.Cap(), doc)
+}
+
+// Query returns the IDs of the documents whose filter may contain key, in
+// increasing order.
+func (x *BitSlicedIndex) Query(ctx context.Context, key []byte) ([]uint, error) {
+	return x.QueryHashes(ctx, baseHashes(key))
+}
+
+// QueryString returns the IDs of the documents whose filter may contain key.
+func (x *BitSlicedIndex) QueryString(ctx context.Context, key string) ([]uint, error) {
+	return x.QueryHashes(ctx, HashesString(key))
+}
+
+// QueryHashes returns the IDs of the documents whose filter may contain the
+// key of base hash values h.
+func (x *BitSlicedIndex) QueryHashes(ctx context.Context, h [4]uint64) ([]uint, error) {
+	var buf [32]uint
+	rows := x.locator.hashLocations(h, buf[:0])
+	result, err := x.store.and(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+	var docs []uint
+	for i, b := range result {
+		for ; b != 0; b &= b - 1 {
+			docs = append(docs, uint(i)*8+uint(bits.LeadingZeros8(b)))
+		}
+	}
+	return docs, nil
+}
+
+// memorySliceStore keeps the rows in memory. Rows never set are not
+// allocated.
+type memorySliceStore struct {
+	rows map[uint][]byte
+}
+
+func (s *memorySliceStore) set(_ context.Context, rows []uint, doc uint) error {
+	for _, r := range rows {
+		row := s.rows[r]
+		if doc>>3 >= uint(len(row)) {
+			grown := make([]byte, doc>>3+1)
+			copy(grown, row)
+			row = grown
+			s.rows[r] = row
+		}
+		row[doc>>3] |= 0x80 >> (doc & 7)
+	}
+	return nil
+}
+
+func (s *memorySliceStore) unset(_ context.Context, _ uint, doc uint) error {
+	for _, row := range s.rows {
+		if doc>>3 < uint(len(row)) {
+			row[doc>>3] &^= 0x80 >> (doc & 7)
+		}
+	}
+	return nil
+}
+
+func (s *memorySliceStore) and(_ context.Context, rows []uint) ([]byte, error) {
+	var result []byte
+	for i, r := range rows {
+		row := s.rows[r]
+		if i == 0 {
+			result = append([]byte(nil), row...)
+			continue
+		}
+		if len(row) < len(result) {
+			result = result[:len(row)]
+		}
+		for j := range result {
+			result[j] &= row[j]
+		}
+	}
+	return result, nil
+}
+
+// redisSliceStore keeps each row in a Redis string.
+type redisSliceStore struct {
+	redisClient redis.UniversalClient
+	prefix      string
+}
+
+func (s *redisSliceStore) rowKey(r uint) string {
+	return s.prefix + strconv.FormatUint(uint64(r), 10)
+}
+
+func (s *redisSliceStore) set(ctx context.Context, rows []uint, doc uint) error {
+	_, err := s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, r := range rows {
+			pipe.SetBit(ctx, s.rowKey(r), int64(doc), 1)
+		}
+		return nil
+	})
+	return err
+}
+
+func (s *redisSliceStore) unset(ctx context.Context, m uint, doc uint) error {
+	_, err := s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for r := uint(0); r < m; r++ {
+			// SETBIT would create the rows never set
+			pipe.Eval(ctx, unsetIfExistsScript, []string{s.rowKey(r)}, doc)
+		}
+		return nil
+	})
+	return err
+}
+
+// unsetIfExistsScript clears a bit of a key, if the key exists.
+const unsetIfExistsScript = `if redis.call('EXISTS', KEYS[1]) == 1 then return redis.call('SETBIT', KEYS[1], ARGV[1], 0) end return 0`
+
+func (s *redisSliceStore) and(ctx context.Context, rows []uint) ([]byte, error) {
+	keys := make([]string, len(rows))
+	for i, r := range rows {
+		keys[i] = s.rowKey(r)
+	}
+	dest := s.prefix + "query:" + uuid.New().String()
+	var get *redis.StringCmd
+	// in a transaction, so that the intersection is never left behind
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.BitOpAnd(ctx, dest, keys...)
+		get = pipe.Get(ctx, dest)
+		pipe.Del(ctx, dest)
+		return nil
+	})
+	// an empty intersection is not stored
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return get.Bytes()
+}
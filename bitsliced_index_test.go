@@ -0,0 +1,68 @@
+package bloom
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func testBitSlicedIndex(t *testing.T, x *BitSlicedIndex) {
+	ctx := context.Background()
+	// document d holds the words "w<i>" for the i dividing d
+	for d := uint(1); d <= 100; d++ {
+		for i := uint(1); i <= d; i++ {
+			if d%i == 0 {
+				if err := x.AddString(ctx, d, "w"+strconv.Itoa(int(i))); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	docs, err := x.QueryString(ctx, "w25")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(docs, []uint{25, 50, 75, 100}) {
+		t.Errorf("unexpected documents for w25 %v", docs)
+	}
+	if docs, _ := x.Query(ctx, []byte("w101")); len(docs) != 0 {
+		t.Errorf("w101 should not be in any document, got %v", docs)
+	}
+
+	if err := x.Remove(ctx, 50); err != nil {
+		t.Fatal(err)
+	}
+	docs, _ = x.QueryHashes(ctx, HashesString("w25"))
+	if !reflect.DeepEqual(docs, []uint{25, 75, 100}) {
+		t.Errorf("unexpected documents after Remove %v", docs)
+	}
+
+	f := New(x.Cap(), x.K(), NewMemoryBitSet())
+	f.AddString("Bess").AddString("Jane")
+	if err := x.AddFilter(ctx, 1000, f); err != nil {
+		t.Fatal(err)
+	}
+	if docs, _ := x.QueryString(ctx, "Jane"); !reflect.DeepEqual(docs, []uint{1000}) {
+		t.Errorf("unexpected documents for Jane %v", docs)
+	}
+	if err := x.AddFilter(ctx, 1001, New(x.Cap()+1, x.K(), NewMemoryBitSet())); err != ErrIncompatibleFilter {
+		t.Errorf("a filter of another size should be rejected, got %v", err)
+	}
+	if err := x.AddFilter(ctx, 1001, NewBlocked(x.Cap(), x.K(), NewMemoryBitSet())); err != ErrIncompatibleFilter {
+		t.Errorf("a blocked filter should be rejected, got %v", err)
+	}
+}
+
+func TestBitSlicedIndex(t *testing.T) {
+	testBitSlicedIndex(t, NewBitSlicedIndex(2048, 7))
+}
+
+func TestRedisBitSlicedIndex(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	testBitSlicedIndex(t, NewRedisBitSlicedIndex(redisClient, uuid.New().String(), 2048, 7))
+}
@@ -0,0 +1,107 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestBlockedBasic(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	f := NewBlocked(1000, 4, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	if f.Cap() != 1024 {
+		t.Errorf("m should be rounded up to a multiple of BlockBits, got %d", f.Cap())
+	}
+	n1 := []byte("Bess")
+	n2 := []byte("Jane")
+	n3 := []byte("Emma")
+	f.Add(n1)
+	n3a := f.TestAndAdd(n3)
+	if !f.Test(n1) {
+		t.Errorf("%v should be in.", n1)
+	}
+	if f.Test(n2) {
+		t.Errorf("%v should not be in.", n2)
+	}
+	if n3a {
+		t.Errorf("%v should not be in the first time we look.", n3)
+	}
+	if !f.Test(n3) {
+		t.Errorf("%v should be in the second time we look.", n3)
+	}
+}
+
+func TestBlockedSingleBlock(t *testing.T) {
+	f := NewBlocked(1<<20, 7, NewMemoryBitSet()).(*blockedBloomFilterImpl)
+	blocks := make(map[uint]bool)
+	for i := 0; i < 1000; i++ {
+		locs := f.bitLocations([]byte(uuid.New().String()), nil)
+		block := locs[0] / BlockBits
+		blocks[block] = true
+		for _, l := range locs {
+			if l/BlockBits != block {
+				t.Fatalf("locations %v span several blocks", locs)
+			}
+		}
+	}
+	if len(blocks) < 700 {
+		t.Errorf("keys should be spread over the blocks, only %d blocks used", len(blocks))
+	}
+}
+
+func TestBlockedTestLocations(t *testing.T) {
+	f := NewBlockedWithEstimates(1000, 0.001, NewMemoryBitSet())
+	for i := 0; i < 1000; i++ {
+		f.AddString(strconv.Itoa(i))
+	}
+	for i := 0; i < 1000; i++ {
+		if !f.TestLocations(Locations([]byte(strconv.Itoa(i)), f.K())) {
+			t.Fatalf("%d should be in", i)
+		}
+	}
+	count := 0
+	for i := 1000; i < 11000; i++ {
+		if f.TestLocations(Locations([]byte(strconv.Itoa(i)), f.K())) {
+			count++
+		}
+	}
+	if float64(count)/10000 > 0.005 {
+		t.Errorf("excessive fpp %f", float64(count)/10000)
+	}
+}
+
+func TestBlockedFPP(t *testing.T) {
+	f := NewBlockedWithEstimates(10000, 0.01, NewMemoryBitSet())
+	n := make([]byte, 4)
+	for i := uint32(0); i < 10000; i++ {
+		binary.BigEndian.PutUint32(n, i)
+		f.Add(n)
+	}
+	count := 0
+	for i := uint32(0); i < 10000; i++ {
+		binary.BigEndian.PutUint32(n, i+10000)
+		if f.Test(n) {
+			count++
+		}
+	}
+	if float64(count)/10000.0 > 0.02 {
+		t.Errorf("Excessive fpp %f", float64(count)/10000.0)
+	}
+}
+
+func TestBlockedSharded(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitset := NewShardedRedisBitSet(redisClient, uuid.New().String(), 8, time.Minute, nil)
+	f := NewBlocked(8*BlockBits, 5, bitset)
+	f.AddString("Bess")
+	if !f.TestString("Bess") {
+		t.Error("Bess should be in")
+	}
+	if bitset.Count() == 0 || bitset.Count() > 5 {
+		t.Errorf("unexpected number of bits set %d", bitset.Count())
+	}
+}
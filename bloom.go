@@ -122,6 +122,20 @@ type BloomFilter interface {
 	Equal(g BloomFilter) bool
 }
 
+// HashedBloomFilter is implemented by the filters that accept keys hashed
+// beforehand with Hashes or HashesString, so that a key hashed once can be
+// added to, or tested against, many filters. The filters returned by New and
+// NewBlocked implement it.
+type HashedBloomFilter interface {
+	BloomFilter
+	// AddHashes adds the key of base hash values h. Returns the filter
+	// (allows chaining)
+	AddHashes(h [4]uint64) BloomFilter
+	// TestHashes returns true if the key of base hash values h is in the
+	// BloomFilter, false otherwise.
+	TestHashes(h [4]uint64) bool
+}
+
 // New creates a new Bloom filter with _m_ bits and _k_ hashing functions
 // We force _m_ and _k_ to be at least one to avoid panics.
 func New(m uint, k uint, b BitSet) BloomFilter {
@@ -6,6 +6,7 @@ package bloom
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"io"
@@ -26,6 +27,19 @@ func (f *bloomFilterImpl) location(h [4]uint64, i uint) uint {
 	return uint(location(h, i) % uint64(f.m))
 }
 
+// bitLocations appends the k bit locations of data to dst
+func (f *bloomFilterImpl) bitLocations(data []byte, dst []uint) []uint {
+	return f.hashLocations(baseHashes(data), dst)
+}
+
+// hashLocations appends the k bit locations of the base hash values h to dst
+func (f *bloomFilterImpl) hashLocations(h [4]uint64, dst []uint) []uint {
+	for i := uint(0); i < f.k; i++ {
+		dst = append(dst, f.location(h, i))
+	}
+	return dst
+}
+
 func (f *bloomFilterImpl) Cap() uint {
 	return f.m
 }
@@ -39,19 +53,39 @@ func (f *bloomFilterImpl) BitSet() BitSet {
 }
 
 func (f *bloomFilterImpl) Add(data []byte) BloomFilter {
-	h := baseHashes(data)
+	return f.AddHashes(baseHashes(data))
+}
+
+func (f *bloomFilterImpl) AddString(data string) BloomFilter {
+	return f.AddHashes(HashesString(data))
+}
+
+// AddHashes sets the k bits of the key. A BatchBitSet other than a
+// MemoryBitSet gets them in one batch: a single pipeline, with a single
+// expiration refresh, for a Redis bitset.
+func (f *bloomFilterImpl) AddHashes(h [4]uint64) BloomFilter {
+	if b, ok := f.b.(BatchBitSet); ok {
+		if _, local := b.(*MemoryBitSet); !local {
+			var buf [32]uint
+			_ = b.SetBits(context.Background(), f.hashLocations(h, buf[:0]))
+			return f
+		}
+	}
 	for i := uint(0); i < f.k; i++ {
 		f.b.Set(f.location(h, i))
 	}
 	return f
 }
 
-func (f *bloomFilterImpl) AddString(data string) BloomFilter {
-	return f.Add([]byte(data))
+func (f *bloomFilterImpl) Test(data []byte) bool {
+	return f.TestHashes(baseHashes(data))
 }
 
-func (f *bloomFilterImpl) Test(data []byte) bool {
-	h := baseHashes(data)
+func (f *bloomFilterImpl) TestString(data string) bool {
+	return f.TestHashes(HashesString(data))
+}
+
+func (f *bloomFilterImpl) TestHashes(h [4]uint64) bool {
 	for i := uint(0); i < f.k; i++ {
 		if !f.b.Test(f.location(h, i)) {
 			return false
@@ -60,10 +94,6 @@ func (f *bloomFilterImpl) Test(data []byte) bool {
 	return true
 }
 
-func (f *bloomFilterImpl) TestString(data string) bool {
-	return f.Test([]byte(data))
-}
-
 func (f *bloomFilterImpl) TestLocations(locs []uint64) bool {
 	for i := 0; i < len(locs); i++ {
 		if !f.b.Test(uint(locs[i] % uint64(f.m))) {
@@ -74,8 +104,11 @@ func (f *bloomFilterImpl) TestLocations(locs []uint64) bool {
 }
 
 func (f *bloomFilterImpl) TestAndAdd(data []byte) bool {
+	return f.testAndAddHashes(baseHashes(data))
+}
+
+func (f *bloomFilterImpl) testAndAddHashes(h [4]uint64) bool {
 	present := true
-	h := baseHashes(data)
 	for i := uint(0); i < f.k; i++ {
 		l := f.location(h, i)
 		if !f.b.Test(l) {
@@ -87,12 +120,15 @@ func (f *bloomFilterImpl) TestAndAdd(data []byte) bool {
 }
 
 func (f *bloomFilterImpl) TestAndAddString(data string) bool {
-	return f.TestAndAdd([]byte(data))
+	return f.testAndAddHashes(HashesString(data))
 }
 
 func (f *bloomFilterImpl) TestOrAdd(data []byte) bool {
+	return f.testOrAddHashes(baseHashes(data))
+}
+
+func (f *bloomFilterImpl) testOrAddHashes(h [4]uint64) bool {
 	present := true
-	h := baseHashes(data)
 	for i := uint(0); i < f.k; i++ {
 		l := f.location(h, i)
 		if !f.b.Test(l) {
@@ -104,7 +140,7 @@ func (f *bloomFilterImpl) TestOrAdd(data []byte) bool {
 }
 
 func (f *bloomFilterImpl) TestOrAddString(data string) bool {
-	return f.TestOrAdd([]byte(data))
+	return f.testOrAddHashes(HashesString(data))
 }
 
 func (f *bloomFilterImpl) ClearAll() BloomFilter {
@@ -172,6 +208,10 @@ func (f *bloomFilterImpl) ReadFrom(stream io.Reader) (int64, error) {
 	}
 	f.m = uint(m)
 	f.k = uint(k)
+	if fb, ok := f.b.(*FileBitSet); ok {
+		// keep the header in line with the bits, for OpenFileFilter
+		fb.SetParameters(f.m, f.k)
+	}
 	return numBytes + int64(2*binary.Size(uint64(0))), nil
 }
 
@@ -193,5 +233,8 @@ func (f *bloomFilterImpl) GobDecode(data []byte) error {
 }
 
 func (f *bloomFilterImpl) Equal(g BloomFilter) bool {
-	return f.m == g.Cap() && f.k == g.K() && f.b.Equal(g.BitSet())
+	// filters whose bits are not kept in a BitSet, such as RedisBloomFilter,
+	// are never equal
+	b := g.BitSet()
+	return b != nil && f.m == g.Cap() && f.k == g.K() && f.b.Equal(b)
 }
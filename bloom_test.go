@@ -580,3 +580,103 @@ func TestFPP(t *testing.T) {
 		t.Errorf("Excessive fpp")
 	}
 }
+
+func TestHashes(t *testing.T) {
+	f := NewWithEstimates(1000, 0.001, NewMemoryBitSet())
+	g := NewBlocked(10000, 5, NewMemoryBitSet())
+	h := HashesString("Bess")
+	if h != Hashes([]byte("Bess")) {
+		t.Error("HashesString and Hashes should agree")
+	}
+	for _, filter := range []BloomFilter{f, g} {
+		hf := filter.(HashedBloomFilter)
+		hf.AddHashes(h)
+		if !filter.TestString("Bess") || !hf.TestHashes(HashesString("Bess")) {
+			t.Errorf("%T: a key added by its hashes should be in", filter)
+		}
+		filter.AddString("Jane")
+		if !hf.TestHashes(Hashes([]byte("Jane"))) {
+			t.Errorf("%T: a key added as a string should be found by its hashes", filter)
+		}
+		if hf.TestHashes(HashesString("Emma")) {
+			t.Errorf("%T: Emma should not be in", filter)
+		}
+	}
+
+	locs := AppendLocations(nil, h, f.K())
+	if !f.TestLocations(locs) {
+		t.Error("the cached locations should be in")
+	}
+	for i, l := range Locations([]byte("Bess"), f.K()) {
+		if locs[i] != l {
+			t.Errorf("AppendLocations and Locations should agree, %d != %d", locs[i], l)
+		}
+	}
+}
+
+func TestZeroAllocations(t *testing.T) {
+	f := NewWithEstimates(1000, 0.001, NewMemoryBitSet())
+	key := make([]byte, 100)
+	str := string(key)
+	h := Hashes(key)
+	locs := AppendLocations(make([]uint64, 0, f.K()), h, f.K())
+	ops := map[string]func(){
+		"Add":              func() { f.Add(key) },
+		"AddString":        func() { f.AddString(str) },
+		"Test":             func() { f.Test(key) },
+		"TestString":       func() { f.TestString(str) },
+		"TestAndAddString": func() { f.TestAndAddString(str) },
+		"TestOrAddString":  func() { f.TestOrAddString(str) },
+		"TestHashes":       func() { f.(HashedBloomFilter).TestHashes(h) },
+		"AppendLocations":  func() { AppendLocations(locs[:0], h, f.K()) },
+	}
+	for name, op := range ops {
+		if allocs := testing.AllocsPerRun(100, op); allocs != 0 {
+			t.Errorf("%s: %v allocations, expected none", name, allocs)
+		}
+	}
+}
+
+func BenchmarkMemoryAddString(b *testing.B) {
+	f := NewWithEstimates(uint(b.N), 0.0001, NewMemoryBitSet())
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = uuid.New().String()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.AddString(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkMemoryTestString(b *testing.B) {
+	f := NewWithEstimates(uint(b.N), 0.0001, NewMemoryBitSet())
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = uuid.New().String()
+		f.AddString(keys[i])
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.TestString(keys[i%len(keys)])
+	}
+}
+
+func BenchmarkMemoryTestHashes(b *testing.B) {
+	filters := make([]HashedBloomFilter, 8)
+	for i := range filters {
+		filters[i] = NewWithEstimates(10000, 0.0001, NewMemoryBitSet()).(HashedBloomFilter)
+	}
+	key := make([]byte, 100)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		binary.BigEndian.PutUint32(key, uint32(i))
+		h := Hashes(key)
+		for _, f := range filters {
+			f.TestHashes(h)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// flushBatchSize is the number of bits sent to the BitSet in one pipeline.
+const flushBatchSize = 4096
+
+// ErrUnsupportedFilter is returned by NewBufferedBloomFilter for a filter
+// that cannot report the bit locations of a key.
+var ErrUnsupportedFilter = errors.New("bloom: filter does not report its bit locations")
+
+// bitLocator is implemented by the filters of this package that can report
+// the bit locations of a key without touching their BitSet.
+type bitLocator interface {
+	bitLocations(data []byte, dst []uint) []uint
+}
+
+// NewBufferedBloomFilter creates a BufferedBloomFilter writing behind to
+// filter, which must be one of the Bloom filters of this package keeping its
+// bits in a BitSet, such as those of New and NewBlocked, or it returns
+// ErrUnsupportedFilter. Pending bits are
+// flushed once more than maxPending distinct bits are buffered, and at least
+// every flushInterval (a zero flushInterval disables the timer). onError, if
+// not nil, is called with the error of every failed background flush.
+func NewBufferedBloomFilter(filter BloomFilter, maxPending int, flushInterval time.Duration, onError func(error)) (*BufferedBloomFilter, error) {
+	locator, ok := filter.(bitLocator)
+	if !ok {
+		return nil, ErrUnsupportedFilter
+	}
+	f := &BufferedBloomFilter{
+		filter:        filter,
+		locator:       locator,
+		maxPending:    maxPending,
+		flushInterval: flushInterval,
+		onError:       onError,
+		pending:       make(map[uint]struct{}),
+		flushSignal:   make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+	}
+	go f.flushLoop()
+	return f, nil
+}
+
+// BufferedBloomFilter is a write-behind buffer in front of a Bloom filter,
+// meant for high-throughput ingestion into a Redis backed filter.
+//
+// Add only records the bit locations of the key locally; identical bits are
+// deduplicated, and they are written to the BitSet of the underlying filter
+// in pipelined batches once the buffer is large or old enough, or when Flush
+// is called. A key added by one process is therefore visible to others only
+// after the next flush. Test consults both the buffer and the underlying
+// filter, so a process always sees its own adds.
+//
+// Bits of a failed flush are kept in the buffer and retried on the next
+// flush. A BufferedBloomFilter is safe for concurrent use; call Close to
+// flush the remaining bits and stop the background flush.
+type BufferedBloomFilter struct {
+	filter        BloomFilter
+	locator       bitLocator
+	maxPending    int
+	flushInterval time.Duration
+	onError       func(error)
+
+	mu      sync.Mutex
+	pending map[uint]struct{}
+	// flushing holds the bits being written by a flush, which Test still
+	// sees until they are written or put back in pending.
+	flushing map[uint]struct{}
+
+	// flushMu serializes flushes.
+	flushMu     sync.Mutex
+	flushSignal chan struct{}
+	done        chan struct{}
+	stopped     chan struct{}
+	closeOnce   sync.Once
+}
+
+// Filter returns the underlying Bloom filter.
+func (f *BufferedBloomFilter) Filter() BloomFilter {
+	return f.filter
+}
+
+// Add buffers the bits of data. Returns the filter (allows chaining)
+func (f *BufferedBloomFilter) Add(data []byte) *BufferedBloomFilter {
+	var buf [16]uint
+	locs := f.locator.bitLocations(data, buf[:0])
+	f.mu.Lock()
+	for _, l := range locs {
+		f.pending[l] = struct{}{}
+	}
+	full := f.maxPending > 0 && len(f.pending) >= f.maxPending
+	f.mu.Unlock()
+	if full {
+		select {
+		case f.flushSignal <- struct{}{}:
+		default:
+		}
+	}
+	return f
+}
+
+// AddString buffers the bits of a string. Returns the filter (allows chaining)
+func (f *BufferedBloomFilter) AddString(data string) *BufferedBloomFilter {
+	return f.Add(stringBytes(data))
+}
+
+// Test returns true if the data is in the buffer or the underlying filter,
+// false otherwise. If true, the result might be a false positive. If false,
+// the data is definitely not in the set.
+func (f *BufferedBloomFilter) Test(data []byte) bool {
+	var buf [16]uint
+	locs := f.locator.bitLocations(data, buf[:0])
+	remaining := locs[:0]
+	f.mu.Lock()
+	for _, l := range locs {
+		_, pending := f.pending[l]
+		_, flushing := f.flushing[l]
+		if !pending && !flushing {
+			remaining = append(remaining, l)
+		}
+	}
+	f.mu.Unlock()
+	if len(remaining) == 0 {
+		return true
+	}
+	present, err := testBits(context.Background(), f.filter.BitSet(), remaining)
+	return err == nil && present
+}
+
+// TestString returns true if the string is in the buffer or the underlying
+// filter, false otherwise.
+func (f *BufferedBloomFilter) TestString(data string) bool {
+	return f.Test(stringBytes(data))
+}
+
+// Pending returns the number of distinct bits waiting to be flushed.
+func (f *BufferedBloomFilter) Pending() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.pending)
+}
+
+// Flush writes all the buffered bits to the underlying filter. On failure
+// the bits that could not be written are kept for the next flush.
+func (f *BufferedBloomFilter) Flush(ctx context.Context) error {
+	f.flushMu.Lock()
+	defer f.flushMu.Unlock()
+
+	f.mu.Lock()
+	pending := f.pending
+	if len(pending) == 0 {
+		f.mu.Unlock()
+		return nil
+	}
+	f.pending = make(map[uint]struct{}, len(pending))
+	f.flushing = pending
+	f.mu.Unlock()
+
+	batch := make([]uint, 0, flushBatchSize)
+	flushed := make([]uint, 0, len(pending))
+	var err error
+	for l := range pending {
+		batch = append(batch, l)
+		if len(batch) == flushBatchSize {
+			if err = setBits(ctx, f.filter.BitSet(), batch); err != nil {
+				break
+			}
+			flushed = append(flushed, batch...)
+			batch = batch[:0]
+		}
+	}
+	if err == nil && len(batch) > 0 {
+		if err = setBits(ctx, f.filter.BitSet(), batch); err == nil {
+			flushed = append(flushed, batch...)
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.flushing = nil
+	if err != nil {
+		for _, l := range flushed {
+			delete(pending, l)
+		}
+		for l := range pending {
+			f.pending[l] = struct{}{}
+		}
+	}
+	return err
+}
+
+// Close flushes the remaining bits and stops the background flush. The
+// BufferedBloomFilter must not be used after Close.
+func (f *BufferedBloomFilter) Close() error {
+	f.closeOnce.Do(func() {
+		close(f.done)
+		<-f.stopped
+	})
+	return f.Flush(context.Background())
+}
+
+// flushLoop flushes the buffer on every tick and every time it fills up,
+// until Close is called.
+func (f *BufferedBloomFilter) flushLoop() {
+	defer close(f.stopped)
+	var tick <-chan time.Time
+	if f.flushInterval > 0 {
+		ticker := time.NewTicker(f.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-f.done:
+			return
+		case <-tick:
+		case <-f.flushSignal:
+		}
+		if err := f.Flush(context.Background()); err != nil && f.onError != nil {
+			f.onError(err)
+		}
+	}
+}
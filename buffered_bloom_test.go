@@ -0,0 +1,135 @@
+package bloom
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestBufferedBloomFilter(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	f := New(1000, 4, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	bf, err := NewBufferedBloomFilter(f, 0, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+
+	bf.AddString("Bess").AddString("Jane").AddString("Bess")
+	if !bf.TestString("Bess") || !bf.TestString("Jane") {
+		t.Error("buffered keys should be visible through the buffer")
+	}
+	if f.TestString("Bess") {
+		t.Error("buffered keys should not be written before a flush")
+	}
+	if bf.Pending() > 2*int(f.K()) {
+		t.Errorf("%d pending bits, duplicates should be removed", bf.Pending())
+	}
+	if err := bf.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bf.Pending() != 0 {
+		t.Error("the buffer should be empty after a flush")
+	}
+	if !f.TestString("Bess") || !f.TestString("Jane") {
+		t.Error("flushed keys should be in the filter")
+	}
+	if f.TestString("Emma") || bf.TestString("Emma") {
+		t.Error("Emma should not be in")
+	}
+}
+
+func TestBufferedBloomFilterThreshold(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	f := New(1000, 4, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	bf, err := NewBufferedBloomFilter(f, 4, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bf.Close()
+
+	bf.AddString("Bess")
+	deadline := time.Now().Add(time.Second)
+	for !f.TestString("Bess") {
+		if time.Now().After(deadline) {
+			t.Fatal("a full buffer should be flushed in the background")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBufferedBloomFilterFailedFlush(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":1"}, MaxRetries: -1})
+	f := New(1000, 4, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	bf, _ := NewBufferedBloomFilter(f, 0, 0, nil)
+
+	bf.AddString("Bess")
+	pending := bf.Pending()
+	if err := bf.Flush(context.Background()); err == nil {
+		t.Fatal("flushing to an unreachable redis should fail")
+	}
+	if bf.Pending() != pending {
+		t.Errorf("%d pending bits, failed bits should be kept", bf.Pending())
+	}
+}
+
+// blockFirstPipeline holds the first pipeline sent to Redis until release is
+// closed, after closing started.
+type blockFirstPipeline struct {
+	blocked          int32
+	started, release chan struct{}
+}
+
+func (b *blockFirstPipeline) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (b *blockFirstPipeline) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (b *blockFirstPipeline) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if atomic.CompareAndSwapInt32(&b.blocked, 0, 1) {
+			close(b.started)
+			<-b.release
+		}
+		return next(ctx, cmds)
+	}
+}
+
+func TestBufferedBloomFilterConcurrentFlush(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	f := New(1000, 4, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	hook := &blockFirstPipeline{started: make(chan struct{}), release: make(chan struct{})}
+	redisClient.AddHook(hook)
+	bf, _ := NewBufferedBloomFilter(f, 0, 0, nil)
+	defer bf.Close()
+
+	bf.AddString("Bess")
+	flushed := make(chan error)
+	go func() { flushed <- bf.Flush(context.Background()) }()
+	<-hook.started
+	if !bf.TestString("Bess") {
+		t.Error("the keys being flushed should be visible")
+	}
+	close(hook.release)
+	if err := <-flushed; err != nil {
+		t.Fatal(err)
+	}
+	if !bf.TestString("Bess") || bf.Pending() != 0 {
+		t.Error("the flushed keys should be in the filter")
+	}
+}
+
+func TestBufferedBloomFilterUnsupported(t *testing.T) {
+	// a filter wrapping another one does not report its bit locations
+	f := struct{ BloomFilter }{New(1000, 4, NewMemoryBitSet())}
+	if _, err := NewBufferedBloomFilter(f, 0, 0, nil); err != ErrUnsupportedFilter {
+		t.Errorf("expected ErrUnsupportedFilter, got %v", err)
+	}
+}
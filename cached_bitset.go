@@ -0,0 +1,321 @@
+package bloom
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// NewCachedBitSet creates a CachedBitSet in front of the Redis bitset stored
+// under bitsetKey. The local copy is reloaded every refreshInterval; a zero
+// refreshInterval disables the periodic refresh, leaving Refresh and
+// WatchKeyspace as the only ways to pick up bits set by other writers.
+func NewCachedBitSet(redisClient redis.UniversalClient, bitsetKey string, expiration, refreshInterval time.Duration) *CachedBitSet {
+	c := &CachedBitSet{
+		remote:          NewRedisBitSet(redisClient, bitsetKey, expiration).(*RedisBitSet),
+		refreshInterval: refreshInterval,
+		refreshSignal:   make(chan struct{}, 1),
+		done:            make(chan struct{}),
+	}
+	go c.refreshLoop()
+	return c
+}
+
+// CachedBitSet is a read-through cache in front of a RedisBitSet, meant for
+// filters that are written rarely and tested often.
+//
+// Test and Count are answered from a local copy of the Redis bitset, without
+// any network round trip. Set, UnSet and ClearAll write through to Redis and
+// update the local copy, so a process always sees its own writes.
+//
+// Staleness: the local copy may miss recent writes made by other writers. A
+// bit set, unset or cleared elsewhere is seen after the next refresh, that
+// is at most refreshInterval (plus the time of a GET) later, or sooner when
+// keyspace notifications are enabled with WatchKeyspace. During that window,
+// a Bloom filter tested through a CachedBitSet can return a false negative
+// for a key added by another process, and a positive that Redis would no
+// longer return for a key whose bits another process unset or cleared.
+//
+// A CachedBitSet is safe for concurrent use. Call Close to stop the
+// background refresh.
+type CachedBitSet struct {
+	remote *RedisBitSet
+
+	// refreshMu serializes refreshes, mu guards the local copy.
+	refreshMu   sync.Mutex
+	mu          sync.RWMutex
+	local       MemoryBitSet
+	lastRefresh time.Time
+	// pending records, in order, the bits set and unset locally while a
+	// refresh is in flight, and cleared whether ClearAll was called, they are
+	// replayed on the freshly loaded copy.
+	pending    []pendingWrite
+	cleared    bool
+	refreshing bool
+
+	refreshInterval time.Duration
+	refreshSignal   chan struct{}
+	done            chan struct{}
+	closeOnce       sync.Once
+	pubsub          *redis.PubSub
+}
+
+// pendingWrite is a bit set or unset during a refresh.
+type pendingWrite struct {
+	i   uint
+	set bool
+}
+
+func (c *CachedBitSet) Init(length uint) BitSet {
+	c.remote.Init(length)
+	_ = c.Refresh(context.Background())
+	return c
+}
+
+func (c *CachedBitSet) Set(i uint) BitSet {
+	c.remote.Set(i)
+	c.mu.Lock()
+	c.local.grow(i)
+	c.local.Set(i)
+	if c.refreshing {
+		c.pending = append(c.pending, pendingWrite{i, true})
+	}
+	c.mu.Unlock()
+	return c
+}
+
+// SetBits writes all the bits in idx through to Redis in one round trip.
+func (c *CachedBitSet) SetBits(ctx context.Context, idx []uint) error {
+	if err := c.remote.SetBits(ctx, idx); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	// grow once, to the largest index
+	var last uint
+	for _, i := range idx {
+		last = max(last, i)
+	}
+	if len(idx) > 0 {
+		c.local.grow(last)
+	}
+	for _, i := range idx {
+		c.local.Set(i)
+	}
+	if c.refreshing {
+		for _, i := range idx {
+			c.pending = append(c.pending, pendingWrite{i, true})
+		}
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// TestBits answers from the local copy, see the staleness notes on
+// CachedBitSet.
+func (c *CachedBitSet) TestBits(_ context.Context, idx []uint) (bool, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, i := range idx {
+		if !c.local.Test(i) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *CachedBitSet) UnSet(i uint) BitSet {
+	c.remote.UnSet(i)
+	c.mu.Lock()
+	c.local.grow(i)
+	c.local.UnSet(i)
+	if c.refreshing {
+		c.pending = append(c.pending, pendingWrite{i, false})
+	}
+	c.mu.Unlock()
+	return c
+}
+
+func (c *CachedBitSet) InPlaceUnion(compare BitSet) {
+	c.remote.InPlaceUnion(compare)
+	_ = c.Refresh(context.Background())
+}
+
+// Test answers from the local copy, see the staleness notes on CachedBitSet.
+func (c *CachedBitSet) Test(i uint) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.local.Test(i)
+}
+
+func (c *CachedBitSet) ClearAll() BitSet {
+	c.remote.ClearAll()
+	c.mu.Lock()
+	c.local.ClearAll()
+	if c.refreshing {
+		c.pending = c.pending[:0]
+		c.cleared = true
+	}
+	c.mu.Unlock()
+	return c
+}
+
+// Count answers from the local copy, see the staleness notes on CachedBitSet.
+func (c *CachedBitSet) Count() uint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.local.Count()
+}
+
+func (c *CachedBitSet) WriteTo(stream io.Writer) (int64, error) {
+	return c.remote.WriteTo(stream)
+}
+
+func (c *CachedBitSet) Equal(other BitSet) bool {
+	return c.remote.Equal(other)
+}
+
+func (c *CachedBitSet) GetBitSetKey() string {
+	return c.remote.GetBitSetKey()
+}
+
+func (c *CachedBitSet) ReadFrom(stream io.Reader) (int64, error) {
+	n, err := c.remote.ReadFrom(stream)
+	if err != nil {
+		return n, err
+	}
+	return n, c.Refresh(context.Background())
+}
+
+func (c *CachedBitSet) From(buf []uint64) BitSet {
+	c.remote.From(buf)
+	_ = c.Refresh(context.Background())
+	return c
+}
+
+// Refresh reloads the local copy from Redis.
+func (c *CachedBitSet) Refresh(ctx context.Context) error {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.startRefresh()
+	data, err := c.remote.redisClient.Get(ctx, c.remote.bitsetKey).Bytes()
+	if err == redis.Nil {
+		data, err = nil, nil
+	}
+	return c.finishRefresh(data, err)
+}
+
+// startRefresh starts recording the local writes, to be replayed by
+// finishRefresh.
+func (c *CachedBitSet) startRefresh() {
+	c.mu.Lock()
+	c.refreshing = true
+	c.pending = c.pending[:0]
+	c.cleared = false
+	c.mu.Unlock()
+}
+
+// finishRefresh replaces the local copy with data, read from Redis since
+// startRefresh, and replays the local writes made in between, which data may
+// or may not include.
+func (c *CachedBitSet) finishRefresh(data []byte, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	if err != nil {
+		return err
+	}
+	if c.cleared {
+		data = nil
+	}
+	c.local.SetBytes(data)
+	for _, w := range c.pending {
+		c.local.grow(w.i)
+		if w.set {
+			c.local.Set(w.i)
+		} else {
+			c.local.UnSet(w.i)
+		}
+	}
+	c.pending = c.pending[:0]
+	c.cleared = false
+	c.lastRefresh = time.Now()
+	return nil
+}
+
+// LastRefresh returns the time of the last successful refresh.
+func (c *CachedBitSet) LastRefresh() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastRefresh
+}
+
+// WatchKeyspace subscribes to the Redis keyspace notifications of the bitset
+// key and refreshes the local copy whenever it changes. db is the database
+// number the key lives in. Notifications must be enabled on the server, e.g.
+// with "CONFIG SET notify-keyspace-events K$". Notifications are delivered at
+// most once, so the periodic refresh still bounds the staleness.
+func (c *CachedBitSet) WatchKeyspace(ctx context.Context, db int) error {
+	channel := fmt.Sprintf("__keyspace@%d__:%s", db, c.remote.bitsetKey)
+	pubsub := c.remote.redisClient.Subscribe(ctx, channel)
+	if _, err := pubsub.Receive(ctx); err != nil {
+		_ = pubsub.Close()
+		return err
+	}
+
+	c.mu.Lock()
+	if c.pubsub != nil {
+		_ = c.pubsub.Close()
+	}
+	c.pubsub = pubsub
+	c.mu.Unlock()
+
+	go func() {
+		for range pubsub.Channel() {
+			select {
+			case c.refreshSignal <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return nil
+}
+
+// Close stops the background refresh and the keyspace subscription. The
+// CachedBitSet remains usable, but is no longer refreshed.
+func (c *CachedBitSet) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		if c.pubsub != nil {
+			err = c.pubsub.Close()
+		}
+		c.mu.Unlock()
+	})
+	return err
+}
+
+// refreshLoop refreshes the local copy on every tick and every keyspace
+// notification, until Close is called.
+func (c *CachedBitSet) refreshLoop() {
+	var tick <-chan time.Time
+	if c.refreshInterval > 0 {
+		ticker := time.NewTicker(c.refreshInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-tick:
+		case <-c.refreshSignal:
+		}
+		_ = c.Refresh(context.Background())
+	}
+}
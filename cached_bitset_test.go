@@ -0,0 +1,93 @@
+package bloom
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestCachedBitSet(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitSetKey := uuid.New().String()
+	cached := NewCachedBitSet(redisClient, bitSetKey, time.Minute, 0)
+	defer cached.Close()
+
+	f := New(1000, 4, cached)
+	direct := New(1000, 4, NewRedisBitSet(redisClient, bitSetKey, time.Minute))
+
+	f.AddString("Bess")
+	if !f.TestString("Bess") {
+		t.Error("own writes should be visible at once")
+	}
+	if !direct.TestString("Bess") {
+		t.Error("writes should go through to redis")
+	}
+
+	direct.AddString("Jane")
+	if f.TestString("Jane") {
+		t.Error("remote writes should not be visible before a refresh")
+	}
+	if err := cached.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if !f.TestString("Jane") || !f.TestString("Bess") {
+		t.Error("remote writes should be visible after a refresh")
+	}
+	if cached.Count() != direct.BitSet().Count() {
+		t.Errorf("count %d should match redis count %d", cached.Count(), direct.BitSet().Count())
+	}
+}
+
+func TestCachedBitSetPeriodicRefresh(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitSetKey := uuid.New().String()
+	cached := NewCachedBitSet(redisClient, bitSetKey, time.Minute, 10*time.Millisecond)
+	defer cached.Close()
+
+	f := New(1000, 4, cached)
+	direct := New(1000, 4, NewRedisBitSet(redisClient, bitSetKey, time.Minute))
+	direct.AddString("Emma")
+
+	deadline := time.Now().Add(time.Second)
+	for !f.TestString("Emma") {
+		if time.Now().After(deadline) {
+			t.Fatal("periodic refresh did not pick up the remote write")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCachedBitSetWritesDuringRefresh(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitSetKey := uuid.New().String()
+	cached := NewCachedBitSet(redisClient, bitSetKey, time.Minute, 0)
+	defer cached.Close()
+	defer redisClient.Del(context.Background(), bitSetKey)
+
+	cached.Init(100)
+	cached.Set(1).Set(2)
+	// a refresh reads bits 1 and 2, then bit 2 is unset and bit 3 set before
+	// it completes
+	cached.startRefresh()
+	stale := append([]byte(nil), cached.local.Bytes()...)
+	cached.UnSet(2)
+	cached.Set(3)
+	if err := cached.finishRefresh(stale, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Test(1) || cached.Test(2) || !cached.Test(3) {
+		t.Error("the writes made during the refresh should be kept")
+	}
+
+	cached.startRefresh()
+	stale = append([]byte(nil), cached.local.Bytes()...)
+	cached.ClearAll()
+	cached.Set(4)
+	cached.finishRefresh(stale, nil)
+	if cached.Test(1) || cached.Test(3) || !cached.Test(4) {
+		t.Error("a ClearAll made during the refresh should be kept")
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/HoangViet144/bloom"
+)
+
+// maxBodyBytes bounds the JSON request bodies.
+const maxBodyBytes = 16 << 20
+
+// Limits of the created filters and imported dumps: the number of bits of a
+// filter is bounded by the 2^32 bits of a Redis string, and maxDumpBytes
+// bounds the whole dump.
+const (
+	maxDumpBits  = 1 << 32
+	maxDumpK     = 1 << 10
+	maxDumpKey   = 1 << 16
+	maxDumpBytes = maxDumpBits/8 + maxDumpKey + 1<<10
+)
+
+// createRequest is the body of POST /filters.
+type createRequest struct {
+	Name string  `json:"name"`
+	N    uint    `json:"n"`
+	FP   float64 `json:"fp"`
+}
+
+// keysRequest is the body of the add and test endpoints: a single key or a
+// batch of keys.
+type keysRequest struct {
+	Key  *string  `json:"key"`
+	Keys []string `json:"keys"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// handler serves the REST API:
+//
+//	GET    /filters               list the filters
+//	POST   /filters               create a filter from {"name", "n", "fp"}
+//	GET    /filters/{name}        stats of a filter
+//	DELETE /filters/{name}        delete a filter
+//	POST   /filters/{name}/add    add {"key"} or {"keys"}
+//	POST   /filters/{name}/test   test {"key"} or {"keys"}
+//	GET    /filters/{name}/stats  stats of a filter
+//	GET    /filters/{name}/export binary dump, as written by WriteTo
+//	PUT    /filters/{name}/import load a binary dump, as read by ReadFrom
+type handler struct {
+	registry *registry
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	if parts[0] != "filters" || len(parts) > 3 {
+		writeError(w, http.StatusNotFound, "not found")
+		return
+	}
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string][]string{"filters": h.registry.names()})
+		case http.MethodPost:
+			h.create(w, r)
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	case len(parts) == 2:
+		switch r.Method {
+		case http.MethodGet:
+			h.stats(w, parts[1])
+		case http.MethodDelete:
+			h.delete(w, parts[1])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	default:
+		name := parts[1]
+		switch {
+		case parts[2] == "add" && r.Method == http.MethodPost:
+			h.add(w, r, name)
+		case parts[2] == "test" && r.Method == http.MethodPost:
+			h.test(w, r, name)
+		case parts[2] == "stats" && r.Method == http.MethodGet:
+			h.stats(w, name)
+		case parts[2] == "export" && r.Method == http.MethodGet:
+			h.export(w, name)
+		case parts[2] == "import" && r.Method == http.MethodPut:
+			h.importFilter(w, r, name)
+		default:
+			writeError(w, http.StatusNotFound, "not found")
+		}
+	}
+}
+
+func (h *handler) create(w http.ResponseWriter, r *http.Request) {
+	var req createRequest
+	if !readJSON(w, r, &req) {
+		return
+	}
+	if req.Name == "" || strings.Contains(req.Name, "/") {
+		writeError(w, http.StatusBadRequest, "invalid name")
+		return
+	}
+	if req.N == 0 || req.FP <= 0 || req.FP >= 1 {
+		writeError(w, http.StatusBadRequest, "n must be positive and fp between 0 and 1")
+		return
+	}
+	// the number of bits of bloom.EstimateParameters, before it is rounded
+	// to a uint
+	m := -float64(req.N) * math.Log(req.FP) / (math.Ln2 * math.Ln2)
+	if _, k := bloom.EstimateParameters(req.N, req.FP); m > maxDumpBits || k > maxDumpK {
+		writeError(w, http.StatusBadRequest, "filter too large")
+		return
+	}
+	e, err := h.registry.create(req.Name, req.N, req.FP)
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"name": req.Name,
+		"m":    e.filter.Cap(),
+		"k":    e.filter.K(),
+	})
+}
+
+func (h *handler) delete(w http.ResponseWriter, name string) {
+	if err := h.registry.delete(name); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// keys reads the keys of an add or test request.
+func (h *handler) keys(w http.ResponseWriter, r *http.Request) ([]string, bool, bool) {
+	var req keysRequest
+	if !readJSON(w, r, &req) {
+		return nil, false, false
+	}
+	if req.Key != nil {
+		return []string{*req.Key}, true, true
+	}
+	if req.Keys == nil {
+		writeError(w, http.StatusBadRequest, "key or keys required")
+		return nil, false, false
+	}
+	return req.Keys, false, true
+}
+
+func (h *handler) add(w http.ResponseWriter, r *http.Request, name string) {
+	e, err := h.registry.get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	keys, _, ok := h.keys(w, r)
+	if !ok {
+		return
+	}
+	e.mu.Lock()
+	for _, key := range keys {
+		e.filter.AddString(key)
+	}
+	e.mu.Unlock()
+	writeJSON(w, http.StatusOK, map[string]int{"added": len(keys)})
+}
+
+func (h *handler) test(w http.ResponseWriter, r *http.Request, name string) {
+	e, err := h.registry.get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	keys, single, ok := h.keys(w, r)
+	if !ok {
+		return
+	}
+	results := make([]bool, len(keys))
+	e.mu.Lock()
+	for i, key := range keys {
+		results[i] = e.filter.TestString(key)
+	}
+	e.mu.Unlock()
+	if single {
+		writeJSON(w, http.StatusOK, map[string]bool{"present": results[0]})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string][]bool{"results": results})
+}
+
+func (h *handler) stats(w http.ResponseWriter, name string) {
+	e, err := h.registry.get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	e.mu.Lock()
+	stats := bloom.Stats(e.filter)
+	e.mu.Unlock()
+	writeJSON(w, http.StatusOK, stats)
+}
+
+func (h *handler) export(w http.ResponseWriter, name string) {
+	e, err := h.registry.get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	_, _ = e.filter.WriteTo(w)
+}
+
+// importFilter replaces, or creates, the filter named name with the dump in
+// the request body. A dump can only be imported into the backend it was
+// exported from; a Redis backed dump is loaded under the key of the filter
+// named name, whatever the key it records.
+func (h *handler) importFilter(w http.ResponseWriter, r *http.Request, name string) {
+	b := h.registry.newBitSet(name)
+	dump, err := readDump(http.MaxBytesReader(w, r.Body, maxDumpBytes), b.GetBitSetKey())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid dump: "+err.Error())
+		return
+	}
+	filter := bloom.New(0, 0, b)
+	if _, err := filter.ReadFrom(bytes.NewReader(dump)); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid dump: "+err.Error())
+		return
+	}
+	h.registry.put(name, filter)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name": name,
+		"m":    filter.Cap(),
+		"k":    filter.K(),
+	})
+}
+
+// errDumpSize is returned by readDump for a dump whose sizes are out of
+// bounds.
+var errDumpSize = errors.New("sizes out of bounds")
+
+// readDump reads the dump of a filter, checking its sizes before allocating
+// anything, and returns it re-encoded for a bitset stored under key: a
+// memory dump if key is empty, a Redis dump of key otherwise.
+func readDump(r io.Reader, key string) ([]byte, error) {
+	var header [2]uint64
+	if err := binary.Read(r, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	m, k := header[0], header[1]
+	if m < 1 || m > maxDumpBits || k < 1 || k > maxDumpK {
+		return nil, errDumpSize
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, header)
+	if key != "" {
+		// the key recorded in the dump is replaced with key
+		var keyLen uint64
+		if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+			return nil, err
+		}
+		if keyLen > maxDumpKey {
+			return nil, errDumpSize
+		}
+		if _, err := io.CopyN(io.Discard, r, int64(keyLen)); err != nil {
+			return nil, err
+		}
+		var expiration uint64
+		if err := binary.Read(r, binary.BigEndian, &expiration); err != nil {
+			return nil, err
+		}
+		_ = binary.Write(&buf, binary.BigEndian, uint64(len(key)))
+		buf.WriteString(key)
+		_ = binary.Write(&buf, binary.BigEndian, expiration)
+	}
+	var length uint64
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if length > m/8+1 {
+		return nil, fmt.Errorf("%d bytes of bits for %d bits", length, m)
+	}
+	_ = binary.Write(&buf, binary.BigEndian, length)
+	if _, err := io.CopyN(&buf, r, int64(length)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readJSON decodes the JSON body of r into v, answering 400 on failure.
+func readJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	err := json.NewDecoder(io.LimitReader(r.Body, maxBodyBytes)).Decode(v)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON body: "+err.Error())
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, errorResponse{msg})
+}
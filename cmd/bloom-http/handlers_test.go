@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func newTestServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(&handler{registry: newRegistry(func(string) bloom.BitSet {
+		return bloom.NewMemoryBitSet()
+	})})
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// do sends a request with a JSON body and decodes the JSON response into
+// out, returning the status code.
+func do(t *testing.T, method, url string, body interface{}, out interface{}) int {
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestFilterLifecycle(t *testing.T) {
+	srv := newTestServer(t)
+
+	created := map[string]interface{}{}
+	if status := do(t, "POST", srv.URL+"/filters", createRequest{"f", 1000, 0.01}, &created); status != http.StatusCreated {
+		t.Fatalf("unexpected status %d", status)
+	}
+	m, k := bloom.EstimateParameters(1000, 0.01)
+	if created["m"] != float64(m) || created["k"] != float64(k) {
+		t.Errorf("unexpected parameters %v", created)
+	}
+	if status := do(t, "POST", srv.URL+"/filters", createRequest{"f", 1000, 0.01}, nil); status != http.StatusConflict {
+		t.Errorf("creating an existing filter should conflict, got %d", status)
+	}
+	for _, req := range []createRequest{{"huge", 4000000000, 0.01}, {"huge", 1 << 30, 1e-300}} {
+		if status := do(t, "POST", srv.URL+"/filters", req, nil); status != http.StatusBadRequest {
+			t.Errorf("creating a filter of n=%d fp=%g should be refused, got %d", req.N, req.FP, status)
+		}
+	}
+
+	do(t, "POST", srv.URL+"/filters/f/add", map[string]interface{}{"keys": []string{"Bess", "Jane"}}, nil)
+	do(t, "POST", srv.URL+"/filters/f/add", map[string]interface{}{"key": "Emma"}, nil)
+
+	var single struct{ Present bool }
+	do(t, "POST", srv.URL+"/filters/f/test", map[string]interface{}{"key": "Emma"}, &single)
+	if !single.Present {
+		t.Error("Emma should be in")
+	}
+	var batch struct{ Results []bool }
+	do(t, "POST", srv.URL+"/filters/f/test", map[string]interface{}{"keys": []string{"Bess", "Anna"}}, &batch)
+	if len(batch.Results) != 2 || !batch.Results[0] || batch.Results[1] {
+		t.Errorf("unexpected results %v", batch.Results)
+	}
+
+	var stats bloom.FilterStats
+	do(t, "GET", srv.URL+"/filters/f/stats", nil, &stats)
+	if stats.M != m || stats.ApproximatedSize != 3 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var list struct{ Filters []string }
+	do(t, "GET", srv.URL+"/filters", nil, &list)
+	if len(list.Filters) != 1 || list.Filters[0] != "f" {
+		t.Errorf("unexpected filters %v", list.Filters)
+	}
+
+	if status := do(t, "DELETE", srv.URL+"/filters/f", nil, nil); status != http.StatusNoContent {
+		t.Errorf("unexpected status %d", status)
+	}
+	if status := do(t, "POST", srv.URL+"/filters/f/test", map[string]interface{}{"key": "Emma"}, nil); status != http.StatusNotFound {
+		t.Errorf("a deleted filter should not be found, got %d", status)
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	srv := newTestServer(t)
+	do(t, "POST", srv.URL+"/filters", createRequest{"f", 1000, 0.01}, nil)
+	do(t, "POST", srv.URL+"/filters/f/add", map[string]interface{}{"key": "Bess"}, nil)
+
+	resp, err := http.Get(srv.URL + "/filters/f/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, _ := http.NewRequest("PUT", srv.URL+"/filters/g/import", bytes.NewReader(dump))
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %d", resp.StatusCode)
+	}
+	var single struct{ Present bool }
+	do(t, "POST", srv.URL+"/filters/g/test", map[string]interface{}{"key": "Bess"}, &single)
+	if !single.Present {
+		t.Error("Bess should be in the imported filter")
+	}
+}
+
+// importDump sends dump to the import endpoint of the filter name, returning
+// the status code.
+func importDump(t *testing.T, srv *httptest.Server, name string, dump []byte) int {
+	req, _ := http.NewRequest("PUT", srv.URL+"/filters/"+name+"/import", bytes.NewReader(dump))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestImportRedisKey(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	prefix := uuid.New().String() + ":"
+	defer redisClient.Del(ctx, prefix+"f", prefix+"g", "victim")
+	srv := httptest.NewServer(&handler{registry: newRegistry(func(name string) bloom.BitSet {
+		return bloom.NewRedisBitSet(redisClient, prefix+name, time.Minute)
+	})})
+	defer srv.Close()
+
+	do(t, "POST", srv.URL+"/filters", createRequest{"f", 1000, 0.01}, nil)
+	do(t, "POST", srv.URL+"/filters/f/add", map[string]interface{}{"key": "Bess"}, nil)
+	m, k := bloom.EstimateParameters(1000, 0.01)
+
+	// a dump of f, exported by the redis backend, imported into g
+	resp, err := http.Get(srv.URL + "/filters/f/export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exported, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if status := importDump(t, srv, "g", exported); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	do(t, "POST", srv.URL+"/filters/g/add", map[string]interface{}{"key": "Jane"}, nil)
+	var single struct{ Present bool }
+	if do(t, "POST", srv.URL+"/filters/f/test", map[string]interface{}{"key": "Jane"}, &single); single.Present {
+		t.Error("importing into g should not write the key of f")
+	}
+
+	// a dump recording any other key
+	var crafted bytes.Buffer
+	binary.Write(&crafted, binary.BigEndian, []uint64{uint64(m), uint64(k), uint64(len("victim"))})
+	crafted.WriteString("victim")
+	binary.Write(&crafted, binary.BigEndian, []uint64{0, 1})
+	crafted.WriteByte(0xff)
+	if status := importDump(t, srv, "g", crafted.Bytes()); status != http.StatusOK {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if n := redisClient.Exists(ctx, "victim").Val(); n != 0 {
+		t.Error("importing a dump should not write the key it records")
+	}
+}
+
+func TestImportLimits(t *testing.T) {
+	srv := newTestServer(t)
+	for _, header := range [][]uint64{
+		{0, 7, 0},
+		{1000, 0, 0},
+		{1 << 40, 7, 0},
+		{1000, 7, 1 << 40},
+	} {
+		var dump bytes.Buffer
+		binary.Write(&dump, binary.BigEndian, header)
+		if status := importDump(t, srv, "g", dump.Bytes()); status != http.StatusBadRequest {
+			t.Errorf("%v: unexpected status %d", header, status)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+// Command bloom-http serves named Bloom filters over an HTTP/JSON API: create
+// filters from an expected number of items and false positive rate, add and
+// test keys, one at a time or in batches, fetch their stats, export and
+// import their binary dumps, and delete them. See handler for the routes.
+//
+// Filters are kept in memory, or in Redis bitsets with -backend redis. The
+// registry of names itself lives in memory.
+//
+// Usage:
+//
+//	bloom-http [-addr :8080] [-backend memory|redis] [-redis-addr :6379] [-key-prefix bloom-http:] [-expiration 0]
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/go-redis/redis/v9"
+)
+
+// shutdownTimeout bounds the time given to the requests in flight on
+// shutdown.
+const shutdownTimeout = 10 * time.Second
+
+func main() {
+	addr := flag.String("addr", ":8080", "address to listen on")
+	backend := flag.String("backend", "memory", "where the bits are stored: memory or redis")
+	redisAddr := flag.String("redis-addr", ":6379", "address of the Redis server of the redis backend")
+	keyPrefix := flag.String("key-prefix", "bloom-http:", "prefix of the Redis keys of the redis backend")
+	expiration := flag.Duration("expiration", 0, "expiration of the Redis keys of the redis backend, 0 for none")
+	flag.Parse()
+
+	var newBitSet func(name string) bloom.BitSet
+	switch *backend {
+	case "memory":
+		newBitSet = func(string) bloom.BitSet { return bloom.NewMemoryBitSet() }
+	case "redis":
+		redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{*redisAddr}})
+		defer redisClient.Close()
+		newBitSet = func(name string) bloom.BitSet {
+			return bloom.NewRedisBitSet(redisClient, *keyPrefix+name, *expiration)
+		}
+	default:
+		log.Fatalf("bloom-http: unknown backend %q", *backend)
+	}
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: &handler{registry: newRegistry(newBitSet)},
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
+		log.Print("bloom-http: shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Print(err)
+		}
+	}()
+
+	log.Printf("bloom-http: listening on %s, %s backend", *addr, *backend)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-done
+}
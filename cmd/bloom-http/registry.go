@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/HoangViet144/bloom"
+)
+
+var (
+	errNotFound = errors.New("filter not found")
+	errExists   = errors.New("filter already exists")
+)
+
+// entry is a named filter. The filters of the package are not safe for
+// concurrent use, mu serializes the requests on one filter.
+type entry struct {
+	mu     sync.Mutex
+	filter bloom.BloomFilter
+}
+
+// registry holds the named filters served over HTTP.
+type registry struct {
+	mu        sync.RWMutex
+	entries   map[string]*entry
+	newBitSet func(name string) bloom.BitSet
+}
+
+func newRegistry(newBitSet func(name string) bloom.BitSet) *registry {
+	return &registry{
+		entries:   make(map[string]*entry),
+		newBitSet: newBitSet,
+	}
+}
+
+// create adds a filter named name for about n items with fp false positive
+// rate.
+func (r *registry) create(name string, n uint, fp float64) (*entry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.entries[name]; ok {
+		return nil, errExists
+	}
+	e := &entry{filter: bloom.NewWithEstimates(n, fp, r.newBitSet(name))}
+	r.entries[name] = e
+	return e, nil
+}
+
+// get returns the filter named name.
+func (r *registry) get(name string) (*entry, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	e, ok := r.entries[name]
+	if !ok {
+		return nil, errNotFound
+	}
+	return e, nil
+}
+
+// put adds or replaces the filter named name.
+func (r *registry) put(name string, filter bloom.BloomFilter) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[name] = &entry{filter: filter}
+}
+
+// delete removes the filter named name and clears its bits.
+func (r *registry) delete(name string) error {
+	r.mu.Lock()
+	e, ok := r.entries[name]
+	delete(r.entries, name)
+	r.mu.Unlock()
+	if !ok {
+		return errNotFound
+	}
+	e.mu.Lock()
+	e.filter.ClearAll()
+	e.mu.Unlock()
+	return nil
+}
+
+// names returns the sorted names of the filters.
+func (r *registry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.entries))
+	for name := range r.entries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+
+	"github.com/HoangViet144/bloom"
+)
+
+// maxLineBytes bounds the length of a key read from an input.
+const maxLineBytes = 1 << 20
+
+// errAbsent is returned by test when a key is not in the filter, so that
+// bloomctl exits with status 1 like grep.
+var errAbsent = errors.New("absent")
+
+// env holds the standard streams of a command.
+type env struct {
+	stdin          io.Reader
+	stdout, stderr io.Writer
+}
+
+type command struct {
+	usage string
+	run   func(e *env, args []string) error
+}
+
+// commands is filled in init, the commands refer to it for their usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"plan":  {"plan -n items -fp rate", plan},
+		"build": {"build -o location [-n items -fp rate | -m bits -k hashes] [file ...]", build},
+		"test":  {"test -f location [key ...]", test},
+		"info":  {"info -f location [-json]", info},
+		"merge": {"merge -o location location ...", merge},
+	}
+}
+
+// newFlagSet creates the flag set of a command.
+func newFlagSet(e *env, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "usage: bloomctl %s\n", commands[name].usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// newStore creates a store configured by flags of fs.
+func newStore(fs *flag.FlagSet) *store {
+	s := &store{}
+	fs.StringVar(&s.redisAddr, "redis-addr", ":6379", "address of the Redis server of redis: locations")
+	fs.UintVar(&s.m, "m", 0, "number of bits of the filter, required for redis: locations")
+	fs.UintVar(&s.k, "k", 0, "number of hash functions of the filter, required for redis: locations")
+	fs.DurationVar(&s.expiration, "expiration", 0, "expiration of the Redis keys written, 0 for none")
+	return s
+}
+
+// plan prints the parameters of a filter holding n items with a false
+// positive rate of fp.
+func plan(e *env, args []string) error {
+	fs := newFlagSet(e, "plan")
+	n := fs.Uint("n", 0, "expected number of items")
+	fp := fs.Float64("fp", 0.01, "desired false positive rate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *n == 0 || *fp <= 0 || *fp >= 1 {
+		return errors.New("plan: -n must be positive and -fp between 0 and 1")
+	}
+	m, k := bloom.EstimateParameters(*n, *fp)
+	fmt.Fprintf(e.stdout, "m: %d\nk: %d\nbytes: %d\nfalse positive rate: %g\n",
+		m, k, m/8+1, expectedFalsePositiveRate(m, k, *n))
+	return nil
+}
+
+// expectedFalsePositiveRate is the false positive rate of a filter of m bits
+// and k hash functions holding n items.
+func expectedFalsePositiveRate(m, k, n uint) float64 {
+	return math.Pow(1-math.Exp(-float64(k)*float64(n)/float64(m)), float64(k))
+}
+
+// build adds the lines of the files, or of the standard input, to a new
+// filter. Without -n nor -m, the filter is sized for the number of lines.
+func build(e *env, args []string) error {
+	fs := newFlagSet(e, "build")
+	s := newStore(fs)
+	defer s.close()
+	out := fs.String("o", "", "location to write the filter to")
+	n := fs.Uint("n", 0, "expected number of items, defaults to the number of lines")
+	fp := fs.Float64("fp", 0.01, "desired false positive rate")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" {
+		return errors.New("build: -o is required")
+	}
+	if *fp <= 0 || *fp >= 1 {
+		return errors.New("build: -fp must be between 0 and 1")
+	}
+	if s.m != 0 && s.k == 0 {
+		return errors.New("build: -k is required with -m")
+	}
+
+	var keys []string
+	if *n == 0 && s.m == 0 {
+		err := readLines(e, fs.Args(), func(key string) error {
+			keys = append(keys, key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(keys) == 0 {
+			return errors.New("build: no input to size the filter, use -n or -m")
+		}
+		*n = uint(len(keys))
+	}
+	var f bloom.BloomFilter
+	if s.m != 0 {
+		f = bloom.New(s.m, s.k, bloom.NewMemoryBitSet())
+	} else {
+		f = bloom.NewWithEstimates(*n, *fp, bloom.NewMemoryBitSet())
+	}
+
+	if keys != nil {
+		for _, key := range keys {
+			f.AddString(key)
+		}
+	} else {
+		err := readLines(e, fs.Args(), func(key string) error {
+			f.AddString(key)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.save(*out, f)
+}
+
+// test prints whether each key, given as arguments or read from the standard
+// input, is in the filter.
+func test(e *env, args []string) error {
+	fs := newFlagSet(e, "test")
+	s := newStore(fs)
+	defer s.close()
+	loc := fs.String("f", "", "location of the filter")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *loc == "" {
+		return errors.New("test: -f is required")
+	}
+	f, err := s.load(*loc)
+	if err != nil {
+		return err
+	}
+
+	absent := false
+	check := func(key string) error {
+		present := f.TestString(key)
+		absent = absent || !present
+		_, err := fmt.Fprintf(e.stdout, "%s\t%t\n", key, present)
+		return err
+	}
+	if fs.NArg() > 0 {
+		for _, key := range fs.Args() {
+			if err := check(key); err != nil {
+				return err
+			}
+		}
+	} else if err := readLines(e, nil, check); err != nil {
+		return err
+	}
+	if absent {
+		return errAbsent
+	}
+	return nil
+}
+
+// info prints the parameters and the load of a filter.
+func info(e *env, args []string) error {
+	fs := newFlagSet(e, "info")
+	s := newStore(fs)
+	defer s.close()
+	loc := fs.String("f", "", "location of the filter")
+	asJSON := fs.Bool("json", false, "print the stats as JSON")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *loc == "" {
+		return errors.New("info: -f is required")
+	}
+	f, err := s.load(*loc)
+	if err != nil {
+		return err
+	}
+
+	stats := bloom.Stats(f)
+	if *asJSON {
+		return json.NewEncoder(e.stdout).Encode(stats)
+	}
+	_, err = fmt.Fprintf(e.stdout, "m: %d\nk: %d\nset bits: %d\nfill ratio: %.4f\napproximated size: %d\nfalse positive rate: %g\n",
+		stats.M, stats.K, stats.SetBits, stats.FillRatio, stats.ApproximatedSize, stats.FalsePositiveRate)
+	return err
+}
+
+// merge writes the union of filters sharing the same parameters.
+func merge(e *env, args []string) error {
+	fs := newFlagSet(e, "merge")
+	s := newStore(fs)
+	defer s.close()
+	out := fs.String("o", "", "location to write the union to")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *out == "" || fs.NArg() == 0 {
+		return errors.New("merge: -o and at least one filter are required")
+	}
+
+	var union bloom.BloomFilter
+	for _, loc := range fs.Args() {
+		f, err := s.load(loc)
+		if err != nil {
+			return err
+		}
+		if union == nil {
+			union = f
+			continue
+		}
+		if f.Cap() != union.Cap() || f.K() != union.K() {
+			return fmt.Errorf("%s: m=%d k=%d, expected m=%d k=%d", loc, f.Cap(), f.K(), union.Cap(), union.K())
+		}
+		union.BitSet().InPlaceUnion(f.BitSet())
+	}
+	return s.save(*out, union)
+}
+
+// readLines calls fn with each non-empty line of the files, or of the
+// standard input if there are none.
+func readLines(e *env, files []string, fn func(line string) error) error {
+	if len(files) == 0 {
+		return scanLines(e.stdin, fn)
+	}
+	for _, name := range files {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		err = scanLines(file, fn)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func scanLines(r io.Reader, fn func(line string) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxLineBytes)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if err := fn(line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
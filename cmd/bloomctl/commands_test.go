@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// runCommand runs bloomctl with args and the given standard input, and
+// returns its exit status and standard output.
+func runCommand(t *testing.T, stdin string, args ...string) (int, string) {
+	var stdout, stderr bytes.Buffer
+	status := run(&env{stdin: strings.NewReader(stdin), stdout: &stdout, stderr: &stderr}, args)
+	if status > 1 || (status == 1 && stderr.Len() > 0) {
+		t.Logf("bloomctl %s: %s", strings.Join(args, " "), stderr.String())
+	}
+	return status, stdout.String()
+}
+
+// tempDir creates a directory removed at the end of the test.
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bloomctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestPlan(t *testing.T) {
+	status, out := runCommand(t, "", "plan", "-n", "1000", "-fp", "0.01")
+	if status != 0 {
+		t.Fatalf("unexpected status %d", status)
+	}
+	if !strings.Contains(out, "m: 9586\n") || !strings.Contains(out, "k: 7\n") {
+		t.Errorf("unexpected plan %q", out)
+	}
+}
+
+func TestBuildTestInfoMerge(t *testing.T) {
+	dir := tempDir(t)
+	a := filepath.Join(dir, "a.bloom")
+	b := filepath.Join(dir, "b.bloom")
+	union := filepath.Join(dir, "union.bloom")
+
+	if status, _ := runCommand(t, "Bess\nJane\n", "build", "-o", a, "-n", "1000"); status != 0 {
+		t.Fatalf("build failed with status %d", status)
+	}
+	if status, _ := runCommand(t, "Emma\n", "build", "-o", b, "-n", "1000"); status != 0 {
+		t.Fatalf("build failed with status %d", status)
+	}
+
+	status, out := runCommand(t, "", "test", "-f", a, "Bess", "Emma")
+	if status != 1 || out != "Bess\ttrue\nEmma\tfalse\n" {
+		t.Errorf("unexpected test output %d %q", status, out)
+	}
+	if status, _ := runCommand(t, "Bess\nJane\n", "test", "-f", a); status != 0 {
+		t.Errorf("keys read from stdin should be present, got status %d", status)
+	}
+
+	status, out = runCommand(t, "", "info", "-f", a)
+	if status != 0 || !strings.Contains(out, "approximated size: 2\n") {
+		t.Errorf("unexpected info %d %q", status, out)
+	}
+
+	if status, _ := runCommand(t, "", "merge", "-o", union, a, b); status != 0 {
+		t.Fatalf("merge failed with status %d", status)
+	}
+	if status, _ := runCommand(t, "", "test", "-f", union, "Bess", "Jane", "Emma"); status != 0 {
+		t.Errorf("the union should contain all the keys, got status %d", status)
+	}
+
+	small := filepath.Join(dir, "small.bloom")
+	runCommand(t, "Anna\n", "build", "-o", small, "-n", "10")
+	if status, _ := runCommand(t, "", "merge", "-o", union, a, small); status != 1 {
+		t.Errorf("merging filters of different sizes should fail, got status %d", status)
+	}
+
+	empty := filepath.Join(dir, "empty.bloom")
+	if status, _ := runCommand(t, "", "build", "-o", empty); status != 1 {
+		t.Errorf("building a filter sized for no input should fail, got status %d", status)
+	}
+	if status, _ := runCommand(t, "Anna\n", "build", "-o", empty, "-m", "1000"); status != 1 {
+		t.Errorf("building a filter with -m and no -k should fail, got status %d", status)
+	}
+}
+
+func TestRedisKey(t *testing.T) {
+	dir := tempDir(t)
+	file := filepath.Join(dir, "f.bloom")
+	key := "redis:" + uuid.New().String()
+
+	if status, _ := runCommand(t, "Bess\nJane\n", "build", "-o", key, "-m", "10000", "-k", "5"); status != 0 {
+		t.Fatalf("build failed with status %d", status)
+	}
+	if status, _ := runCommand(t, "", "test", "-f", key, "Bess"); status != 1 {
+		t.Errorf("a Redis key without -m and -k should fail, got status %d", status)
+	}
+	status, out := runCommand(t, "", "test", "-f", key, "-m", "10000", "-k", "5", "Bess", "Emma")
+	if status != 1 || out != "Bess\ttrue\nEmma\tfalse\n" {
+		t.Errorf("unexpected test output %d %q", status, out)
+	}
+
+	if status, _ := runCommand(t, "", "merge", "-o", file, "-m", "10000", "-k", "5", key); status != 0 {
+		t.Fatalf("merge failed with status %d", status)
+	}
+	status, out = runCommand(t, "", "info", "-f", file)
+	if status != 0 || !strings.Contains(out, "m: 10000\n") || !strings.Contains(out, "approximated size: 2\n") {
+		t.Errorf("unexpected info %d %q", status, out)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/go-redis/redis/v9"
+)
+
+// redisPrefix marks a location naming a Redis key rather than a file.
+const redisPrefix = "redis:"
+
+// store loads and saves filters. A location is either the path of a file
+// holding a filter in the WriteTo format, or redis:KEY naming a Redis string
+// holding the bits of a filter, as stored by a RedisBitSet. A Redis key does
+// not record the parameters of its filter, they are given by m and k.
+type store struct {
+	redisAddr  string
+	m, k       uint
+	expiration time.Duration
+
+	redisClient redis.UniversalClient
+}
+
+func (s *store) client() redis.UniversalClient {
+	if s.redisClient == nil {
+		s.redisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{s.redisAddr}})
+	}
+	return s.redisClient
+}
+
+func (s *store) close() {
+	if s.redisClient != nil {
+		s.redisClient.Close()
+	}
+}
+
+// load reads the filter at loc into memory.
+func (s *store) load(loc string) (bloom.BloomFilter, error) {
+	if key := strings.TrimPrefix(loc, redisPrefix); key != loc {
+		if s.m == 0 || s.k == 0 {
+			return nil, fmt.Errorf("%s: -m and -k are required for a Redis key", loc)
+		}
+		data, err := s.client().Get(context.Background(), key).Bytes()
+		if err == redis.Nil {
+			return nil, fmt.Errorf("%s: no such key", loc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", loc, err)
+		}
+		b := bloom.NewMemoryBitSet()
+		f := bloom.New(s.m, s.k, b)
+		b.(*bloom.MemoryBitSet).SetBytes(data)
+		return f, nil
+	}
+
+	file, err := os.Open(loc)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	f := bloom.New(0, 0, bloom.NewMemoryBitSet())
+	if _, err := f.ReadFrom(file); err != nil {
+		return nil, fmt.Errorf("%s: invalid filter: %v", loc, err)
+	}
+	return f, nil
+}
+
+// save writes f, an in-memory filter, to loc.
+func (s *store) save(loc string, f bloom.BloomFilter) error {
+	if key := strings.TrimPrefix(loc, redisPrefix); key != loc {
+		data := f.BitSet().(*bloom.MemoryBitSet).Bytes()
+		if err := s.client().Set(context.Background(), key, data, s.expiration).Err(); err != nil {
+			return fmt.Errorf("%s: %v", loc, err)
+		}
+		return nil
+	}
+
+	file, err := os.Create(loc)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteTo(file); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,64 @@
+// Command bloomctl builds and inspects Bloom filters offline. Filters are
+// read and written in the binary format of BloomFilter.WriteTo, or as the
+// bits held by a Redis key with a redis:KEY location.
+//
+// Usage:
+//
+//	bloomctl plan -n items -fp rate
+//	bloomctl build -o location [-n items -fp rate | -m bits -k hashes] [file ...]
+//	bloomctl test -f location [key ...]
+//	bloomctl info -f location [-json]
+//	bloomctl merge -o location location ...
+//
+// build and test read one key per line from the standard input when no files
+// or keys are given. test exits with status 1 if a key is absent.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+func main() {
+	os.Exit(run(&env{stdin: os.Stdin, stdout: os.Stdout, stderr: os.Stderr}, os.Args[1:]))
+}
+
+// run runs the command in args and returns the exit status.
+func run(e *env, args []string) int {
+	if len(args) == 0 {
+		usage(e.stderr)
+		return 2
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(e.stderr, "bloomctl: unknown command %q\n", args[0])
+		usage(e.stderr)
+		return 2
+	}
+	switch err := cmd.run(e, args[1:]); err {
+	case nil:
+		return 0
+	case errAbsent:
+		return 1
+	case flag.ErrHelp:
+		return 2
+	default:
+		fmt.Fprintf(e.stderr, "bloomctl: %v\n", err)
+		return 1
+	}
+}
+
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintln(w, "usage:")
+	for _, name := range names {
+		fmt.Fprintf(w, "\tbloomctl %s\n", commands[name].usage)
+	}
+}
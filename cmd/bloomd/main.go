@@ -0,0 +1,61 @@
+// Command bloomd serves the Bloom filters of the bloom package over the Redis
+// protocol. It implements the BF.RESERVE, BF.ADD, BF.MADD, BF.EXISTS,
+// BF.MEXISTS, BF.INFO and BF.INSERT commands of the RedisBloom module, so any
+// Redis client library can use it.
+//
+// Filters are kept in memory, or in Redis bitsets with -backend redis. Filter
+// parameters are not persisted: after a restart, reserve a Redis backed filter
+// again with the same parameters to reattach its bits.
+//
+// Usage:
+//
+//	bloomd [-addr :6380] [-backend memory|redis] [-redis-addr :6379] [-key-prefix bloomd:] [-expiration 0]
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/go-redis/redis/v9"
+)
+
+func main() {
+	addr := flag.String("addr", ":6380", "address to listen on")
+	backend := flag.String("backend", "memory", "where the bits are stored: memory or redis")
+	redisAddr := flag.String("redis-addr", ":6379", "address of the Redis server of the redis backend")
+	keyPrefix := flag.String("key-prefix", "bloomd:", "prefix of the Redis keys of the redis backend")
+	expiration := flag.Duration("expiration", 0, "expiration of the Redis keys of the redis backend, 0 for none")
+	flag.Parse()
+
+	var newBitSet func(key string) bloom.BitSet
+	switch *backend {
+	case "memory":
+		newBitSet = func(string) bloom.BitSet { return bloom.NewMemoryBitSet() }
+	case "redis":
+		redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{*redisAddr}})
+		defer redisClient.Close()
+		newBitSet = func(key string) bloom.BitSet {
+			return bloom.NewRedisBitSet(redisClient, *keyPrefix+key, *expiration)
+		}
+	default:
+		log.Fatalf("bloomd: unknown backend %q", *backend)
+	}
+
+	srv := newServer(newBitSet)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		log.Print("bloomd: shutting down")
+		srv.Close()
+	}()
+
+	log.Printf("bloomd: listening on %s, %s backend", *addr, *backend)
+	if err := srv.ListenAndServe(*addr); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/HoangViet144/bloom/internal/resp"
+)
+
+// Defaults of a filter created implicitly by BF.ADD, BF.MADD or BF.INSERT,
+// the same as RedisBloom.
+const (
+	defaultCapacity  = 100
+	defaultErrorRate = 0.01
+)
+
+// maxFilterBits bounds the size of a filter, to the 2^32 bits of a Redis
+// string.
+const maxFilterBits = 1 << 32
+
+// filter is a Bloom filter with the parameters it was reserved with.
+type filter struct {
+	mu        sync.Mutex
+	bloom     bloom.BloomFilter
+	capacity  uint
+	errorRate float64
+	items     uint
+}
+
+// add adds item and returns whether it was newly added.
+func (f *filter) add(item []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.bloom.TestOrAdd(item) {
+		return false
+	}
+	f.items++
+	return true
+}
+
+func (f *filter) test(item []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.bloom.Test(item)
+}
+
+// server holds the filters served by bloomd.
+type server struct {
+	mu        sync.RWMutex
+	filters   map[string]*filter
+	newBitSet func(key string) bloom.BitSet
+}
+
+// newServer creates the RESP server of bloomd, storing the bits of the
+// filter named key in newBitSet(key).
+func newServer(newBitSet func(key string) bloom.BitSet) *resp.Server {
+	s := &server{
+		filters:   make(map[string]*filter),
+		newBitSet: newBitSet,
+	}
+	srv := resp.NewServer()
+	srv.Handle("MODULE", s.moduleList)
+	srv.Handle("DEL", s.del)
+	srv.Handle("BF.RESERVE", s.reserve)
+	srv.Handle("BF.ADD", s.add)
+	srv.Handle("BF.MADD", s.madd)
+	srv.Handle("BF.EXISTS", s.exists)
+	srv.Handle("BF.MEXISTS", s.mexists)
+	srv.Handle("BF.INFO", s.info)
+	srv.Handle("BF.INSERT", s.insert)
+	return srv
+}
+
+// get returns the filter named key, creating it with the given parameters
+// when create is true.
+func (s *server) get(key string, create bool, capacity uint, errorRate float64) *filter {
+	s.mu.RLock()
+	f, ok := s.filters[key]
+	s.mu.RUnlock()
+	if ok || !create {
+		return f
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok = s.filters[key]; ok {
+		return f
+	}
+	f = &filter{
+		bloom:     bloom.NewWithEstimates(capacity, errorRate, s.newBitSet(key)),
+		capacity:  capacity,
+		errorRate: errorRate,
+	}
+	s.filters[key] = f
+	return f
+}
+
+// moduleList answers MODULE LIST as if RedisBloom was loaded, so clients
+// detecting the module find it.
+func (s *server) moduleList(w *resp.Writer, args [][]byte) {
+	if len(args) != 2 || !strings.EqualFold(string(args[1]), "LIST") {
+		w.Error("ERR only MODULE LIST is supported")
+		return
+	}
+	w.Array(1)
+	w.Array(4)
+	w.BulkString("name")
+	w.BulkString("bf")
+	w.BulkString("ver")
+	w.Int(20612)
+}
+
+func (s *server) del(w *resp.Writer, args [][]byte) {
+	if len(args) < 2 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := int64(0)
+	for _, key := range args[1:] {
+		if f, ok := s.filters[string(key)]; ok {
+			f.bloom.ClearAll()
+			delete(s.filters, string(key))
+			deleted++
+		}
+	}
+	w.Int(deleted)
+}
+
+// reserve implements BF.RESERVE key error_rate capacity [EXPANSION expansion] [NONSCALING]
+func (s *server) reserve(w *resp.Writer, args [][]byte) {
+	if len(args) < 4 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	errorRate, capacity, msg := parseParameters(args[2], args[3])
+	if msg != "" {
+		w.Error(msg)
+		return
+	}
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "NONSCALING":
+		case "EXPANSION":
+			w.Error("ERR EXPANSION is not supported, filters do not scale")
+			return
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+	key := string(args[1])
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.filters[key]; ok {
+		w.Error("ERR item exists")
+		return
+	}
+	s.filters[key] = &filter{
+		bloom:     bloom.NewWithEstimates(capacity, errorRate, s.newBitSet(key)),
+		capacity:  capacity,
+		errorRate: errorRate,
+	}
+	w.SimpleString("OK")
+}
+
+// parseParameters parses the error rate and capacity of a filter, returning
+// an error message if they are invalid.
+func parseParameters(errorRateArg, capacityArg []byte) (float64, uint, string) {
+	errorRate, err := strconv.ParseFloat(string(errorRateArg), 64)
+	if err != nil || errorRate <= 0 || errorRate >= 1 {
+		return 0, 0, "ERR (0 < error rate range < 1)"
+	}
+	capacity, err := strconv.ParseUint(string(capacityArg), 10, strconv.IntSize)
+	if err != nil || capacity == 0 {
+		return 0, 0, "ERR (capacity should be larger than 0)"
+	}
+	// the number of bits of bloom.EstimateParameters, before it is rounded
+	// to a uint
+	if m := -float64(capacity) * math.Log(errorRate) / (math.Ln2 * math.Ln2); m > maxFilterBits {
+		return 0, 0, "ERR capacity too large for the error rate"
+	}
+	return errorRate, uint(capacity), ""
+}
+
+func (s *server) add(w *resp.Writer, args [][]byte) {
+	if len(args) != 3 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	f := s.get(string(args[1]), true, defaultCapacity, defaultErrorRate)
+	w.Bool(f.add(args[2]))
+}
+
+func (s *server) madd(w *resp.Writer, args [][]byte) {
+	if len(args) < 3 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	f := s.get(string(args[1]), true, defaultCapacity, defaultErrorRate)
+	w.Array(len(args) - 2)
+	for _, item := range args[2:] {
+		w.Bool(f.add(item))
+	}
+}
+
+func (s *server) exists(w *resp.Writer, args [][]byte) {
+	if len(args) != 3 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	f := s.get(string(args[1]), false, 0, 0)
+	w.Bool(f != nil && f.test(args[2]))
+}
+
+func (s *server) mexists(w *resp.Writer, args [][]byte) {
+	if len(args) < 3 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	f := s.get(string(args[1]), false, 0, 0)
+	w.Array(len(args) - 2)
+	for _, item := range args[2:] {
+		w.Bool(f != nil && f.test(item))
+	}
+}
+
+// info implements BF.INFO key [CAPACITY | SIZE | FILTERS | ITEMS | EXPANSION]
+func (s *server) info(w *resp.Writer, args [][]byte) {
+	if len(args) != 2 && len(args) != 3 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	f := s.get(string(args[1]), false, 0, 0)
+	if f == nil {
+		w.Error("ERR not found")
+		return
+	}
+	f.mu.Lock()
+	fields := []struct {
+		name, option string
+		value        int64
+	}{
+		{"Capacity", "CAPACITY", int64(f.capacity)},
+		{"Size", "SIZE", int64(f.bloom.Cap()+7) / 8},
+		{"Number of filters", "FILTERS", 1},
+		{"Number of items inserted", "ITEMS", int64(f.items)},
+		{"Expansion rate", "EXPANSION", 0},
+	}
+	f.mu.Unlock()
+
+	if len(args) == 3 {
+		option := strings.ToUpper(string(args[2]))
+		for _, field := range fields {
+			if field.option == option {
+				w.Array(1)
+				w.Int(field.value)
+				return
+			}
+		}
+		w.Error("ERR Invalid information value")
+		return
+	}
+	w.Array(2 * len(fields))
+	for _, field := range fields {
+		w.SimpleString(field.name)
+		w.Int(field.value)
+	}
+}
+
+// insert implements BF.INSERT key [CAPACITY capacity] [ERROR error]
+// [EXPANSION expansion] [NOCREATE] [NONSCALING] ITEMS item [item ...]
+func (s *server) insert(w *resp.Writer, args [][]byte) {
+	if len(args) < 4 {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	capacityArg := []byte(strconv.Itoa(defaultCapacity))
+	errorRateArg := []byte(strconv.FormatFloat(defaultErrorRate, 'f', -1, 64))
+	create := true
+	i := 2
+options:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i])) {
+		case "CAPACITY", "ERROR", "EXPANSION":
+			if i+1 >= len(args) {
+				w.Error("ERR syntax error")
+				return
+			}
+			switch strings.ToUpper(string(args[i])) {
+			case "CAPACITY":
+				capacityArg = args[i+1]
+			case "ERROR":
+				errorRateArg = args[i+1]
+			case "EXPANSION":
+				w.Error("ERR EXPANSION is not supported, filters do not scale")
+				return
+			}
+			i++
+		case "NOCREATE":
+			create = false
+		case "NONSCALING":
+		case "ITEMS":
+			i++
+			break options
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+	if i >= len(args) {
+		w.Error(resp.WrongArity(args))
+		return
+	}
+	errorRate, capacity, msg := parseParameters(errorRateArg, capacityArg)
+	if msg != "" {
+		w.Error(msg)
+		return
+	}
+	f := s.get(string(args[1]), create, capacity, errorRate)
+	if f == nil {
+		w.Error("ERR not found")
+		return
+	}
+	w.Array(len(args) - i)
+	for _, item := range args[i:] {
+		w.Bool(f.add(item))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/HoangViet144/bloom"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+// startServer starts bloomd on a random port and returns a client to it.
+func startServer(t *testing.T, newBitSet func(key string) bloom.BitSet) redis.UniversalClient {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newServer(newBitSet)
+	go srv.Serve(l)
+	client := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{l.Addr().String()}})
+	t.Cleanup(func() {
+		client.Close()
+		srv.Close()
+	})
+	return client
+}
+
+func memoryBitSet(string) bloom.BitSet {
+	return bloom.NewMemoryBitSet()
+}
+
+func TestCommands(t *testing.T) {
+	client := startServer(t, memoryBitSet)
+	ctx := context.Background()
+
+	if err := client.Do(ctx, "BF.RESERVE", "f", 0.001, 1000).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Do(ctx, "BF.RESERVE", "f", 0.001, 1000).Err(); err == nil {
+		t.Error("reserving an existing filter should fail")
+	}
+	if added, _ := client.Do(ctx, "BF.ADD", "f", "Bess").Bool(); !added {
+		t.Error("Bess should be newly added")
+	}
+	if added, _ := client.Do(ctx, "BF.ADD", "f", "Bess").Bool(); added {
+		t.Error("Bess should already be in")
+	}
+	added, err := client.Do(ctx, "BF.MADD", "f", "Bess", "Jane").BoolSlice()
+	if err != nil || added[0] || !added[1] {
+		t.Errorf("unexpected BF.MADD result %v %v", added, err)
+	}
+	if exists, _ := client.Do(ctx, "BF.EXISTS", "f", "Jane").Bool(); !exists {
+		t.Error("Jane should be in")
+	}
+	if exists, _ := client.Do(ctx, "BF.EXISTS", "missing", "Jane").Bool(); exists {
+		t.Error("a missing filter should not contain anything")
+	}
+	exists, err := client.Do(ctx, "BF.MEXISTS", "f", "Bess", "Emma").BoolSlice()
+	if err != nil || !exists[0] || exists[1] {
+		t.Errorf("unexpected BF.MEXISTS result %v %v", exists, err)
+	}
+
+	info, err := client.Do(ctx, "BF.INFO", "f").Slice()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info[0] != "Capacity" || info[1] != int64(1000) || info[7] != int64(2) {
+		t.Errorf("unexpected BF.INFO reply %v", info)
+	}
+	items, err := client.Do(ctx, "BF.INFO", "f", "ITEMS").Int64Slice()
+	if err != nil || items[0] != 2 {
+		t.Errorf("unexpected BF.INFO ITEMS reply %v %v", items, err)
+	}
+
+	inserted, err := client.Do(ctx, "BF.INSERT", "g", "CAPACITY", 500, "ERROR", 0.01, "ITEMS", "Emma", "Emma").BoolSlice()
+	if err != nil || !inserted[0] || inserted[1] {
+		t.Errorf("unexpected BF.INSERT result %v %v", inserted, err)
+	}
+	if err := client.Do(ctx, "BF.INSERT", "h", "NOCREATE", "ITEMS", "Emma").Err(); err == nil {
+		t.Error("BF.INSERT NOCREATE should not create a filter")
+	}
+	if err := client.Do(ctx, "BF.INSERT", "h", "ITEMS").Err(); err == nil {
+		t.Error("BF.INSERT without items should fail")
+	}
+
+	// filters larger than a Redis string are refused, the server goes on
+	if err := client.Do(ctx, "BF.RESERVE", "huge", 0.01, uint64(1000000000000)).Err(); err == nil {
+		t.Error("reserving a filter of 10^12 keys should fail")
+	}
+	if err := client.Do(ctx, "BF.INSERT", "huge", "CAPACITY", uint64(1000000000000), "ITEMS", "Emma").Err(); err == nil {
+		t.Error("inserting into a filter of 10^12 keys should fail")
+	}
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisBloomClient(t *testing.T) {
+	client := startServer(t, memoryBitSet)
+	ctx := context.Background()
+
+	if ok, err := bloom.HasRedisBloom(ctx, client); err != nil || !ok {
+		t.Fatalf("bloomd should look like RedisBloom: %v", err)
+	}
+	f, err := bloom.NewRedisBloomFilter(ctx, client, "f", 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddString("Bess")
+	if !f.TestString("Bess") || f.TestString("Jane") {
+		t.Error("unexpected membership")
+	}
+}
+
+func TestRedisBackend(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	prefix := uuid.New().String() + ":"
+	client := startServer(t, func(key string) bloom.BitSet {
+		return bloom.NewRedisBitSet(redisClient, prefix+key, time.Minute)
+	})
+	ctx := context.Background()
+
+	if err := client.Do(ctx, "BF.ADD", "f", "Bess").Err(); err != nil {
+		t.Fatal(err)
+	}
+	if redisClient.BitCount(ctx, prefix+"f", nil).Val() == 0 {
+		t.Error("the bits should be stored in redis")
+	}
+}
+
+func TestProtocolError(t *testing.T) {
+	client := startServer(t, memoryBitSet)
+	conn, err := net.Dial("tcp", client.(*redis.Client).Options().Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Write([]byte("*9223372036854775807\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 64)
+	n, _ := conn.Read(reply)
+	if string(reply[:n]) != "-ERR Protocol error\r\n" {
+		t.Errorf("unexpected reply %q", reply[:n])
+	}
+	// the server survives the malformed command
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,587 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Parameters of the Count-Min sketches: the size of the header written by
+// WriteTo, the largest counter, counters saturating there, the number of
+// counters incremented per BITFIELD command when merging into a Redis
+// string, and the field of the total count in a Redis hash.
+const (
+	cmsHeaderSize  = 24
+	cmsMaxCounter  = math.MaxUint32
+	cmsChunkLength = 1000
+	cmsTotalField  = "total"
+)
+
+// ErrInvalidCountMinSketch is returned when reading a CountMinSketch from a
+// stream that does not hold one.
+var ErrInvalidCountMinSketch = errors.New("bloom: invalid count-min sketch")
+
+// ErrIncompatibleSketch is returned when merging sketches of different
+// dimensions.
+var ErrIncompatibleSketch = errors.New("bloom: sketches of different dimensions")
+
+// CountMinSketch is a Count-Min sketch (Cormode and Muthukrishnan), counting
+// how many times keys were added. It has d rows of w counters, and a key
+// maps to one counter per row, with the locations of the Bloom filters of
+// this package. Adding a key increments its d counters, and its estimate is
+// the smallest of them: it is never below the true count, and exceeds it by
+// at most epsilon times the total count with probability 1-delta, for w =
+// e/epsilon and d = ln(1/delta).
+//
+// With conservative update, adding n only raises the counters of the key to
+// their smallest value plus n, which improves the estimates of the keys
+// sharing counters. Both kinds of updates can be mixed.
+//
+// The counters are stored in memory, in a Redis string updated with BITFIELD
+// (NewRedisCountMinSketch), or in a Redis hash updated with HINCRBY
+// (NewRedisHashCountMinSketch), holding only the non zero counters. An
+// in-memory sketch is not safe for concurrent use.
+type CountMinSketch struct {
+	w, d         uint
+	conservative bool
+	store        countMinStore
+}
+
+// EstimateCountMinParameters returns the width w and the depth d of a
+// Count-Min sketch whose estimates exceed the true counts by at most epsilon
+// times the total count, with probability 1-delta.
+func EstimateCountMinParameters(epsilon, delta float64) (w, d uint) {
+	w = max(1, uint(math.Ceil(math.E/epsilon)))
+	d = max(1, uint(math.Ceil(math.Log(1/delta))))
+	return
+}
+
+// NewCountMinSketch creates an in-memory Count-Min sketch of d rows of w
+// counters.
+func NewCountMinSketch(w, d uint) *CountMinSketch {
+	w, d = max(1, w), max(1, d)
+	return &CountMinSketch{w: w, d: d, store: &memoryCountMinStore{counters: make([]uint32, w*d)}}
+}
+
+// NewCountMinSketchWithEstimates creates an in-memory Count-Min sketch of
+// epsilon error with probability 1-delta, see EstimateCountMinParameters.
+func NewCountMinSketchWithEstimates(epsilon, delta float64) *CountMinSketch {
+	return NewCountMinSketch(EstimateCountMinParameters(epsilon, delta))
+}
+
+// NewRedisCountMinSketch creates a Count-Min sketch of d rows of w counters,
+// stored in the Redis string key: the total count as a 64-bit integer, then
+// the counters, in the format of WriteTo. A non conservative add is a single
+// BITFIELD command.
+func NewRedisCountMinSketch(redisClient redis.UniversalClient, key string, w, d uint) *CountMinSketch {
+	w, d = max(1, w), max(1, d)
+	return &CountMinSketch{w: w, d: d, store: &redisCountMinStore{redisClient: redisClient, key: key, size: w * d}}
+}
+
+// NewRedisHashCountMinSketch creates a Count-Min sketch of d rows of w
+// counters, stored in the Redis hash key: a field per non zero counter,
+// named after its index, and the total count in the field "total". The
+// counters are incremented with HINCRBY, and read saturated to 32 bits.
+func NewRedisHashCountMinSketch(redisClient redis.UniversalClient, key string, w, d uint) *CountMinSketch {
+	w, d = max(1, w), max(1, d)
+	return &CountMinSketch{w: w, d: d, store: &redisHashCountMinStore{redisClient: redisClient, key: key, size: w * d}}
+}
+
+// Width returns the number of counters of a row, w.
+func (s *CountMinSketch) Width() uint {
+	return s.w
+}
+
+// Depth returns the number of rows, d.
+func (s *CountMinSketch) Depth() uint {
+	return s.d
+}
+
+// SetConservative sets whether keys are added with conservative update.
+func (s *CountMinSketch) SetConservative(conservative bool) {
+	s.conservative = conservative
+}
+
+// Conservative returns whether keys are added with conservative update.
+func (s *CountMinSketch) Conservative() bool {
+	return s.conservative
+}
+
+// counters appends the indexes of the counters of the key of base hash
+// values h to dst, one per row.
+func (s *CountMinSketch) counters(h [4]uint64, dst []uint) []uint {
+	for i := uint(0); i < s.d; i++ {
+		dst = append(dst, i*s.w+uint(location(h, i)%uint64(s.w)))
+	}
+	return dst
+}
+
+// Add adds n to the count of data.
+func (s *CountMinSketch) Add(ctx context.Context, data []byte, n uint64) error {
+	return s.AddHashes(ctx, baseHashes(data), n)
+}
+
+// AddString adds n to the count of data.
+func (s *CountMinSketch) AddString(ctx context.Context, data string, n uint64) error {
+	return s.AddHashes(ctx, HashesString(data), n)
+}
+
+// AddHashes adds n to the count of the key of base hash values h.
+func (s *CountMinSketch) AddHashes(ctx context.Context, h [4]uint64, n uint64) error {
+	var buf [32]uint
+	idx := s.counters(h, buf[:0])
+	if s.conservative {
+		return s.store.raise(ctx, idx, n)
+	}
+	return s.store.add(ctx, idx, n)
+}
+
+// Estimate returns the estimated count of data, never below its true count.
+func (s *CountMinSketch) Estimate(ctx context.Context, data []byte) (uint64, error) {
+	return s.EstimateHashes(ctx, baseHashes(data))
+}
+
+// EstimateString returns the estimated count of data, see Estimate.
+func (s *CountMinSketch) EstimateString(ctx context.Context, data string) (uint64, error) {
+	return s.EstimateHashes(ctx, HashesString(data))
+}
+
+// EstimateHashes returns the estimated count of the key of base hash values
+// h.
+func (s *CountMinSketch) EstimateHashes(ctx context.Context, h [4]uint64) (uint64, error) {
+	var buf [32]uint
+	values, err := s.store.get(ctx, s.counters(h, buf[:0]))
+	if err != nil {
+		return 0, err
+	}
+	return minCounter(values), nil
+}
+
+// Count returns the total count of the keys added.
+func (s *CountMinSketch) Count(ctx context.Context) (uint64, error) {
+	_, total, err := s.store.all(ctx, false)
+	return total, err
+}
+
+// Merge adds the counts of g to the sketch. Both sketches must have the same
+// dimensions, and their keys are counted as if they were added to one.
+func (s *CountMinSketch) Merge(ctx context.Context, g *CountMinSketch) error {
+	if s.w != g.w || s.d != g.d {
+		return ErrIncompatibleSketch
+	}
+	counters, total, err := g.store.all(ctx, true)
+	if err != nil {
+		return err
+	}
+	return s.store.merge(ctx, counters, total)
+}
+
+// ClearAll resets all the counts.
+func (s *CountMinSketch) ClearAll(ctx context.Context) error {
+	return s.store.replace(ctx, make([]uint32, s.w*s.d), 0)
+}
+
+// WriteTo writes the sketch to an i/o stream: w and d as big-endian uint64,
+// the total count as a big-endian uint64, then the counters, row by row, as
+// big-endian uint32. It returns the number of bytes written.
+func (s *CountMinSketch) WriteTo(stream io.Writer) (int64, error) {
+	counters, total, err := s.store.all(context.Background(), true)
+	if err != nil {
+		return 0, err
+	}
+	data := make([]byte, cmsHeaderSize+4*len(counters))
+	binary.BigEndian.PutUint64(data, uint64(s.w))
+	binary.BigEndian.PutUint64(data[8:], uint64(s.d))
+	encodeCounters(data[16:], total, counters)
+	n, err := stream.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom reads a sketch written by WriteTo from an i/o stream, replacing
+// the dimensions and the counts of the sketch. It returns the number of
+// bytes read.
+func (s *CountMinSketch) ReadFrom(stream io.Reader) (int64, error) {
+	var header [cmsHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	w, d := binary.BigEndian.Uint64(header[:]), binary.BigEndian.Uint64(header[8:])
+	if w < 1 || d < 1 || d > 64 || w > 1<<32 || 4*w*d > 1<<36 {
+		return int64(n), ErrInvalidCountMinSketch
+	}
+	var counters []uint32
+	m, err := readRecords(stream, w*d, 4, func(chunk []byte) {
+		for i := 0; i < len(chunk); i += 4 {
+			counters = append(counters, binary.BigEndian.Uint32(chunk[i:]))
+		}
+	})
+	if err != nil {
+		return int64(n) + m, err
+	}
+	if err := s.store.replace(context.Background(), counters, binary.BigEndian.Uint64(header[16:])); err != nil {
+		return int64(n) + m, err
+	}
+	s.w, s.d = uint(w), uint(d)
+	return int64(n) + m, nil
+}
+
+// encodeCounters writes the total count then the counters into data, as
+// stored in Redis strings.
+func encodeCounters(data []byte, total uint64, counters []uint32) {
+	binary.BigEndian.PutUint64(data, total)
+	for i, c := range counters {
+		binary.BigEndian.PutUint32(data[8+4*i:], c)
+	}
+}
+
+func minCounter(values []uint64) uint64 {
+	least := uint64(math.MaxUint64)
+	for _, v := range values {
+		if v < least {
+			least = v
+		}
+	}
+	return least
+}
+
+// saturatedAdd returns c+n, saturated to cmsMaxCounter.
+func saturatedAdd(c, n uint64) uint64 {
+	if n > cmsMaxCounter-c {
+		return cmsMaxCounter
+	}
+	return c + n
+}
+
+// countMinStore stores the counters and the total count of a
+// CountMinSketch.
+type countMinStore interface {
+	// add adds n to the counters of idx and to the total
+	add(ctx context.Context, idx []uint, n uint64) error
+	// raise raises the counters of idx to at least their minimum plus n, and
+	// adds n to the total
+	raise(ctx context.Context, idx []uint, n uint64) error
+	// get returns the counters of idx
+	get(ctx context.Context, idx []uint) ([]uint64, error)
+	// all returns the total, and all the counters if counters is true
+	all(ctx context.Context, counters bool) ([]uint32, uint64, error)
+	// merge adds counters and total to the counters and the total
+	merge(ctx context.Context, counters []uint32, total uint64) error
+	// replace replaces the counters and the total
+	replace(ctx context.Context, counters []uint32, total uint64) error
+}
+
+// memoryCountMinStore keeps the counters in memory.
+type memoryCountMinStore struct {
+	counters []uint32
+	total    uint64
+}
+
+func (s *memoryCountMinStore) add(_ context.Context, idx []uint, n uint64) error {
+	for _, i := range idx {
+		s.counters[i] = uint32(saturatedAdd(uint64(s.counters[i]), n))
+	}
+	s.total += n
+	return nil
+}
+
+func (s *memoryCountMinStore) raise(ctx context.Context, idx []uint, n uint64) error {
+	values, _ := s.get(ctx, idx)
+	target := uint32(saturatedAdd(minCounter(values), n))
+	for _, i := range idx {
+		if s.counters[i] < target {
+			s.counters[i] = target
+		}
+	}
+	s.total += n
+	return nil
+}
+
+func (s *memoryCountMinStore) get(_ context.Context, idx []uint) ([]uint64, error) {
+	values := make([]uint64, len(idx))
+	for j, i := range idx {
+		values[j] = uint64(s.counters[i])
+	}
+	return values, nil
+}
+
+func (s *memoryCountMinStore) all(_ context.Context, counters bool) ([]uint32, uint64, error) {
+	if !counters {
+		return nil, s.total, nil
+	}
+	return append([]uint32(nil), s.counters...), s.total, nil
+}
+
+func (s *memoryCountMinStore) merge(_ context.Context, counters []uint32, total uint64) error {
+	for i, c := range counters {
+		s.counters[i] = uint32(saturatedAdd(uint64(s.counters[i]), uint64(c)))
+	}
+	s.total += total
+	return nil
+}
+
+func (s *memoryCountMinStore) replace(_ context.Context, counters []uint32, total uint64) error {
+	s.counters, s.total = counters, total
+	return nil
+}
+
+// redisCountMinStore keeps the total count and the size counters in a Redis
+// string, as a BITFIELD i64 at offset 0 followed by u32 counters.
+type redisCountMinStore struct {
+	redisClient redis.UniversalClient
+	key         string
+	size        uint
+}
+
+// counterOffset returns the BITFIELD offset of counter i, past the total.
+func counterOffset(i uint) string {
+	return "#" + strconv.FormatUint(uint64(i)+2, 10)
+}
+
+func (s *redisCountMinStore) add(ctx context.Context, idx []uint, n uint64) error {
+	args := make([]interface{}, 0, 2+4*len(idx)+4)
+	args = append(args, "OVERFLOW", "SAT")
+	for _, i := range idx {
+		args = append(args, "INCRBY", "u32", counterOffset(i), saturatedAdd(0, n))
+	}
+	args = append(args, "INCRBY", "i64", "#0", n)
+	return s.redisClient.BitField(ctx, s.key, args...).Err()
+}
+
+func (s *redisCountMinStore) raise(ctx context.Context, idx []uint, n uint64) error {
+	return watchKey(ctx, s.redisClient, s.key, func(tx *redis.Tx) error {
+		values, err := s.read(ctx, tx, idx)
+		if err != nil {
+			return err
+		}
+		target := saturatedAdd(minCounter(values), n)
+		args := []interface{}{"OVERFLOW", "SAT"}
+		for j, i := range idx {
+			if values[j] < target {
+				args = append(args, "SET", "u32", counterOffset(i), target)
+			}
+		}
+		args = append(args, "INCRBY", "i64", "#0", n)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.BitField(ctx, s.key, args...)
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *redisCountMinStore) read(ctx context.Context, client redis.Cmdable, idx []uint) ([]uint64, error) {
+	args := make([]interface{}, 0, 3*len(idx))
+	for _, i := range idx {
+		args = append(args, "GET", "u32", counterOffset(i))
+	}
+	values, err := client.BitField(ctx, s.key, args...).Result()
+	if err != nil {
+		return nil, err
+	}
+	counters := make([]uint64, len(values))
+	for j, v := range values {
+		counters[j] = uint64(v)
+	}
+	return counters, nil
+}
+
+func (s *redisCountMinStore) get(ctx context.Context, idx []uint) ([]uint64, error) {
+	return s.read(ctx, s.redisClient, idx)
+}
+
+func (s *redisCountMinStore) all(ctx context.Context, counters bool) ([]uint32, uint64, error) {
+	if !counters {
+		values, err := s.redisClient.BitField(ctx, s.key, "GET", "i64", "#0").Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		return nil, uint64(values[0]), nil
+	}
+	data, err := s.redisClient.Get(ctx, s.key).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+	if size := int(8 + 4*s.size); len(data) < size {
+		data = append(data, make([]byte, size-len(data))...)
+	}
+	values := make([]uint32, s.size)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint32(data[8+4*i:])
+	}
+	return values, binary.BigEndian.Uint64(data), nil
+}
+
+func (s *redisCountMinStore) merge(ctx context.Context, counters []uint32, total uint64) error {
+	// the increments of the non zero counters, in a single transaction
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		args := []interface{}{"OVERFLOW", "SAT", "INCRBY", "i64", "#0", total}
+		for i, c := range counters {
+			if c == 0 {
+				continue
+			}
+			args = append(args, "INCRBY", "u32", counterOffset(uint(i)), c)
+			if len(args) >= 4*cmsChunkLength {
+				pipe.BitField(ctx, s.key, args...)
+				args = []interface{}{"OVERFLOW", "SAT"}
+			}
+		}
+		pipe.BitField(ctx, s.key, args...)
+		return nil
+	})
+	return err
+}
+
+func (s *redisCountMinStore) replace(ctx context.Context, counters []uint32, total uint64) error {
+	data := make([]byte, 8+4*len(counters))
+	encodeCounters(data, total, counters)
+	s.size = uint(len(counters))
+	return s.redisClient.Set(ctx, s.key, data, redis.KeepTTL).Err()
+}
+
+// redisHashCountMinStore keeps the non zero counters in a Redis hash, in
+// fields named after their index, and the total count in the field "total".
+type redisHashCountMinStore struct {
+	redisClient redis.UniversalClient
+	key         string
+	size        uint
+}
+
+func counterField(i uint) string {
+	return strconv.FormatUint(uint64(i), 10)
+}
+
+func (s *redisHashCountMinStore) add(ctx context.Context, idx []uint, n uint64) error {
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, i := range idx {
+			pipe.HIncrBy(ctx, s.key, counterField(i), int64(n))
+		}
+		pipe.HIncrBy(ctx, s.key, cmsTotalField, int64(n))
+		return nil
+	})
+	return err
+}
+
+func (s *redisHashCountMinStore) raise(ctx context.Context, idx []uint, n uint64) error {
+	return watchKey(ctx, s.redisClient, s.key, func(tx *redis.Tx) error {
+		values, err := s.read(ctx, tx, idx)
+		if err != nil {
+			return err
+		}
+		target := saturatedAdd(minCounter(values), n)
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for j, i := range idx {
+				if values[j] < target {
+					pipe.HSet(ctx, s.key, counterField(i), target)
+				}
+			}
+			pipe.HIncrBy(ctx, s.key, cmsTotalField, int64(n))
+			return nil
+		})
+		return err
+	})
+}
+
+// read returns the counters of idx, saturated to 32 bits.
+func (s *redisHashCountMinStore) read(ctx context.Context, client redis.Cmdable, idx []uint) ([]uint64, error) {
+	fields := make([]string, len(idx))
+	for j, i := range idx {
+		fields[j] = counterField(i)
+	}
+	values, err := client.HMGet(ctx, s.key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+	counters := make([]uint64, len(values))
+	for j, v := range values {
+		if v == nil {
+			continue
+		}
+		if counters[j], err = parseCounter(v.(string)); err != nil {
+			return nil, err
+		}
+	}
+	return counters, nil
+}
+
+// parseCounter parses the value of a counter field, saturated to 32 bits.
+func parseCounter(v string) (uint64, error) {
+	c, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return saturatedAdd(0, c), nil
+}
+
+func (s *redisHashCountMinStore) get(ctx context.Context, idx []uint) ([]uint64, error) {
+	return s.read(ctx, s.redisClient, idx)
+}
+
+func (s *redisHashCountMinStore) all(ctx context.Context, counters bool) ([]uint32, uint64, error) {
+	if !counters {
+		total, err := s.redisClient.HGet(ctx, s.key, cmsTotalField).Uint64()
+		if err == redis.Nil {
+			err = nil
+		}
+		return nil, total, err
+	}
+	fields, err := s.redisClient.HGetAll(ctx, s.key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	values := make([]uint32, s.size)
+	var total uint64
+	for field, v := range fields {
+		c, err := parseCounter(v)
+		if err != nil {
+			return nil, 0, err
+		}
+		if field == cmsTotalField {
+			total, err = strconv.ParseUint(v, 10, 64)
+			if err != nil {
+				return nil, 0, err
+			}
+			continue
+		}
+		i, err := strconv.ParseUint(field, 10, 64)
+		if err != nil || i >= uint64(s.size) {
+			return nil, 0, ErrInvalidCountMinSketch
+		}
+		values[i] = uint32(c)
+	}
+	return values, total, nil
+}
+
+func (s *redisHashCountMinStore) merge(ctx context.Context, counters []uint32, total uint64) error {
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, c := range counters {
+			if c != 0 {
+				pipe.HIncrBy(ctx, s.key, counterField(uint(i)), int64(c))
+			}
+		}
+		pipe.HIncrBy(ctx, s.key, cmsTotalField, int64(total))
+		return nil
+	})
+	return err
+}
+
+func (s *redisHashCountMinStore) replace(ctx context.Context, counters []uint32, total uint64) error {
+	_, err := s.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, s.key)
+		values := []interface{}{cmsTotalField, total}
+		for i, c := range counters {
+			if c != 0 {
+				values = append(values, counterField(uint(i)), c)
+			}
+		}
+		pipe.HSet(ctx, s.key, values...)
+		return nil
+	})
+	s.size = uint(len(counters))
+	return err
+}
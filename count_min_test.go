@@ -0,0 +1,203 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestEstimateCountMinParameters(t *testing.T) {
+	if w, d := EstimateCountMinParameters(0.001, 0.01); w != 2719 || d != 5 {
+		t.Errorf("unexpected w=%d d=%d", w, d)
+	}
+}
+
+func testCountMinSketch(t *testing.T, s *CountMinSketch, keys int) {
+	ctx := context.Background()
+	rng := rand.New(rand.NewSource(1))
+	counts := make(map[string]uint64)
+	var total uint64
+	for i := 0; i < 4*keys; i++ {
+		// a skewed stream, where a few keys are frequent
+		key := "key" + strconv.Itoa(rng.Intn(1+rng.Intn(keys)))
+		n := uint64(1 + rng.Intn(3))
+		if err := s.AddString(ctx, key, n); err != nil {
+			t.Fatal(err)
+		}
+		counts[key] += n
+		total += n
+	}
+	if count, err := s.Count(ctx); err != nil || count != total {
+		t.Errorf("unexpected total count %d, %v", count, err)
+	}
+	bound := uint64(2.72 * float64(total) / float64(s.Width()))
+	over := 0
+	for key, count := range counts {
+		estimate, err := s.EstimateString(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if estimate < count {
+			t.Fatalf("%s: estimate %d below count %d", key, estimate, count)
+		}
+		if estimate > count+bound {
+			over++
+		}
+	}
+	if over > len(counts)/20 {
+		t.Errorf("%d of %d estimates over the error bound", over, len(counts))
+	}
+	if estimate, _ := s.Estimate(ctx, []byte("missing")); estimate > bound {
+		t.Errorf("estimate of a missing key %d over the error bound", estimate)
+	}
+
+	if err := s.ClearAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if estimate, _ := s.EstimateString(ctx, "key0"); estimate != 0 {
+		t.Errorf("estimate %d after ClearAll", estimate)
+	}
+}
+
+func TestCountMinSketch(t *testing.T) {
+	testCountMinSketch(t, NewCountMinSketchWithEstimates(0.01, 0.01), 2000)
+	s := NewCountMinSketchWithEstimates(0.01, 0.01)
+	s.SetConservative(true)
+	testCountMinSketch(t, s, 2000)
+}
+
+func TestRedisCountMinSketch(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	for _, conservative := range []bool{false, true} {
+		key, hashKey := uuid.New().String(), uuid.New().String()
+		defer redisClient.Del(context.Background(), key, hashKey)
+		s := NewRedisCountMinSketch(redisClient, key, 300, 4)
+		s.SetConservative(conservative)
+		testCountMinSketch(t, s, 200)
+		s = NewRedisHashCountMinSketch(redisClient, hashKey, 300, 4)
+		s.SetConservative(conservative)
+		testCountMinSketch(t, s, 200)
+	}
+}
+
+func TestConservativeUpdate(t *testing.T) {
+	ctx := context.Background()
+	s, c := NewCountMinSketch(50, 3), NewCountMinSketch(50, 3)
+	c.SetConservative(true)
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i % 100)
+		s.AddString(ctx, key, 1)
+		c.AddString(ctx, key, 1)
+	}
+	var errS, errC uint64
+	for i := 0; i < 100; i++ {
+		es, _ := s.EstimateString(ctx, strconv.Itoa(i))
+		ec, _ := c.EstimateString(ctx, strconv.Itoa(i))
+		if ec < 10 || ec > es {
+			t.Fatalf("%d: conservative estimate %d, estimate %d", i, ec, es)
+		}
+		errS += es - 10
+		errC += ec - 10
+	}
+	if errC >= errS {
+		t.Errorf("conservative update should reduce the error: %d >= %d", errC, errS)
+	}
+}
+
+func TestCountMinSketchMerge(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key, hashKey := uuid.New().String(), uuid.New().String()
+	defer redisClient.Del(ctx, key, hashKey)
+
+	f := NewCountMinSketch(100, 4)
+	f.AddString(ctx, "Love", 3)
+	for _, s := range []*CountMinSketch{
+		NewCountMinSketch(100, 4),
+		NewRedisCountMinSketch(redisClient, key, 100, 4),
+		NewRedisHashCountMinSketch(redisClient, hashKey, 100, 4),
+	} {
+		s.AddString(ctx, "Love", 2)
+		s.AddString(ctx, "Peace", 1)
+		if err := s.Merge(ctx, f); err != nil {
+			t.Fatal(err)
+		}
+		if estimate, _ := s.EstimateString(ctx, "Love"); estimate != 5 {
+			t.Errorf("unexpected estimate %d after Merge", estimate)
+		}
+		if count, _ := s.Count(ctx); count != 6 {
+			t.Errorf("unexpected total count %d after Merge", count)
+		}
+		g := NewCountMinSketch(100, 4)
+		if err := g.Merge(ctx, s); err != nil {
+			t.Fatal(err)
+		}
+		if estimate, _ := g.EstimateString(ctx, "Peace"); estimate != 1 {
+			t.Errorf("unexpected estimate %d after merging from another sketch", estimate)
+		}
+	}
+	if err := f.Merge(ctx, NewCountMinSketch(100, 3)); err != ErrIncompatibleSketch {
+		t.Errorf("expected ErrIncompatibleSketch, got %v", err)
+	}
+}
+
+func TestCountMinSketchReadWrite(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key, hashKey := uuid.New().String(), uuid.New().String()
+	defer redisClient.Del(ctx, key, hashKey)
+
+	f := NewCountMinSketch(200, 5)
+	for i := 0; i < 100; i++ {
+		f.AddString(ctx, strconv.Itoa(i), uint64(i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	for _, g := range []*CountMinSketch{
+		NewCountMinSketch(1, 1),
+		NewRedisCountMinSketch(redisClient, key, 1, 1),
+		NewRedisHashCountMinSketch(redisClient, hashKey, 1, 1),
+	} {
+		bytesRead, err := g.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytesRead != bytesWritten {
+			t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+		}
+		if g.Width() != 200 || g.Depth() != 5 {
+			t.Errorf("unexpected dimensions %d, %d", g.Width(), g.Depth())
+		}
+		for i := 0; i < 100; i++ {
+			e1, _ := f.EstimateString(ctx, strconv.Itoa(i))
+			if e2, err := g.EstimateString(ctx, strconv.Itoa(i)); err != nil || e1 != e2 {
+				t.Fatalf("%d: estimates differ %d != %d, %v", i, e1, e2, err)
+			}
+		}
+		var out bytes.Buffer
+		if _, err := g.WriteTo(&out); err != nil || !bytes.Equal(out.Bytes(), data) {
+			t.Errorf("the sketch should be written back the same, %v", err)
+		}
+	}
+
+	if _, err := f.ReadFrom(bytes.NewReader(make([]byte, cmsHeaderSize))); err != ErrInvalidCountMinSketch {
+		t.Errorf("expected ErrInvalidCountMinSketch, got %v", err)
+	}
+	if _, err := f.ReadFrom(bytes.NewReader(bigEndianHeader(1<<32, 16, 0))); err != ErrInvalidCountMinSketch {
+		t.Errorf("expected ErrInvalidCountMinSketch, got %v", err)
+	}
+	// the counters are allocated as they are read
+	if _, err := f.ReadFrom(bytes.NewReader(bigEndianHeader(1<<28, 4, 0))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,403 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/bits"
+	"sort"
+	"sync"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// patchEntrySize is the size of a word of a patch written by WriteTo: its
+// index and its bits, as big-endian uint64.
+const patchEntrySize = 16
+
+// patchReadWords is the number of words ReadFrom reads at a time, so that
+// the memory it allocates is bounded by the size of the stream, not by the
+// length it claims.
+const patchReadWords = 4096
+
+// ErrInvalidPatch is returned when reading a Patch from a stream that does
+// not hold one.
+var ErrInvalidPatch = errors.New("bloom: invalid patch")
+
+// Patch is a set of bits to set in a BitSet, to bring a replica up to date
+// with the changes of another one without shipping the whole bitset. The
+// bits are grouped by 64-bit words: word i holds bits 64*i to 64*i+63, the
+// first one in its most significant bit, as the bytes 8*i to 8*i+7 of the
+// bitset in Redis bit order read as a big-endian uint64.
+//
+// A patch only sets bits: applying it ORs the words into the bitset, so
+// patches can be applied in any order, more than once, and to a replica
+// written concurrently. Bits cleared by UnSet or ClearAll are not
+// propagated.
+type Patch struct {
+	// the indexes of the words, sorted, and their bits
+	indexes []uint64
+	words   []uint64
+}
+
+// newPatch creates a patch of the non zero words of dirty.
+func newPatch(dirty map[uint64]uint64) *Patch {
+	p := &Patch{indexes: make([]uint64, 0, len(dirty))}
+	for i, w := range dirty {
+		if w != 0 {
+			p.indexes = append(p.indexes, i)
+		}
+	}
+	sort.Slice(p.indexes, func(a, b int) bool { return p.indexes[a] < p.indexes[b] })
+	p.words = make([]uint64, len(p.indexes))
+	for j, i := range p.indexes {
+		p.words[j] = dirty[i]
+	}
+	return p
+}
+
+// Diff returns the patch of the bits set in the snapshot current and not in
+// the snapshot previous, both the raw bits of a bitset in Redis bit order,
+// as returned by Snapshot.
+func Diff(previous, current []byte) *Patch {
+	p := &Patch{}
+	for i := 0; 8*i < len(current); i++ {
+		if w := snapshotWord(current, i) &^ snapshotWord(previous, i); w != 0 {
+			p.indexes = append(p.indexes, uint64(i))
+			p.words = append(p.words, w)
+		}
+	}
+	return p
+}
+
+// snapshotWord returns word i of the raw bits data, zero past its end.
+func snapshotWord(data []byte, i int) uint64 {
+	if 8*i+8 <= len(data) {
+		return binary.BigEndian.Uint64(data[8*i:])
+	}
+	var word [8]byte
+	if 8*i < len(data) {
+		copy(word[:], data[8*i:])
+	}
+	return binary.BigEndian.Uint64(word[:])
+}
+
+// Snapshot returns a copy of the raw bits of b, in Redis bit order, to be
+// compared later with Diff. The bits of a RedisBitSet are read with GET.
+func Snapshot(ctx context.Context, b BitSet) ([]byte, error) {
+	if r, ok := b.(*RedisBitSet); ok {
+		data, err := r.redisClient.Get(ctx, r.bitsetKey).Bytes()
+		if err == redis.Nil {
+			err = nil
+		}
+		return data, err
+	}
+	return append([]byte(nil), bitSetBytes(b)...), nil
+}
+
+// Len returns the number of words of the patch.
+func (p *Patch) Len() int {
+	return len(p.indexes)
+}
+
+// Count returns the number of bits of the patch.
+func (p *Patch) Count() uint {
+	var count int
+	for _, w := range p.words {
+		count += bits.OnesCount64(w)
+	}
+	return uint(count)
+}
+
+// Merge adds the bits of q to the patch.
+func (p *Patch) Merge(q *Patch) {
+	dirty := make(map[uint64]uint64, len(p.indexes)+len(q.indexes))
+	for _, r := range []*Patch{p, q} {
+		for j, i := range r.indexes {
+			dirty[i] |= r.words[j]
+		}
+	}
+	*p = *newPatch(dirty)
+}
+
+// lastBit returns the index of the last bit of a non empty patch.
+func (p *Patch) lastBit() uint64 {
+	j := len(p.indexes) - 1
+	return 64*p.indexes[j] + 63 - uint64(bits.TrailingZeros64(p.words[j]))
+}
+
+// patchBound returns the number of bits of b, bounding the patches applied
+// to it: the length of a bitset in memory or in a file, of a sharded bitset,
+// and the 2^32 bits of a Redis string for the others.
+func patchBound(b BitSet) uint64 {
+	switch c := b.(type) {
+	case *MemoryBitSet:
+		return 8 * uint64(len(c.data))
+	case *FileBitSet:
+		return 8 * uint64(len(c.bits()))
+	case *ShardedRedisBitSet:
+		return uint64(c.shards) * uint64(c.shardBits)
+	case *DeltaBitSet:
+		return patchBound(c.b)
+	default:
+		return maxShardBits
+	}
+}
+
+// bitIndexes returns the indexes of the bits of the patch.
+func (p *Patch) bitIndexes() []uint {
+	idx := make([]uint, 0, p.Count())
+	for j, i := range p.indexes {
+		for w := p.words[j]; w != 0; {
+			z := bits.LeadingZeros64(w)
+			idx = append(idx, uint(64*i)+uint(z))
+			w &^= 1 << (63 - z)
+		}
+	}
+	return idx
+}
+
+// Apply sets the bits of the patch in b. The bytes of a MemoryBitSet are
+// ORed in place, while the bits of other bitsets are set with SetBits, a
+// single pipeline for a RedisBitSet. It returns ErrInvalidPatch, setting no
+// bit, if the patch holds bits past the length of b, as set by Init, or for a
+// RedisBitSet, which does not keep its length, past the 2^32 bits of a Redis
+// string.
+func (p *Patch) Apply(ctx context.Context, b BitSet) error {
+	if len(p.indexes) > 0 && p.lastBit() >= patchBound(b) {
+		return ErrInvalidPatch
+	}
+	if d, ok := b.(*DeltaBitSet); ok {
+		// record the bits, so that they are passed on to further replicas
+		err := p.Apply(ctx, d.b)
+		if err == nil {
+			d.Restore(p)
+		}
+		return err
+	}
+	s, ok := b.(*MemoryBitSet)
+	if !ok {
+		return setBits(ctx, b, p.bitIndexes())
+	}
+	for j, i := range p.indexes {
+		for k := uint64(0); k < 8; k++ {
+			if v := byte(p.words[j] >> (56 - 8*k)); v != 0 {
+				s.data[8*i+k] |= v
+			}
+		}
+	}
+	return nil
+}
+
+// WriteTo writes the patch to an i/o stream: the number of words as a
+// big-endian uint64, then the index and the bits of each word as big-endian
+// uint64. It returns the number of bytes written.
+func (p *Patch) WriteTo(stream io.Writer) (int64, error) {
+	data := make([]byte, 8+patchEntrySize*len(p.indexes))
+	binary.BigEndian.PutUint64(data, uint64(len(p.indexes)))
+	for j, i := range p.indexes {
+		binary.BigEndian.PutUint64(data[8+patchEntrySize*j:], i)
+		binary.BigEndian.PutUint64(data[16+patchEntrySize*j:], p.words[j])
+	}
+	n, err := stream.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom reads a patch written by WriteTo from an i/o stream, replacing
+// the patch. It returns the number of bytes read.
+func (p *Patch) ReadFrom(stream io.Reader) (int64, error) {
+	var header [8]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	length := binary.BigEndian.Uint64(header[:])
+	if length > 1<<32 {
+		return int64(n), ErrInvalidPatch
+	}
+	capacity := length
+	if capacity > patchReadWords {
+		capacity = patchReadWords
+	}
+	q := &Patch{indexes: make([]uint64, 0, capacity), words: make([]uint64, 0, capacity)}
+	data := make([]byte, patchEntrySize*capacity)
+	total := int64(n)
+	for remaining := length; remaining > 0; {
+		chunk := data
+		if remaining < capacity {
+			chunk = data[:patchEntrySize*remaining]
+		}
+		m, err := io.ReadFull(stream, chunk)
+		total += int64(m)
+		if err != nil {
+			return total, err
+		}
+		for e := 0; e < len(chunk); e += patchEntrySize {
+			i, w := binary.BigEndian.Uint64(chunk[e:]), binary.BigEndian.Uint64(chunk[e+8:])
+			if i > 1<<40 || w == 0 || (len(q.indexes) > 0 && i <= q.indexes[len(q.indexes)-1]) {
+				return total, ErrInvalidPatch
+			}
+			q.indexes = append(q.indexes, i)
+			q.words = append(q.words, w)
+		}
+		remaining -= uint64(len(chunk) / patchEntrySize)
+	}
+	*p = *q
+	return total, nil
+}
+
+// NewDeltaBitSet creates a DeltaBitSet tracking the bits set in b.
+func NewDeltaBitSet(b BitSet) *DeltaBitSet {
+	return &DeltaBitSet{b: b, dirty: make(map[uint64]uint64)}
+}
+
+// DeltaBitSet is a BitSet recording the bits set in an underlying BitSet,
+// in memory or in Redis, since the last call to Delta, so that a replica
+// can be brought up to date with a patch of the words changed, instead of
+// the whole bitset. The bits are recorded by word, as they are set: Delta
+// reads nothing from the underlying bitset.
+//
+// Bits set by other processes in a shared RedisBitSet are not recorded, and
+// neither are the bits cleared by UnSet or ClearAll, see Patch. A
+// DeltaBitSet is safe for concurrent use if its underlying bitset is.
+type DeltaBitSet struct {
+	b     BitSet
+	mu    sync.Mutex
+	dirty map[uint64]uint64
+}
+
+// BitSet returns the underlying bitset.
+func (d *DeltaBitSet) BitSet() BitSet {
+	return d.b
+}
+
+// Delta returns the patch of the bits set since the previous call, and
+// starts recording anew. A patch that could not be delivered should be given
+// back with Restore.
+func (d *DeltaBitSet) Delta() *Patch {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := newPatch(d.dirty)
+	d.dirty = make(map[uint64]uint64)
+	return p
+}
+
+// Restore records the bits of p again, such as a patch returned by Delta
+// that could not be delivered, so that they are part of the next Delta.
+func (d *DeltaBitSet) Restore(p *Patch) {
+	d.mu.Lock()
+	d.mark(p)
+	d.mu.Unlock()
+}
+
+// Pending returns the number of words changed since the last Delta.
+func (d *DeltaBitSet) Pending() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return len(d.dirty)
+}
+
+func (d *DeltaBitSet) mark(p *Patch) {
+	for j, i := range p.indexes {
+		d.dirty[i] |= p.words[j]
+	}
+}
+
+// markBits records the bits of idx, d.mu held.
+func (d *DeltaBitSet) markBits(idx []uint) {
+	for _, i := range idx {
+		d.dirty[uint64(i/64)] |= 1 << (63 - i%64)
+	}
+}
+
+// markAll records the bits set in data, raw bits in Redis bit order.
+func (d *DeltaBitSet) markAll(data []byte) {
+	d.mu.Lock()
+	d.mark(Diff(nil, data))
+	d.mu.Unlock()
+}
+
+func (d *DeltaBitSet) Init(length uint) BitSet {
+	d.b = d.b.Init(length)
+	return d
+}
+
+func (d *DeltaBitSet) Set(i uint) BitSet {
+	d.b.Set(i)
+	d.mu.Lock()
+	d.markBits([]uint{i})
+	d.mu.Unlock()
+	return d
+}
+
+// UnSet clears bit i, which is not propagated by the patches.
+func (d *DeltaBitSet) UnSet(i uint) BitSet {
+	d.b.UnSet(i)
+	return d
+}
+
+func (d *DeltaBitSet) InPlaceUnion(compare BitSet) {
+	d.b.InPlaceUnion(compare)
+	d.markAll(bitSetBytes(compare))
+}
+
+func (d *DeltaBitSet) Test(i uint) bool {
+	return d.b.Test(i)
+}
+
+// ClearAll clears all the bits, which is not propagated by the patches.
+func (d *DeltaBitSet) ClearAll() BitSet {
+	d.b.ClearAll()
+	return d
+}
+
+func (d *DeltaBitSet) Count() uint {
+	return d.b.Count()
+}
+
+func (d *DeltaBitSet) WriteTo(stream io.Writer) (int64, error) {
+	return d.b.WriteTo(stream)
+}
+
+func (d *DeltaBitSet) Equal(c BitSet) bool {
+	return d.b.Equal(c)
+}
+
+func (d *DeltaBitSet) GetBitSetKey() string {
+	return d.b.GetBitSetKey()
+}
+
+// ReadFrom reads the underlying bitset from a stream, recording all its set
+// bits.
+func (d *DeltaBitSet) ReadFrom(stream io.Reader) (int64, error) {
+	n, err := d.b.ReadFrom(stream)
+	if err == nil {
+		d.markAll(bitSetBytes(d.b))
+	}
+	return n, err
+}
+
+// From replaces the underlying bitset with buf, recording all its set bits.
+func (d *DeltaBitSet) From(buf []uint64) BitSet {
+	d.b = d.b.From(buf)
+	d.markAll(bitSetBytes(d.b))
+	return d
+}
+
+// SetBits sets all the bits in idx, in one operation if the underlying
+// bitset supports it.
+func (d *DeltaBitSet) SetBits(ctx context.Context, idx []uint) error {
+	if err := setBits(ctx, d.b, idx); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.markBits(idx)
+	d.mu.Unlock()
+	return nil
+}
+
+// TestBits returns true if all the bits in idx are set.
+func (d *DeltaBitSet) TestBits(ctx context.Context, idx []uint) (bool, error) {
+	return testBits(ctx, d.b, idx)
+}
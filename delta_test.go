@@ -0,0 +1,151 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestDeltaBitSetSync(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(ctx, key)
+
+	bits := NewDeltaBitSet(NewMemoryBitSet())
+	f := NewWithEstimates(10000, 0.01, bits)
+	replicas := []BitSet{NewMemoryBitSet().Init(f.Cap()), NewRedisBitSet(redisClient, key, time.Minute).Init(f.Cap())}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 1000; i++ {
+			f.AddString(strconv.Itoa(round*1000 + i))
+		}
+		patch := bits.Delta()
+		if patch.Len() == 0 || bits.Pending() != 0 {
+			t.Fatalf("round %d: unexpected patch of %d words, %d pending", round, patch.Len(), bits.Pending())
+		}
+		for _, replica := range replicas {
+			if err := patch.Apply(ctx, replica); err != nil {
+				t.Fatal(err)
+			}
+			if !sameBits(ctx, bits, replica) {
+				t.Errorf("round %d: the replica %T differs", round, replica)
+			}
+		}
+	}
+	if patch := bits.Delta(); patch.Len() != 0 {
+		t.Errorf("unexpected patch of %d words without changes", patch.Len())
+	}
+
+	// a lost patch is sent again with the next one
+	f.AddString("lost")
+	lost := bits.Delta()
+	bits.Restore(lost)
+	f.AddString("next")
+	patch := bits.Delta()
+	if patch.Count() < lost.Count() {
+		t.Errorf("the patch should include the lost bits, %d < %d", patch.Count(), lost.Count())
+	}
+	for _, replica := range replicas {
+		patch.Apply(ctx, replica)
+		if !sameBits(ctx, bits, replica) {
+			t.Errorf("the replica %T should hold the lost key", replica)
+		}
+	}
+}
+
+// sameBits returns whether a and b have the same bits set, whatever their
+// backends and lengths.
+func sameBits(ctx context.Context, a, b BitSet) bool {
+	x, _ := Snapshot(ctx, a)
+	y, _ := Snapshot(ctx, b)
+	return bytes.Equal(bytes.TrimRight(x, "\x00"), bytes.TrimRight(y, "\x00"))
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	b := NewMemoryBitSet().Init(1000)
+	b.Set(3).Set(500)
+	previous, _ := Snapshot(ctx, b)
+	b.Set(4).Set(5).Set(700).Set(999)
+	current, _ := Snapshot(ctx, b)
+	patch := Diff(previous, current)
+	if patch.Len() != 3 || patch.Count() != 4 {
+		t.Errorf("unexpected patch of %d words, %d bits", patch.Len(), patch.Count())
+	}
+	if idx := patch.bitIndexes(); len(idx) != 4 || idx[0] != 4 || idx[1] != 5 || idx[2] != 700 || idx[3] != 999 {
+		t.Errorf("unexpected bits %v", idx)
+	}
+
+	replica := NewMemoryBitSet().Init(1000)
+	replica.Set(3).Set(500).Set(20)
+	if err := patch.Apply(ctx, replica); err != nil {
+		t.Fatal(err)
+	}
+	// the replica keeps its own bits
+	b.Set(20)
+	if !b.Equal(replica) {
+		t.Error("the replica differs")
+	}
+
+	patch.Merge(Diff(nil, []byte{0x80}))
+	if patch.Len() != 3 || patch.Count() != 5 {
+		t.Errorf("unexpected merged patch of %d words, %d bits", patch.Len(), patch.Count())
+	}
+}
+
+func TestPatchReadWrite(t *testing.T) {
+	b := NewMemoryBitSet().Init(10000)
+	for i := uint(0); i < 10000; i += 97 {
+		b.Set(i)
+	}
+	patch := Diff(nil, bitSetBytes(b))
+	var buf bytes.Buffer
+	bytesWritten, err := patch.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var g Patch
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	replica := NewMemoryBitSet().Init(10000)
+	g.Apply(context.Background(), replica)
+	if !b.Equal(replica) {
+		t.Error("the replica differs")
+	}
+
+	// words out of order
+	data := make([]byte, 8+2*patchEntrySize)
+	data[7], data[15], data[31] = 2, 1, 1
+	if _, err := g.ReadFrom(bytes.NewReader(data)); err != ErrInvalidPatch {
+		t.Errorf("expected ErrInvalidPatch, got %v", err)
+	}
+	// a length the stream does not hold is not allocated
+	data = make([]byte, 8+patchEntrySize)
+	binary.BigEndian.PutUint64(data, 1<<32)
+	data[8+patchEntrySize-1] = 1
+	if _, err := g.ReadFrom(bytes.NewReader(data)); err != io.ErrUnexpectedEOF {
+		t.Errorf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+
+	// bits past the end of the replica
+	g = *Diff(nil, []byte{0x40})
+	g.Merge(&Patch{indexes: []uint64{1 << 30}, words: []uint64{1}})
+	if err := g.Apply(context.Background(), replica); err != ErrInvalidPatch {
+		t.Errorf("expected ErrInvalidPatch, got %v", err)
+	}
+	if replica.Test(1) || !b.Equal(replica) {
+		t.Error("a patch past the end should not be applied")
+	}
+}
@@ -0,0 +1,349 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Layout of the header of a FileBitSet: magic, version, m and k, big-endian,
+// followed by the bits in Redis bit order.
+const (
+	fileBitSetMagic      = "BLMF"
+	fileBitSetVersion    = 1
+	fileBitSetHeaderSize = 32
+)
+
+// fileBitSetMaxBytes bounds the bytes of bits read by ReadFrom.
+const fileBitSetMaxBytes = 1 << 36
+
+// ErrInvalidBitSetFile is returned when opening a file that is not a
+// FileBitSet, or of an unknown version.
+var ErrInvalidBitSetFile = errors.New("bloom: invalid bitset file")
+
+// FileBitSet is a BitSet stored in a memory-mapped file, for filters too big
+// to keep on the heap or that must survive restarts without Redis. Set and
+// Test work directly on the mapping; the operating system writes the pages
+// back to the file, and Sync forces it.
+//
+// The file starts with a header holding the number of bits m and of hash
+// functions k of the filter, so that OpenFileFilter reopens it without
+// knowing them. The bits use the Redis bit order, like a MemoryBitSet.
+//
+// Several processes can map the same file: one writer with NewFileBitSet and
+// readers with OpenFileBitSet in read-only mode see the same pages, up to the
+// size of the file when they opened it. A FileBitSet is not safe for
+// concurrent use within a process, and writing to a read-only one panics. It
+// is only supported on Unix systems.
+type FileBitSet struct {
+	file *os.File
+	// data is the mapping of the file, up to the end of the bits in use
+	data     []byte
+	readOnly bool
+}
+
+// NewFileBitSet opens the bitset file at path for reading and writing,
+// creating it if needed, for a filter with k hash functions. Init (New does
+// it for you) sizes the file for the filter.
+func NewFileBitSet(path string, k uint) (*FileBitSet, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() == 0 {
+		header := make([]byte, fileBitSetHeaderSize)
+		copy(header, fileBitSetMagic)
+		binary.BigEndian.PutUint32(header[4:], fileBitSetVersion)
+		binary.BigEndian.PutUint64(header[16:], uint64(k))
+		if _, err := file.WriteAt(header, 0); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	b, err := mapFileBitSet(file, false)
+	if err != nil {
+		return nil, err
+	}
+	if fileK := b.K(); fileK != k {
+		b.Close()
+		return nil, fmt.Errorf("bloom: %s holds a filter with k=%d, not %d", path, fileK, k)
+	}
+	return b, nil
+}
+
+// OpenFileBitSet opens the existing bitset file at path, read-only if
+// readOnly is true.
+func OpenFileBitSet(path string, readOnly bool) (*FileBitSet, error) {
+	flag := os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		return nil, err
+	}
+	return mapFileBitSet(file, readOnly)
+}
+
+// OpenFileFilter opens the filter stored in the bitset file at path, with
+// the m and k recorded in its header.
+func OpenFileFilter(path string, readOnly bool) (BloomFilter, error) {
+	b, err := OpenFileBitSet(path, readOnly)
+	if err != nil {
+		return nil, err
+	}
+	if b.M() == 0 {
+		b.Close()
+		return nil, fmt.Errorf("bloom: %s holds no filter", path)
+	}
+	return New(b.M(), b.K(), b), nil
+}
+
+// mapFileBitSet maps file and checks its header. It closes file on failure.
+func mapFileBitSet(file *os.File, readOnly bool) (*FileBitSet, error) {
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if info.Size() < fileBitSetHeaderSize {
+		file.Close()
+		return nil, ErrInvalidBitSetFile
+	}
+	data, err := mmapFile(file, int(info.Size()), readOnly)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	b := &FileBitSet{file: file, data: data, readOnly: readOnly}
+	if string(data[:4]) != fileBitSetMagic || binary.BigEndian.Uint32(data[4:]) != fileBitSetVersion {
+		b.Close()
+		return nil, ErrInvalidBitSetFile
+	}
+	return b, nil
+}
+
+// M returns the number of bits of the filter recorded in the header.
+func (b *FileBitSet) M() uint {
+	return uint(binary.BigEndian.Uint64(b.data[8:]))
+}
+
+// K returns the number of hash functions of the filter recorded in the
+// header.
+func (b *FileBitSet) K() uint {
+	return uint(binary.BigEndian.Uint64(b.data[16:]))
+}
+
+// SetParameters records m and k in the header. The filters of this package
+// do it when they read a filter into the bitset with ReadFrom.
+func (b *FileBitSet) SetParameters(m, k uint) {
+	b.checkWritable()
+	binary.BigEndian.PutUint64(b.data[8:], uint64(m))
+	binary.BigEndian.PutUint64(b.data[16:], uint64(k))
+}
+
+// Sync writes the changes of the mapping back to the file.
+func (b *FileBitSet) Sync() error {
+	return msync(b.data[:cap(b.data)])
+}
+
+// Close unmaps and closes the file. Changes not synced are still written
+// back by the operating system.
+func (b *FileBitSet) Close() error {
+	var err error
+	// data is nil once closed
+	if b.data != nil {
+		err = munmap(b.data[:cap(b.data)])
+		b.data = nil
+	}
+	if cerr := b.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bits returns the bits of the mapping.
+func (b *FileBitSet) bits() []byte {
+	return b.data[fileBitSetHeaderSize:]
+}
+
+func (b *FileBitSet) checkWritable() {
+	if b.readOnly {
+		panic("bloom: write to a read-only FileBitSet")
+	}
+}
+
+// resize gives the bits n bytes. The file is never shrunk, which would fault
+// the other processes mapping it: fewer bytes only shorten data, within the
+// mapping, and the bytes left out are cleared. More bytes extend the file
+// and remap it, keeping the current mapping if that fails.
+func (b *FileBitSet) resize(n int) error {
+	size := fileBitSetHeaderSize + n
+	if size <= cap(b.data) {
+		tail := b.data[:cap(b.data)][size:]
+		for i := range tail {
+			tail[i] = 0
+		}
+		b.data = b.data[:size]
+		return nil
+	}
+	if err := b.file.Truncate(int64(size)); err != nil {
+		return err
+	}
+	data, err := mmapFile(b.file, size, false)
+	if err != nil {
+		return err
+	}
+	old := b.data
+	b.data = data
+	return munmap(old[:cap(old)])
+}
+
+// Init extends the file, if needed, to hold length bits, and records length
+// as m in the header. Bits already in the file are kept. It panics if the
+// file cannot be extended.
+func (b *FileBitSet) Init(length uint) BitSet {
+	// like MemoryBitSet, hold length/8+1 bytes
+	n := int(length/8 + 1)
+	if n > len(b.bits()) {
+		b.checkWritable()
+		if err := b.resize(n); err != nil {
+			panic(fmt.Sprintf("bloom: cannot extend %s: %v", b.file.Name(), err))
+		}
+	}
+	if !b.readOnly {
+		binary.BigEndian.PutUint64(b.data[8:], uint64(length))
+	}
+	return b
+}
+
+func (b *FileBitSet) Set(i uint) BitSet {
+	b.checkWritable()
+	b.bits()[i>>3] |= 0x80 >> (i & 7)
+	return b
+}
+
+func (b *FileBitSet) UnSet(i uint) BitSet {
+	b.checkWritable()
+	b.bits()[i>>3] &^= 0x80 >> (i & 7)
+	return b
+}
+
+func (b *FileBitSet) InPlaceUnion(compare BitSet) {
+	b.checkWritable()
+	bits := b.bits()
+	for i, c := range bitSetBytes(compare) {
+		if i >= len(bits) {
+			break
+		}
+		bits[i] |= c
+	}
+}
+
+func (b *FileBitSet) Test(i uint) bool {
+	bits := b.bits()
+	if i>>3 >= uint(len(bits)) {
+		return false
+	}
+	return bits[i>>3]&(0x80>>(i&7)) != 0
+}
+
+func (b *FileBitSet) ClearAll() BitSet {
+	b.checkWritable()
+	bits := b.bits()
+	for i := range bits {
+		bits[i] = 0
+	}
+	return b
+}
+
+func (b *FileBitSet) Count() uint {
+	return popCount(b.bits())
+}
+
+// WriteTo writes the bits in the format of MemoryBitSet.WriteTo.
+func (b *FileBitSet) WriteTo(stream io.Writer) (int64, error) {
+	bits := b.bits()
+	err := binary.Write(stream, binary.BigEndian, uint64(len(bits)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := stream.Write(bits)
+	return int64(n + binary.Size(uint64(0))), err
+}
+
+func (b *FileBitSet) Equal(c BitSet) bool {
+	return bytes.Equal(b.bits(), bitSetBytes(c))
+}
+
+// GetBitSetKey returns an empty string, a FileBitSet has no Redis key.
+func (b *FileBitSet) GetBitSetKey() string {
+	return ""
+}
+
+// ReadFrom reads bits written by MemoryBitSet.WriteTo or FileBitSet.WriteTo,
+// resizing the file to fit them. The m and k of the header are recorded by
+// the filter reading them, see SetParameters.
+func (b *FileBitSet) ReadFrom(stream io.Reader) (int64, error) {
+	b.checkWritable()
+	var length uint64
+	err := binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		return 0, err
+	}
+	// the bits are mapped, so they must also fit an int
+	if length > fileBitSetMaxBytes || uint64(int(length)) != length {
+		return 0, fmt.Errorf("bloom: %d bytes of bits are too many for %s", length, b.file.Name())
+	}
+	if int(length) != len(b.bits()) {
+		if err := b.resize(int(length)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := io.ReadFull(stream, b.bits())
+	if err != nil {
+		return 0, err
+	}
+	return int64(n + binary.Size(uint64(0))), nil
+}
+
+// From uses the same byte layout as RedisBitSet.From. It panics if the file
+// cannot be resized.
+func (b *FileBitSet) From(buf []uint64) BitSet {
+	b.checkWritable()
+	if err := b.resize(8 * len(buf)); err != nil {
+		panic(fmt.Sprintf("bloom: cannot resize %s: %v", b.file.Name(), err))
+	}
+	bits := b.bits()
+	for i, val := range buf {
+		binary.LittleEndian.PutUint64(bits[8*i:], val)
+	}
+	return b
+}
+
+// SetBits sets all the bits in idx.
+func (b *FileBitSet) SetBits(_ context.Context, idx []uint) error {
+	for _, i := range idx {
+		b.Set(i)
+	}
+	return nil
+}
+
+// TestBits returns true if all the bits in idx are set.
+func (b *FileBitSet) TestBits(_ context.Context, idx []uint) (bool, error) {
+	for _, i := range idx {
+		if !b.Test(i) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,176 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd
+
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempFilePath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bloom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "filter.bloom")
+}
+
+func TestFileBitSet(t *testing.T) {
+	path := tempFilePath(t)
+	b, err := NewFileBitSet(path, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := New(100000, 7, b)
+	f.AddString("Bess").AddString("Jane")
+	if !f.TestString("Bess") || f.TestString("Emma") {
+		t.Error("unexpected membership")
+	}
+	if b.M() != 100000 || b.K() != 7 {
+		t.Errorf("unexpected header m=%d k=%d", b.M(), b.K())
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a reader shares the pages of the writer
+	g, err := OpenFileFilter(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Cap() != 100000 || g.K() != 7 || !g.TestString("Jane") {
+		t.Error("the reader should see the filter")
+	}
+	f.AddString("Emma")
+	if !g.TestString("Emma") {
+		t.Error("the reader should see the writes of the writer")
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("writing to a read-only bitset should panic")
+			}
+		}()
+		g.AddString("Anna")
+	}()
+
+	m := New(100000, 7, NewMemoryBitSet())
+	m.AddString("Bess").AddString("Jane").AddString("Emma")
+	if !f.Equal(m) {
+		t.Error("the file bitset should hold the same bits as a memory bitset")
+	}
+	g.BitSet().(*FileBitSet).Close()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopening keeps the bits, extending keeps them too
+	b, err = NewFileBitSet(path, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	f = New(100000, 7, b)
+	if !f.TestString("Bess") || !f.TestString("Emma") {
+		t.Error("the bits should survive reopening")
+	}
+	count := b.Count()
+	b.Init(200000)
+	if b.M() != 200000 || b.Count() != count || !f.TestString("Bess") {
+		t.Error("extending the file should keep the bits and record the new m")
+	}
+	if _, err := NewFileBitSet(path, 5); err == nil {
+		t.Error("opening with another k should fail")
+	}
+}
+
+func TestFileBitSetReadWrite(t *testing.T) {
+	m := New(1000, 4, NewMemoryBitSet())
+	m.AddString("one").AddString("two")
+	var buf bytes.Buffer
+	if _, err := m.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	path := tempFilePath(t)
+	b, err := NewFileBitSet(path, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	f := New(10, 4, b)
+	if _, err := f.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Equal(m) || !f.TestString("one") || b.M() != 1000 || b.K() != 4 {
+		t.Error("the file bitset should hold the loaded filter")
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	g, err := OpenFileFilter(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !g.Equal(m) || !g.TestString("two") {
+		t.Error("the reopened file should hold the loaded filter")
+	}
+	g.BitSet().(*FileBitSet).Close()
+
+	b.From([]uint64{1, 2})
+	if !b.Equal(NewMemoryBitSet().From([]uint64{1, 2})) {
+		t.Error("From should use the layout of the other bitsets")
+	}
+}
+
+func TestFileBitSetResize(t *testing.T) {
+	b, err := NewFileBitSet(tempFilePath(t), 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Init(1000)
+	b.Set(10)
+	var header [8]byte
+	binary.BigEndian.PutUint64(header[:], 1<<62)
+	if _, err := b.ReadFrom(bytes.NewReader(header[:])); err == nil {
+		t.Fatal("reading bits larger than any file should fail")
+	}
+	if !b.Test(10) || len(b.bits()) != 126 {
+		t.Error("a failed read should keep the bits")
+	}
+
+	// reading fewer bits does not shrink the file, mapped by other processes
+	var buf bytes.Buffer
+	NewMemoryBitSet().Init(80).Set(3).WriteTo(&buf)
+	if _, err := b.ReadFrom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := b.file.Stat(); info.Size() != fileBitSetHeaderSize+126 {
+		t.Errorf("the file should keep its size, got %d bytes", info.Size())
+	}
+	if !b.Equal(NewMemoryBitSet().Init(80).Set(3)) || b.Test(10) {
+		t.Error("the file bitset should hold the bits read")
+	}
+	b.Init(1000)
+	if b.Test(10) || b.Count() != 1 {
+		t.Error("the bits beyond the ones read should be cleared")
+	}
+	if err := b.Close(); err != nil {
+		t.Errorf("closing after a failed resize should succeed, got %v", err)
+	}
+}
+
+func TestInvalidBitSetFile(t *testing.T) {
+	path := tempFilePath(t)
+	if err := ioutil.WriteFile(path, bytes.Repeat([]byte{1}, 64), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileBitSet(path, true); err != ErrInvalidBitSetFile {
+		t.Errorf("expected ErrInvalidBitSetFile, got %v", err)
+	}
+}
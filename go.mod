@@ -1,9 +1,12 @@
 module github.com/HoangViet144/bloom
 
-go 1.14
+go 1.18
 
 require (
+	github.com/cespare/xxhash/v2 v2.1.2
 	github.com/go-redis/redis/v9 v9.0.0-rc.2
 	github.com/google/uuid v1.3.0
 	github.com/twmb/murmur3 v1.1.6
 )
+
+require github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
@@ -0,0 +1,536 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/bits"
+	"sort"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Parameters of the HyperLogLog sketches: the range of precisions, the
+// precision of the sparse representation, the number of sparse entries
+// buffered before being sorted in, and the size of the header written by
+// WriteTo.
+const (
+	hllMinPrecision    = 4
+	hllMaxPrecision    = 18
+	hllSparsePrecision = 25
+	hllBufferSize      = 256
+	hllHeaderSize      = 24
+)
+
+// Representations of a HyperLogLog in the format of WriteTo.
+const (
+	hllSparse = iota
+	hllDense
+)
+
+// ErrInvalidHyperLogLog is returned when reading a HyperLogLog from a stream
+// that does not hold one.
+var ErrInvalidHyperLogLog = errors.New("bloom: invalid hyperloglog")
+
+// CardinalityCounter counts the distinct keys added to it, such as a
+// HyperLogLog or a RedisHyperLogLog.
+type CardinalityCounter interface {
+	// AddHashes adds the key of base hash values h.
+	AddHashes(ctx context.Context, h [4]uint64) error
+	// Count returns the estimated number of distinct keys added.
+	Count(ctx context.Context) (uint64, error)
+	// ClearAll removes all the keys.
+	ClearAll(ctx context.Context) error
+}
+
+// HyperLogLog is a HyperLogLog++ sketch (Heule, Nunkesser and Hall,
+// "HyperLogLog in Practice"), estimating the number of distinct keys added
+// to it with 2^p registers, whatever the number of keys. The standard error
+// of the estimates is 1.04/sqrt(2^p), 0.81% for a precision of 14.
+//
+// The keys are hashed like the keys of the Bloom filters of this package. A
+// sketch starts sparse, keeping the hashes of the keys at a precision of 25
+// bits, exact for small cardinalities, and turns dense, one byte per
+// register, once that takes less memory. The dense estimates use the
+// improved estimator of Ertl ("New cardinality estimation algorithms for
+// HyperLogLog sketches"), as Redis does, which needs no bias correction.
+//
+// A HyperLogLog is not safe for concurrent use.
+type HyperLogLog struct {
+	p uint
+	// sparse entries: the index of the key at the sparse precision, shifted
+	// by 6, and the rank of the key, sorted by index
+	sparse []uint32
+	buffer []uint32
+	// dense registers, nil while the sketch is sparse
+	registers []uint8
+}
+
+// EstimateHyperLogLogPrecision returns the precision of a HyperLogLog whose
+// estimates have a standard error of at most stdErr.
+func EstimateHyperLogLogPrecision(stdErr float64) uint {
+	return hllPrecision(uint(math.Ceil(2 * math.Log2(1.04/stdErr))))
+}
+
+func hllPrecision(p uint) uint {
+	if p < hllMinPrecision {
+		return hllMinPrecision
+	}
+	if p > hllMaxPrecision {
+		return hllMaxPrecision
+	}
+	return p
+}
+
+// NewHyperLogLog creates an empty HyperLogLog of precision p, between 4 and
+// 18.
+func NewHyperLogLog(p uint) *HyperLogLog {
+	return &HyperLogLog{p: hllPrecision(p)}
+}
+
+// Precision returns the precision of the sketch, p.
+func (s *HyperLogLog) Precision() uint {
+	return s.p
+}
+
+// Sparse returns whether the sketch uses the sparse representation.
+func (s *HyperLogLog) Sparse() bool {
+	return s.registers == nil
+}
+
+// Add adds data to the sketch.
+func (s *HyperLogLog) Add(ctx context.Context, data []byte) error {
+	return s.AddHashes(ctx, baseHashes(data))
+}
+
+// AddString adds data to the sketch.
+func (s *HyperLogLog) AddString(ctx context.Context, data string) error {
+	return s.AddHashes(ctx, HashesString(data))
+}
+
+// AddHashes adds the key of base hash values h to the sketch.
+func (s *HyperLogLog) AddHashes(_ context.Context, h [4]uint64) error {
+	x := h[0]
+	if s.registers != nil {
+		s.setRegister(uint(x>>(64-s.p)), hllRank(x, s.p))
+		return nil
+	}
+	s.buffer = append(s.buffer, uint32(x>>(64-hllSparsePrecision))<<6|uint32(hllRank(x, hllSparsePrecision)))
+	if len(s.buffer) >= hllBufferSize {
+		s.flush()
+	}
+	return nil
+}
+
+// hllRank returns the position of the first set bit of x after the p bits
+// of the index, from 1 to 65-p.
+func hllRank(x uint64, p uint) uint8 {
+	return uint8(bits.LeadingZeros64(x<<p|1<<(p-1)) + 1)
+}
+
+func (s *HyperLogLog) setRegister(i uint, rank uint8) {
+	if rank > s.registers[i] {
+		s.registers[i] = rank
+	}
+}
+
+// flush sorts the buffered sparse entries into the sparse list, and turns
+// the sketch dense once the list is larger than the registers.
+func (s *HyperLogLog) flush() {
+	if len(s.buffer) == 0 {
+		return
+	}
+	s.sparse = mergeSparse(s.sparse, s.buffer)
+	s.buffer = s.buffer[:0]
+	if 4*len(s.sparse) > 1<<s.p {
+		s.toDense()
+	}
+}
+
+// mergeSparse merges the entries of b into the sorted entries of a, keeping
+// the largest rank of each index.
+func mergeSparse(a, b []uint32) []uint32 {
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	merged := make([]uint32, 0, len(a)+len(b))
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		var e uint32
+		if j == len(b) || (i < len(a) && a[i] < b[j]) {
+			e, i = a[i], i+1
+		} else {
+			e, j = b[j], j+1
+		}
+		// entries of the same index are sorted by rank, keep the last one
+		if n := len(merged); n > 0 && merged[n-1]>>6 == e>>6 {
+			merged[n-1] = e
+		} else {
+			merged = append(merged, e)
+		}
+	}
+	return merged
+}
+
+// toDense turns the sketch dense.
+func (s *HyperLogLog) toDense() {
+	s.registers = make([]uint8, 1<<s.p)
+	for _, e := range s.sparse {
+		s.addSparseEntry(e)
+	}
+	for _, e := range s.buffer {
+		s.addSparseEntry(e)
+	}
+	s.sparse, s.buffer = nil, nil
+}
+
+// addSparseEntry sets the register of a sparse entry in the dense
+// registers.
+func (s *HyperLogLog) addSparseEntry(e uint32) {
+	index, rank := e>>6, uint8(e&0x3f)
+	extra := hllSparsePrecision - s.p
+	if low := index & (1<<extra - 1); low != 0 {
+		// the first set bit is among the bits of the sparse index
+		rank = uint8(bits.LeadingZeros32(low) - (32 - int(extra)) + 1)
+	} else {
+		rank += uint8(extra)
+	}
+	s.setRegister(uint(index>>extra), rank)
+}
+
+// Count returns the estimated number of distinct keys added.
+func (s *HyperLogLog) Count(context.Context) (uint64, error) {
+	s.flush()
+	if s.registers == nil {
+		// linear counting of the sparse indexes, exact for small counts
+		m := float64(uint64(1) << hllSparsePrecision)
+		return uint64(math.Round(m * math.Log(m/(m-float64(len(s.sparse)))))), nil
+	}
+	return uint64(math.Round(hllEstimate(s.registers, s.p))), nil
+}
+
+// hllEstimate returns the improved estimate of Ertl of the registers of a
+// dense sketch of precision p.
+func hllEstimate(registers []uint8, p uint) float64 {
+	q := 64 - p
+	histogram := make([]float64, q+2)
+	for _, r := range registers {
+		histogram[r]++
+	}
+	m := float64(len(registers))
+	z := m * hllTau(1-histogram[q+1]/m)
+	for k := q; k >= 1; k-- {
+		z = 0.5 * (z + histogram[k])
+	}
+	z += m * hllSigma(histogram[0]/m)
+	return m * m / (2 * math.Ln2 * z)
+}
+
+func hllSigma(x float64) float64 {
+	if x == 1 {
+		return math.Inf(1)
+	}
+	y, z := 1.0, x
+	for {
+		x *= x
+		previous := z
+		z += x * y
+		y += y
+		if z == previous {
+			return z
+		}
+	}
+}
+
+func hllTau(x float64) float64 {
+	if x == 0 || x == 1 {
+		return 0
+	}
+	y, z := 1.0, 1-x
+	for {
+		x = math.Sqrt(x)
+		previous := z
+		y *= 0.5
+		z -= (1 - x) * (1 - x) * y
+		if z == previous {
+			return z / 3
+		}
+	}
+}
+
+// Merge adds the keys of g to the sketch, which then estimates the number of
+// distinct keys of both. Both sketches must have the same precision.
+func (s *HyperLogLog) Merge(_ context.Context, g *HyperLogLog) error {
+	if s.p != g.p {
+		return ErrIncompatibleSketch
+	}
+	g.flush()
+	if g.registers == nil {
+		s.buffer = append(s.buffer, g.sparse...)
+		if s.registers == nil {
+			s.flush()
+		} else {
+			for _, e := range s.buffer {
+				s.addSparseEntry(e)
+			}
+			s.buffer = nil
+		}
+		return nil
+	}
+	if s.registers == nil {
+		s.toDense()
+	}
+	for i, r := range g.registers {
+		s.setRegister(uint(i), r)
+	}
+	return nil
+}
+
+// ClearAll removes all the keys, the sketch turning sparse again.
+func (s *HyperLogLog) ClearAll(context.Context) error {
+	s.sparse, s.buffer, s.registers = nil, nil, nil
+	return nil
+}
+
+// WriteTo writes the sketch to an i/o stream: the precision, the
+// representation, 0 for sparse and 1 for dense, and the number of entries or
+// registers as big-endian uint64, then the sparse entries as big-endian
+// uint32 or the registers as bytes. It returns the number of bytes written.
+func (s *HyperLogLog) WriteTo(stream io.Writer) (int64, error) {
+	s.flush()
+	var data []byte
+	if s.registers == nil {
+		data = make([]byte, hllHeaderSize+4*len(s.sparse))
+		binary.BigEndian.PutUint64(data[8:], hllSparse)
+		binary.BigEndian.PutUint64(data[16:], uint64(len(s.sparse)))
+		for i, e := range s.sparse {
+			binary.BigEndian.PutUint32(data[hllHeaderSize+4*i:], e)
+		}
+	} else {
+		data = make([]byte, hllHeaderSize, hllHeaderSize+len(s.registers))
+		binary.BigEndian.PutUint64(data[8:], hllDense)
+		binary.BigEndian.PutUint64(data[16:], uint64(len(s.registers)))
+		data = append(data, s.registers...)
+	}
+	binary.BigEndian.PutUint64(data, uint64(s.p))
+	n, err := stream.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom reads a sketch written by WriteTo from an i/o stream, replacing
+// the sketch. It returns the number of bytes read.
+func (s *HyperLogLog) ReadFrom(stream io.Reader) (int64, error) {
+	var header [hllHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	p := binary.BigEndian.Uint64(header[:])
+	kind, length := binary.BigEndian.Uint64(header[8:]), binary.BigEndian.Uint64(header[16:])
+	if p < hllMinPrecision || p > hllMaxPrecision ||
+		(kind == hllSparse && length > 1<<p) || (kind == hllDense && length != 1<<p) || kind > hllDense {
+		return int64(n), ErrInvalidHyperLogLog
+	}
+	g := &HyperLogLog{p: uint(p)}
+	if kind == hllDense {
+		g.registers = make([]uint8, length)
+		m, err := io.ReadFull(stream, g.registers)
+		if err != nil {
+			return int64(n + m), err
+		}
+		n += m
+		for _, r := range g.registers {
+			if uint64(r) > 65-p {
+				return int64(n), ErrInvalidHyperLogLog
+			}
+		}
+	} else {
+		data := make([]byte, 4*length)
+		m, err := io.ReadFull(stream, data)
+		if err != nil {
+			return int64(n + m), err
+		}
+		n += m
+		g.sparse = make([]uint32, length)
+		for i := range g.sparse {
+			g.sparse[i] = binary.BigEndian.Uint32(data[4*i:])
+			index, rank := g.sparse[i]>>6, g.sparse[i]&0x3f
+			if index >= 1<<hllSparsePrecision || rank == 0 || rank > 65-hllSparsePrecision ||
+				(i > 0 && index <= g.sparse[i-1]>>6) {
+				return int64(n), ErrInvalidHyperLogLog
+			}
+		}
+	}
+	*s = *g
+	return int64(n), nil
+}
+
+// RedisHyperLogLog is a HyperLogLog stored in Redis, updated with PFADD and
+// counted with PFCOUNT, so that it can be shared with any Redis client. Add
+// adds the keys themselves, as PFADD would, while AddHashes adds the 16-byte
+// base hash values of the keys: the two should not be mixed for the same
+// keys, which would count them twice.
+type RedisHyperLogLog struct {
+	redisClient redis.UniversalClient
+	key         string
+}
+
+// NewRedisHyperLogLog creates a HyperLogLog stored in the Redis key.
+func NewRedisHyperLogLog(redisClient redis.UniversalClient, key string) *RedisHyperLogLog {
+	return &RedisHyperLogLog{redisClient: redisClient, key: key}
+}
+
+// Key returns the Redis key of the sketch.
+func (s *RedisHyperLogLog) Key() string {
+	return s.key
+}
+
+// Add adds data to the sketch.
+func (s *RedisHyperLogLog) Add(ctx context.Context, data []byte) error {
+	return s.redisClient.PFAdd(ctx, s.key, data).Err()
+}
+
+// AddString adds data to the sketch.
+func (s *RedisHyperLogLog) AddString(ctx context.Context, data string) error {
+	return s.redisClient.PFAdd(ctx, s.key, data).Err()
+}
+
+// AddHashes adds the key of base hash values h to the sketch.
+func (s *RedisHyperLogLog) AddHashes(ctx context.Context, h [4]uint64) error {
+	var element [16]byte
+	binary.BigEndian.PutUint64(element[:], h[0])
+	binary.BigEndian.PutUint64(element[8:], h[1])
+	return s.redisClient.PFAdd(ctx, s.key, element[:]).Err()
+}
+
+// Count returns the estimated number of distinct keys added.
+func (s *RedisHyperLogLog) Count(ctx context.Context) (uint64, error) {
+	count, err := s.redisClient.PFCount(ctx, s.key).Result()
+	return uint64(count), err
+}
+
+// Merge adds the keys of the sketches others to the sketch, with PFMERGE.
+// On a Redis Cluster, the keys must share a hash tag.
+func (s *RedisHyperLogLog) Merge(ctx context.Context, others ...*RedisHyperLogLog) error {
+	keys := make([]string, len(others))
+	for i, g := range others {
+		keys[i] = g.key
+	}
+	return s.redisClient.PFMerge(ctx, s.key, keys...).Err()
+}
+
+// ClearAll removes all the keys, deleting the Redis key.
+func (s *RedisHyperLogLog) ClearAll(ctx context.Context) error {
+	return s.redisClient.Del(ctx, s.key).Err()
+}
+
+// CardinalityFilter is a Bloom filter counting the distinct keys added to
+// it with a CardinalityCounter, in the same call. Its ApproximatedSize is
+// the estimate of the counter, accurate even once the filter is saturated,
+// and keys the filter reports as present, including false positives, are
+// counted all the same.
+//
+// As the methods of BloomFilter return no error, the errors of the counter
+// are passed to the onError function given to NewCardinalityFilter.
+type CardinalityFilter struct {
+	BloomFilter
+	counter CardinalityCounter
+	onError func(error)
+}
+
+// NewCardinalityFilter creates a CardinalityFilter adding the keys to filter
+// and counting them with counter. onError, if not nil, is called with the
+// errors of the counter.
+func NewCardinalityFilter(filter BloomFilter, counter CardinalityCounter, onError func(error)) *CardinalityFilter {
+	return &CardinalityFilter{BloomFilter: filter, counter: counter, onError: onError}
+}
+
+// Counter returns the counter of the filter.
+func (f *CardinalityFilter) Counter() CardinalityCounter {
+	return f.counter
+}
+
+func (f *CardinalityFilter) count(h [4]uint64) {
+	if err := f.counter.AddHashes(context.Background(), h); err != nil && f.onError != nil {
+		f.onError(err)
+	}
+}
+
+// Add adds data to the filter and to the counter. Returns the filter
+// (allows chaining)
+func (f *CardinalityFilter) Add(data []byte) BloomFilter {
+	f.BloomFilter.Add(data)
+	f.count(baseHashes(data))
+	return f
+}
+
+// AddString adds data to the filter and to the counter. Returns the filter
+// (allows chaining)
+func (f *CardinalityFilter) AddString(data string) BloomFilter {
+	f.BloomFilter.AddString(data)
+	f.count(HashesString(data))
+	return f
+}
+
+// TestAndAdd is the equivalent to calling Test(data) then Add(data).
+// Returns the result of Test.
+func (f *CardinalityFilter) TestAndAdd(data []byte) bool {
+	present := f.BloomFilter.TestAndAdd(data)
+	f.count(baseHashes(data))
+	return present
+}
+
+// TestAndAddString is the equivalent to calling Test(data) then Add(data).
+// Returns the result of Test.
+func (f *CardinalityFilter) TestAndAddString(data string) bool {
+	present := f.BloomFilter.TestAndAddString(data)
+	f.count(HashesString(data))
+	return present
+}
+
+// TestOrAdd is the equivalent to calling Test(data) then if not present
+// Add(data). The key is counted in both cases. Returns the result of Test.
+func (f *CardinalityFilter) TestOrAdd(data []byte) bool {
+	present := f.BloomFilter.TestOrAdd(data)
+	f.count(baseHashes(data))
+	return present
+}
+
+// TestOrAddString is the equivalent to calling Test(data) then if not
+// present Add(data). The key is counted in both cases. Returns the result of
+// Test.
+func (f *CardinalityFilter) TestOrAddString(data string) bool {
+	present := f.BloomFilter.TestOrAddString(data)
+	f.count(HashesString(data))
+	return present
+}
+
+// ClearAll clears the filter and the counter, removing all keys.
+func (f *CardinalityFilter) ClearAll() BloomFilter {
+	f.BloomFilter.ClearAll()
+	if err := f.counter.ClearAll(context.Background()); err != nil && f.onError != nil {
+		f.onError(err)
+	}
+	return f
+}
+
+// Cardinality returns the estimated number of distinct keys added.
+func (f *CardinalityFilter) Cardinality(ctx context.Context) (uint64, error) {
+	return f.counter.Count(ctx)
+}
+
+// ApproximatedSize returns the estimated number of distinct keys added,
+// from the counter, saturated to 32 bits.
+func (f *CardinalityFilter) ApproximatedSize() uint32 {
+	count, err := f.counter.Count(context.Background())
+	if err != nil {
+		if f.onError != nil {
+			f.onError(err)
+		}
+		return f.BloomFilter.ApproximatedSize()
+	}
+	if count > math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(count)
+}
@@ -0,0 +1,195 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"math"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestEstimateHyperLogLogPrecision(t *testing.T) {
+	if p := EstimateHyperLogLogPrecision(0.01); p != 14 {
+		t.Errorf("unexpected precision %d", p)
+	}
+	if p := EstimateHyperLogLogPrecision(1e-6); p != hllMaxPrecision {
+		t.Errorf("unexpected precision %d", p)
+	}
+}
+
+func TestHyperLogLog(t *testing.T) {
+	ctx := context.Background()
+	s := NewHyperLogLog(12)
+	added := 0
+	for _, n := range []int{10, 100, 1000, 10000, 100000, 1000000} {
+		for ; added < n; added++ {
+			s.AddString(ctx, "key"+strconv.Itoa(added))
+			// duplicates are not counted
+			if added%10 == 0 {
+				s.Add(ctx, []byte("key0"))
+			}
+		}
+		count, _ := s.Count(ctx)
+		// 4 standard errors, 1.6%, and exact while sparse
+		tolerance := 4 * 1.04 / math.Sqrt(1<<12)
+		if s.Sparse() {
+			tolerance = 0.001
+		}
+		if math.Abs(float64(count)-float64(n)) > tolerance*float64(n) {
+			t.Errorf("%d keys: estimated %d (sparse %v)", n, count, s.Sparse())
+		}
+		if n <= 100 && !s.Sparse() {
+			t.Errorf("%d keys: the sketch should be sparse", n)
+		}
+		if n >= 10000 && s.Sparse() {
+			t.Errorf("%d keys: the sketch should be dense", n)
+		}
+	}
+	s.ClearAll(ctx)
+	if count, _ := s.Count(ctx); count != 0 || !s.Sparse() {
+		t.Errorf("unexpected count %d after ClearAll", count)
+	}
+}
+
+func TestHyperLogLogMerge(t *testing.T) {
+	ctx := context.Background()
+	for _, sizes := range [][2]int{{50, 50}, {50, 5000}, {5000, 50}, {5000, 5000}} {
+		f, g := NewHyperLogLog(10), NewHyperLogLog(10)
+		// the sketches share half of the keys of the smallest
+		shared := sizes[0] / 2
+		if sizes[1] < sizes[0] {
+			shared = sizes[1] / 2
+		}
+		for i := 0; i < sizes[0]; i++ {
+			f.AddString(ctx, strconv.Itoa(i))
+		}
+		for i := 0; i < sizes[1]; i++ {
+			g.AddString(ctx, strconv.Itoa(sizes[0]-shared+i))
+		}
+		if err := f.Merge(ctx, g); err != nil {
+			t.Fatal(err)
+		}
+		n := sizes[0] + sizes[1] - shared
+		if count, _ := f.Count(ctx); math.Abs(float64(count)-float64(n)) > 0.13*float64(n) {
+			t.Errorf("%v: estimated %d, expected %d", sizes, count, n)
+		}
+	}
+	if err := NewHyperLogLog(10).Merge(ctx, NewHyperLogLog(11)); err != ErrIncompatibleSketch {
+		t.Errorf("expected ErrIncompatibleSketch, got %v", err)
+	}
+}
+
+func TestHyperLogLogReadWrite(t *testing.T) {
+	ctx := context.Background()
+	for _, n := range []int{100, 100000} {
+		s := NewHyperLogLog(14)
+		for i := 0; i < n; i++ {
+			s.AddString(ctx, strconv.Itoa(i))
+		}
+		var buf bytes.Buffer
+		bytesWritten, err := s.WriteTo(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := NewHyperLogLog(4)
+		bytesRead, err := g.ReadFrom(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytesRead != bytesWritten {
+			t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+		}
+		c1, _ := s.Count(ctx)
+		if c2, _ := g.Count(ctx); c1 != c2 || g.Precision() != 14 || g.Sparse() != s.Sparse() {
+			t.Errorf("%d keys: the sketches differ, %d != %d", n, c1, c2)
+		}
+	}
+	if _, err := NewHyperLogLog(4).ReadFrom(bytes.NewReader(make([]byte, hllHeaderSize))); err != ErrInvalidHyperLogLog {
+		t.Errorf("expected ErrInvalidHyperLogLog, got %v", err)
+	}
+
+	// a dense register of precision 4 ranks at most 61
+	dense := make([]byte, hllHeaderSize+16)
+	binary.BigEndian.PutUint64(dense, 4)
+	binary.BigEndian.PutUint64(dense[8:], hllDense)
+	binary.BigEndian.PutUint64(dense[16:], 16)
+	dense[hllHeaderSize+3] = 62
+	if _, err := NewHyperLogLog(4).ReadFrom(bytes.NewReader(dense)); err != ErrInvalidHyperLogLog {
+		t.Errorf("expected ErrInvalidHyperLogLog for a register of 62, got %v", err)
+	}
+	// a sparse index has 25 bits
+	sparse := make([]byte, hllHeaderSize+4)
+	binary.BigEndian.PutUint64(sparse, 4)
+	binary.BigEndian.PutUint64(sparse[16:], 1)
+	binary.BigEndian.PutUint32(sparse[hllHeaderSize:], 1<<25<<6|1)
+	if _, err := NewHyperLogLog(4).ReadFrom(bytes.NewReader(sparse)); err != ErrInvalidHyperLogLog {
+		t.Errorf("expected ErrInvalidHyperLogLog for an index of 2^25, got %v", err)
+	}
+}
+
+func TestRedisHyperLogLog(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	// PFMERGE needs the keys in the same hash slot
+	key := "{" + uuid.New().String() + "}"
+	other := key + ":other"
+	defer redisClient.Del(ctx, key, other)
+
+	s, g := NewRedisHyperLogLog(redisClient, key), NewRedisHyperLogLog(redisClient, other)
+	for i := 0; i < 1000; i++ {
+		if err := s.AddString(ctx, strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+		g.AddHashes(ctx, HashesString(strconv.Itoa(1000+i)))
+	}
+	s.Add(ctx, []byte("0"))
+	if count, err := s.Count(ctx); err != nil || math.Abs(float64(count)-1000) > 30 {
+		t.Errorf("unexpected count %d, %v", count, err)
+	}
+	if err := s.Merge(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := s.Count(ctx); math.Abs(float64(count)-2000) > 60 {
+		t.Errorf("unexpected count %d after Merge", count)
+	}
+	s.ClearAll(ctx)
+	if count, _ := s.Count(ctx); count != 0 {
+		t.Errorf("unexpected count %d after ClearAll", count)
+	}
+}
+
+func TestCardinalityFilter(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(context.Background(), key)
+
+	for _, counter := range []CardinalityCounter{NewHyperLogLog(14), NewRedisHyperLogLog(redisClient, key)} {
+		// a small filter, saturated by the keys
+		f := NewCardinalityFilter(NewWithEstimates(1000, 0.01, NewMemoryBitSet()), counter, func(err error) { t.Error(err) })
+		for i := 0; i < 20000; i++ {
+			switch i % 3 {
+			case 0:
+				f.AddString(strconv.Itoa(i))
+			case 1:
+				f.TestAndAdd([]byte(strconv.Itoa(i)))
+			default:
+				f.TestOrAddString(strconv.Itoa(i))
+			}
+			f.Add([]byte("0"))
+		}
+		if size := f.ApproximatedSize(); math.Abs(float64(size)-20000) > 400 {
+			t.Errorf("unexpected size %d", size)
+		}
+		if !f.TestString("19999") {
+			t.Error("19999 should be in")
+		}
+		f.ClearAll()
+		if count, _ := f.Cardinality(context.Background()); count != 0 || f.TestString("19999") {
+			t.Errorf("the filter should be empty after ClearAll, count %d", count)
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Parameters of the IBLTs: the number of cells per key for small
+// differences, below ibltSmallDifference keys, and larger ones, the cells
+// per key of difference, and the size of the header written by WriteTo.
+const (
+	ibltSmallK          = 4
+	ibltLargeK          = 3
+	ibltSmallDifference = 2000
+	ibltOverhead        = 1.5
+	ibltHeaderSize      = 24
+)
+
+// ErrIBLTDecode is returned by Decode when the IBLT holds too many keys to be
+// listed.
+var ErrIBLTDecode = errors.New("bloom: iblt cannot be decoded")
+
+// ErrInvalidIBLT is returned when reading an IBLT from a stream that does not
+// hold one.
+var ErrInvalidIBLT = errors.New("bloom: invalid iblt")
+
+// IBLT is an Invertible Bloom Lookup Table (Goodrich and Mitzenmacher), a
+// set of fixed size keys that can be listed back as long as it holds few
+// enough keys, for set reconciliation (Eppstein et al., "What's the
+// Difference?"). Two sites insert their keys into IBLTs of the same
+// dimensions, one of them is shipped and subtracted from the other, and
+// decoding the difference lists the keys of each site missing from the
+// other, with cells in proportion to the size of the difference, whatever
+// the size of the sets.
+//
+// Each of the m cells holds the number of keys mapped to it, the XOR of the
+// keys and the XOR of a hash of the keys. A key maps to k cells, one in each
+// of k subtables, located like the bits of a Bloom filter. A cell left with a
+// single key, inserted or deleted, gives it away, and removing the key from
+// its other cells frees more keys, until the table is empty. With the
+// dimensions of EstimateIBLTParameters, a difference of the expected size is
+// decoded with a probability over 99%.
+//
+// An IBLT is not safe for concurrent use.
+type IBLT struct {
+	m, k    uint
+	keySize int
+	counts  []int64
+	hashes  []uint64
+	keys    []byte
+}
+
+// EstimateIBLTParameters returns the number of cells m and of cells per key
+// k of an IBLT decoding differences of up to d keys.
+func EstimateIBLTParameters(d uint) (m, k uint) {
+	k = ibltLargeK
+	if d < ibltSmallDifference {
+		k = ibltSmallK
+	}
+	m = uint(math.Ceil(ibltOverhead*float64(d))) + 8*k
+	return (m + k - 1) / k * k, k
+}
+
+// NewIBLT creates an empty IBLT of m cells, rounded up to a multiple of k,
+// of keys of keySize bytes mapped to k cells.
+func NewIBLT(m, k uint, keySize int) *IBLT {
+	k = max(1, k)
+	m = (max(k, m) + k - 1) / k * k
+	if keySize < 1 {
+		keySize = 1
+	}
+	return &IBLT{
+		m:       m,
+		k:       k,
+		keySize: keySize,
+		counts:  make([]int64, m),
+		hashes:  make([]uint64, m),
+		keys:    make([]byte, int(m)*keySize),
+	}
+}
+
+// NewIBLTWithEstimates creates an IBLT of keys of keySize bytes decoding
+// differences of up to d keys, see EstimateIBLTParameters.
+func NewIBLTWithEstimates(d uint, keySize int) *IBLT {
+	m, k := EstimateIBLTParameters(d)
+	return NewIBLT(m, k, keySize)
+}
+
+// Cells returns the number of cells, m.
+func (t *IBLT) Cells() uint {
+	return t.m
+}
+
+// K returns the number of cells a key maps to.
+func (t *IBLT) K() uint {
+	return t.k
+}
+
+// KeySize returns the size of the keys, in bytes.
+func (t *IBLT) KeySize() int {
+	return t.keySize
+}
+
+// Insert inserts key, of KeySize bytes.
+func (t *IBLT) Insert(key []byte) error {
+	return t.update(key, 1)
+}
+
+// Delete deletes key, of KeySize bytes. The key need not have been
+// inserted: it is then listed as deleted by Decode.
+func (t *IBLT) Delete(key []byte) error {
+	return t.update(key, -1)
+}
+
+func (t *IBLT) update(key []byte, count int64) error {
+	if len(key) != t.keySize {
+		return fmt.Errorf("bloom: key of %d bytes in an iblt of %d-byte keys", len(key), t.keySize)
+	}
+	h := baseHashes(key)
+	for i := uint(0); i < t.k; i++ {
+		t.updateCell(t.cell(h, i), key, h[3], count)
+	}
+	return nil
+}
+
+// cell returns the cell of the key of base hash values h in subtable i.
+func (t *IBLT) cell(h [4]uint64, i uint) uint {
+	size := t.m / t.k
+	return i*size + uint(location(h, i)%uint64(size))
+}
+
+func (t *IBLT) updateCell(c uint, key []byte, hash uint64, count int64) {
+	t.counts[c] += count
+	t.hashes[c] ^= hash
+	sum := t.keys[int(c)*t.keySize : int(c+1)*t.keySize]
+	for j := range sum {
+		sum[j] ^= key[j]
+	}
+}
+
+// Subtract removes the keys of g from the table: keys inserted in g count
+// as deleted, and the keys of both cancel out. Both tables must have the
+// same dimensions.
+func (t *IBLT) Subtract(g *IBLT) error {
+	if t.m != g.m || t.k != g.k || t.keySize != g.keySize {
+		return ErrIncompatibleSketch
+	}
+	for c := range t.counts {
+		t.counts[c] -= g.counts[c]
+		t.hashes[c] ^= g.hashes[c]
+	}
+	for j := range t.keys {
+		t.keys[j] ^= g.keys[j]
+	}
+	return nil
+}
+
+// pure returns whether cell c holds a single key, inserted or deleted.
+func (t *IBLT) pure(c uint) bool {
+	if t.counts[c] != 1 && t.counts[c] != -1 {
+		return false
+	}
+	return baseHashes(t.keys[int(c)*t.keySize : int(c+1)*t.keySize])[3] == t.hashes[c]
+}
+
+// Decode lists the keys of the table, the inserted ones and the deleted
+// ones, without modifying it. If the table holds too many keys, it returns
+// the keys it could list and ErrIBLTDecode.
+func (t *IBLT) Decode() (inserted, deleted [][]byte, err error) {
+	s := t.clone()
+	var queue []uint
+	for c := uint(0); c < s.m; c++ {
+		if s.pure(c) {
+			queue = append(queue, c)
+		}
+	}
+	for len(queue) > 0 {
+		c := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		// the cell may have changed since it was queued
+		if !s.pure(c) {
+			continue
+		}
+		key := append([]byte(nil), s.keys[int(c)*s.keySize:int(c+1)*s.keySize]...)
+		count := s.counts[c]
+		if count == 1 {
+			inserted = append(inserted, key)
+		} else {
+			deleted = append(deleted, key)
+		}
+		h := baseHashes(key)
+		for i := uint(0); i < s.k; i++ {
+			d := s.cell(h, i)
+			s.updateCell(d, key, h[3], -count)
+			if s.pure(d) {
+				queue = append(queue, d)
+			}
+		}
+	}
+	for c := range s.counts {
+		if s.counts[c] != 0 || s.hashes[c] != 0 {
+			return inserted, deleted, ErrIBLTDecode
+		}
+	}
+	for _, b := range s.keys {
+		if b != 0 {
+			return inserted, deleted, ErrIBLTDecode
+		}
+	}
+	return inserted, deleted, nil
+}
+
+func (t *IBLT) clone() *IBLT {
+	return &IBLT{
+		m:       t.m,
+		k:       t.k,
+		keySize: t.keySize,
+		counts:  append([]int64(nil), t.counts...),
+		hashes:  append([]uint64(nil), t.hashes...),
+		keys:    append([]byte(nil), t.keys...),
+	}
+}
+
+// WriteTo writes the table to an i/o stream: m, k and the size of the keys
+// as big-endian uint64, then each cell: its count as a big-endian int64, its
+// hash sum as a big-endian uint64 and its key sum. It returns the number of
+// bytes written.
+func (t *IBLT) WriteTo(stream io.Writer) (int64, error) {
+	cellSize := 16 + t.keySize
+	data := make([]byte, ibltHeaderSize+int(t.m)*cellSize)
+	binary.BigEndian.PutUint64(data, uint64(t.m))
+	binary.BigEndian.PutUint64(data[8:], uint64(t.k))
+	binary.BigEndian.PutUint64(data[16:], uint64(t.keySize))
+	for c := 0; c < int(t.m); c++ {
+		cell := data[ibltHeaderSize+c*cellSize:]
+		binary.BigEndian.PutUint64(cell, uint64(t.counts[c]))
+		binary.BigEndian.PutUint64(cell[8:], t.hashes[c])
+		copy(cell[16:cellSize], t.keys[c*t.keySize:])
+	}
+	n, err := stream.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom reads a table written by WriteTo from an i/o stream, replacing
+// the table. It returns the number of bytes read.
+func (t *IBLT) ReadFrom(stream io.Reader) (int64, error) {
+	var header [ibltHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	m, k := binary.BigEndian.Uint64(header[:]), binary.BigEndian.Uint64(header[8:])
+	keySize := binary.BigEndian.Uint64(header[16:])
+	if k < 1 || k > 32 || m < k || m%k != 0 || keySize < 1 || keySize > 1<<16 || m > (1<<36)/(16+keySize) {
+		return int64(n), ErrInvalidIBLT
+	}
+	// the cells are appended as they are read
+	g := &IBLT{m: uint(m), k: uint(k), keySize: int(keySize)}
+	cellSize := 16 + g.keySize
+	r, err := readRecords(stream, m, cellSize, func(chunk []byte) {
+		for ; len(chunk) > 0; chunk = chunk[cellSize:] {
+			g.counts = append(g.counts, int64(binary.BigEndian.Uint64(chunk)))
+			g.hashes = append(g.hashes, binary.BigEndian.Uint64(chunk[8:]))
+			g.keys = append(g.keys, chunk[16:cellSize]...)
+		}
+	})
+	if err != nil {
+		return int64(n) + r, err
+	}
+	*t = *g
+	return int64(n) + r, nil
+}
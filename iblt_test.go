@@ -0,0 +1,157 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+	"testing"
+)
+
+func ibltKey(i uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, i)
+	return key
+}
+
+func sortedKeys(keys [][]byte) []uint64 {
+	ids := make([]uint64, len(keys))
+	for i, key := range keys {
+		ids[i] = binary.BigEndian.Uint64(key)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func TestIBLTReconciliation(t *testing.T) {
+	// two sites sharing 100000 IDs, each with 50 of its own
+	a, b := NewIBLTWithEstimates(100, 8), NewIBLTWithEstimates(100, 8)
+	for i := uint64(0); i < 100000; i++ {
+		a.Insert(ibltKey(i))
+		b.Insert(ibltKey(i))
+	}
+	for i := uint64(0); i < 50; i++ {
+		a.Insert(ibltKey(1000000 + i))
+		b.Insert(ibltKey(2000000 + i))
+	}
+	if _, _, err := a.Decode(); err != ErrIBLTDecode {
+		t.Errorf("decoding a full table should fail, got %v", err)
+	}
+	if err := a.Subtract(b); err != nil {
+		t.Fatal(err)
+	}
+	onlyA, onlyB, err := a.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ids, others := sortedKeys(onlyA), sortedKeys(onlyB)
+	if len(ids) != 50 || len(others) != 50 {
+		t.Fatalf("unexpected differences of %d and %d keys", len(ids), len(others))
+	}
+	for i := range ids {
+		if ids[i] != 1000000+uint64(i) || others[i] != 2000000+uint64(i) {
+			t.Fatalf("unexpected keys %d and %d", ids[i], others[i])
+		}
+	}
+	// decoding leaves the table untouched
+	if again, _, err := a.Decode(); err != nil || len(again) != 50 {
+		t.Errorf("decoding twice should give the same keys, got %d, %v", len(again), err)
+	}
+}
+
+func TestIBLTInsertDelete(t *testing.T) {
+	s := NewIBLT(60, 3, 8)
+	if s.Cells() != 60 || s.K() != 3 || s.KeySize() != 8 {
+		t.Errorf("unexpected dimensions %d, %d, %d", s.Cells(), s.K(), s.KeySize())
+	}
+	for i := uint64(0); i < 20; i++ {
+		s.Insert(ibltKey(i))
+	}
+	for i := uint64(0); i < 15; i++ {
+		s.Delete(ibltKey(i))
+	}
+	s.Delete(ibltKey(99))
+	inserted, deleted, err := s.Decode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := sortedKeys(inserted); len(ids) != 5 || ids[0] != 15 || ids[4] != 19 {
+		t.Errorf("unexpected inserted keys %v", ids)
+	}
+	if ids := sortedKeys(deleted); len(ids) != 1 || ids[0] != 99 {
+		t.Errorf("unexpected deleted keys %v", ids)
+	}
+
+	if err := s.Insert([]byte("short")); err == nil {
+		t.Error("inserting a key of another size should fail")
+	}
+	if err := s.Subtract(NewIBLT(60, 4, 8)); err != ErrIncompatibleSketch {
+		t.Errorf("expected ErrIncompatibleSketch, got %v", err)
+	}
+}
+
+func TestEstimateIBLTParameters(t *testing.T) {
+	for _, d := range []uint{1, 10, 100, 1000, 10000} {
+		failures := 0
+		for trial := uint64(0); trial < 50; trial++ {
+			s := NewIBLTWithEstimates(d, 8)
+			for i := uint64(0); i < uint64(d); i++ {
+				s.Insert(ibltKey(trial<<32 | i))
+			}
+			if _, _, err := s.Decode(); err != nil {
+				failures++
+			}
+		}
+		if failures > 2 {
+			t.Errorf("difference of %d keys: %d of 50 decodings failed", d, failures)
+		}
+	}
+}
+
+func TestIBLTReadWrite(t *testing.T) {
+	s := NewIBLTWithEstimates(30, 8)
+	for i := uint64(0); i < 30; i++ {
+		s.Insert(ibltKey(i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := s.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewIBLT(3, 3, 1)
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if err := g.Subtract(s); err != nil {
+		t.Fatal(err)
+	}
+	if inserted, deleted, err := g.Decode(); err != nil || len(inserted)+len(deleted) != 0 {
+		t.Errorf("the tables should cancel out, got %d, %d, %v", len(inserted), len(deleted), err)
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, ibltHeaderSize))); err != ErrInvalidIBLT {
+		t.Errorf("expected ErrInvalidIBLT, got %v", err)
+	}
+	// 2^60 cells of 32 bytes overflow 64 bits
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(1<<60, 1, 16))); err != ErrInvalidIBLT {
+		t.Errorf("expected ErrInvalidIBLT, got %v", err)
+	}
+	// the cells are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(1<<30, 1, 16))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// bigEndianHeader returns the header of big-endian uint64 values, as written
+// by the WriteTo methods.
+func bigEndianHeader(values ...uint64) []byte {
+	data := make([]byte, 8*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint64(data[8*i:], v)
+	}
+	return data
+}
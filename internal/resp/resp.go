@@ -0,0 +1,324 @@
+// Package resp implements the subset of the Redis serialization protocol
+// (RESP2) needed to serve Redis compatible commands, so that any Redis client
+// library can talk to a server built on this package.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxBulkLen is the largest bulk string accepted from a client, the limit of
+// a Redis string, and maxArgs the largest number of arguments of a command,
+// the limit of Redis.
+const (
+	maxBulkLen = 512 * 1024 * 1024
+	maxArgs    = 1024 * 1024
+)
+
+// ErrProtocol is returned when a client sends a malformed command.
+var ErrProtocol = errors.New("resp: protocol error")
+
+// ReadCommand reads one command, sent either as an array of bulk strings or
+// as an inline command.
+func ReadCommand(r *bufio.Reader) ([][]byte, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	if line[0] != '*' {
+		fields := strings.Fields(string(line))
+		args := make([][]byte, len(fields))
+		for i, f := range fields {
+			args[i] = []byte(f)
+		}
+		return args, nil
+	}
+	n, err := strconv.Atoi(string(line[1:]))
+	if err != nil || n < 0 || n > maxArgs {
+		return nil, ErrProtocol
+	}
+	// the arguments are appended as they are read, n is not trusted
+	var args [][]byte
+	for i := 0; i < n; i++ {
+		line, err = readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, ErrProtocol
+		}
+		size, err := strconv.Atoi(string(line[1:]))
+		if err != nil || size < 0 || size > maxBulkLen {
+			return nil, ErrProtocol
+		}
+		arg := make([]byte, size+2)
+		if _, err := io.ReadFull(r, arg); err != nil {
+			return nil, err
+		}
+		if arg[size] != '\r' || arg[size+1] != '\n' {
+			return nil, ErrProtocol
+		}
+		args = append(args, arg[:size])
+	}
+	return args, nil
+}
+
+// readLine reads a line terminated by CRLF, without the terminator.
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, ErrProtocol
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, ErrProtocol
+	}
+	return line[:len(line)-2], nil
+}
+
+// Writer writes RESP2 replies. Replies are buffered until Flush.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter creates a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// SimpleString writes a status reply, such as "OK".
+func (w *Writer) SimpleString(s string) {
+	w.w.WriteByte('+')
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// Error writes an error reply. By convention msg starts with an error code,
+// such as "ERR".
+func (w *Writer) Error(msg string) {
+	w.w.WriteByte('-')
+	w.w.WriteString(msg)
+	w.w.WriteString("\r\n")
+}
+
+// Int writes an integer reply.
+func (w *Writer) Int(n int64) {
+	w.w.WriteByte(':')
+	w.w.WriteString(strconv.FormatInt(n, 10))
+	w.w.WriteString("\r\n")
+}
+
+// Bool writes an integer reply, 1 for true and 0 for false.
+func (w *Writer) Bool(b bool) {
+	if b {
+		w.Int(1)
+	} else {
+		w.Int(0)
+	}
+}
+
+// Bulk writes a bulk string reply.
+func (w *Writer) Bulk(b []byte) {
+	w.w.WriteByte('$')
+	w.w.WriteString(strconv.Itoa(len(b)))
+	w.w.WriteString("\r\n")
+	w.w.Write(b)
+	w.w.WriteString("\r\n")
+}
+
+// BulkString writes a bulk string reply.
+func (w *Writer) BulkString(s string) {
+	w.Bulk([]byte(s))
+}
+
+// Null writes a null bulk string reply.
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array writes the header of an array reply of n elements, which must be
+// followed by the n elements.
+func (w *Writer) Array(n int) {
+	w.w.WriteByte('*')
+	w.w.WriteString(strconv.Itoa(n))
+	w.w.WriteString("\r\n")
+}
+
+// Flush writes the buffered replies to the connection.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+// HandlerFunc serves a command. args[0] is the command name, as sent by the
+// client. The handler must write exactly one reply. Handlers are called
+// concurrently for different connections.
+type HandlerFunc func(w *Writer, args [][]byte)
+
+// Server serves Redis compatible commands over RESP2.
+type Server struct {
+	mu        sync.Mutex
+	handlers  map[string]HandlerFunc
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a Server answering PING, ECHO and QUIT. Other commands
+// are registered with Handle.
+func NewServer() *Server {
+	s := &Server{
+		handlers:  make(map[string]HandlerFunc),
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+	s.Handle("PING", func(w *Writer, args [][]byte) {
+		if len(args) > 1 {
+			w.Bulk(args[1])
+			return
+		}
+		w.SimpleString("PONG")
+	})
+	s.Handle("ECHO", func(w *Writer, args [][]byte) {
+		if len(args) != 2 {
+			w.Error(WrongArity(args))
+			return
+		}
+		w.Bulk(args[1])
+	})
+	return s
+}
+
+// Handle registers the handler of a command. Command names are case
+// insensitive.
+func (s *Server) Handle(name string, h HandlerFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[strings.ToUpper(name)] = h
+}
+
+// WrongArity returns the error message for a command called with the wrong
+// number of arguments.
+func WrongArity(args [][]byte) string {
+	return fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(args[0])))
+}
+
+// ListenAndServe listens on the TCP address addr and serves connections.
+func (s *Server) ListenAndServe(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on l and serves them, until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners, closes the connections and waits for the
+// handlers in flight.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if e := l.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		s.wg.Done()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := NewWriter(conn)
+	for {
+		args, err := ReadCommand(r)
+		if err != nil {
+			if err == ErrProtocol {
+				w.Error("ERR Protocol error")
+				w.Flush()
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		name := strings.ToUpper(string(args[0]))
+		if name == "QUIT" {
+			w.SimpleString("OK")
+			w.Flush()
+			return
+		}
+		s.mu.Lock()
+		h, ok := s.handlers[name]
+		s.mu.Unlock()
+		if ok {
+			h(w, args)
+		} else {
+			w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		}
+		// flush once the pipelined commands already received are answered
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package resp
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*2\r\n$4\r\nPING\r\n$2\r\nhi\r\nPING hi\r\n"))
+	for i := 0; i < 2; i++ {
+		args, err := ReadCommand(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(args) != 2 || string(args[0]) != "PING" || string(args[1]) != "hi" {
+			t.Errorf("unexpected command %q", args)
+		}
+	}
+}
+
+func TestReadCommandLimits(t *testing.T) {
+	for _, command := range []string{
+		"*9223372036854775807\r\n",
+		"*1048577\r\n",
+		"*-1\r\n",
+		"*1\r\n$536870913\r\n",
+		"*1\r\n$2\r\nhi\n\n",
+	} {
+		if _, err := ReadCommand(bufio.NewReader(strings.NewReader(command))); err != ErrProtocol {
+			t.Errorf("%q: expected ErrProtocol, got %v", command, err)
+		}
+	}
+	// a large array is read as far as the client sends it
+	if _, err := ReadCommand(bufio.NewReader(strings.NewReader("*1048576\r\n$2\r\nhi\r\n"))); err == nil {
+		t.Error("a truncated command should fail")
+	}
+}
@@ -0,0 +1,189 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math/bits"
+)
+
+// NewMemoryBitSet creates an empty in-memory BitSet. Call Init (New does it
+// for you) to allocate the bits.
+func NewMemoryBitSet() BitSet {
+	return &MemoryBitSet{}
+}
+
+// MemoryBitSet is a BitSet held in process memory.
+//
+// The bits are laid out exactly like a Redis string manipulated with SETBIT:
+// bit i lives in byte i/8 and the most significant bit of a byte comes
+// first. A MemoryBitSet can therefore be loaded from, or stored to, the value
+// of a RedisBitSet key without any conversion.
+type MemoryBitSet struct {
+	data []byte
+}
+
+func (s *MemoryBitSet) Init(length uint) BitSet {
+	// SETBIT on offset length allocates length/8+1 bytes, do the same so that
+	// memory and Redis backed bitsets compare equal.
+	s.data = make([]byte, length/8+1)
+	return s
+}
+
+func (s *MemoryBitSet) Set(i uint) BitSet {
+	s.data[i>>3] |= 0x80 >> (i & 7)
+	return s
+}
+
+func (s *MemoryBitSet) UnSet(i uint) BitSet {
+	s.data[i>>3] &^= 0x80 >> (i & 7)
+	return s
+}
+
+func (s *MemoryBitSet) InPlaceUnion(compare BitSet) {
+	other := bitSetBytes(compare)
+	if len(other) > len(s.data) {
+		data := make([]byte, len(other))
+		copy(data, s.data)
+		s.data = data
+	}
+	for i, b := range other {
+		s.data[i] |= b
+	}
+}
+
+func (s *MemoryBitSet) Test(i uint) bool {
+	if i>>3 >= uint(len(s.data)) {
+		return false
+	}
+	return s.data[i>>3]&(0x80>>(i&7)) != 0
+}
+
+func (s *MemoryBitSet) ClearAll() BitSet {
+	for i := range s.data {
+		s.data[i] = 0
+	}
+	return s
+}
+
+func (s *MemoryBitSet) Count() uint {
+	return popCount(s.data)
+}
+
+func (s *MemoryBitSet) WriteTo(stream io.Writer) (int64, error) {
+	err := binary.Write(stream, binary.BigEndian, uint64(len(s.data)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := stream.Write(s.data)
+	return int64(n + binary.Size(uint64(0))), err
+}
+
+func (s *MemoryBitSet) Equal(c BitSet) bool {
+	return bytes.Equal(s.data, bitSetBytes(c))
+}
+
+// GetBitSetKey returns an empty string, a MemoryBitSet has no Redis key.
+func (s *MemoryBitSet) GetBitSetKey() string {
+	return ""
+}
+
+func (s *MemoryBitSet) ReadFrom(stream io.Reader) (int64, error) {
+	var length uint64
+	err := binary.Read(stream, binary.BigEndian, &length)
+	if err != nil {
+		return 0, err
+	}
+	data := make([]byte, length)
+	n, err := io.ReadFull(stream, data)
+	if err != nil {
+		return 0, err
+	}
+	s.data = data
+	return int64(n + binary.Size(uint64(0))), nil
+}
+
+// From uses the same byte layout as RedisBitSet.From, so both backends
+// hold the same bits for the same input.
+func (s *MemoryBitSet) From(buf []uint64) BitSet {
+	s.data = make([]byte, 8*len(buf))
+	for i, val := range buf {
+		binary.LittleEndian.PutUint64(s.data[8*i:], val)
+	}
+	return s
+}
+
+// Bytes returns the raw bits, in Redis bit order. The slice is shared with
+// the bitset.
+func (s *MemoryBitSet) Bytes() []byte {
+	return s.data
+}
+
+// SetBytes replaces the bits with data, in Redis bit order. The slice is
+// used directly, not copied.
+func (s *MemoryBitSet) SetBytes(data []byte) {
+	s.data = data
+}
+
+// SetBits sets all the bits in idx.
+func (s *MemoryBitSet) SetBits(_ context.Context, idx []uint) error {
+	for _, i := range idx {
+		s.Set(i)
+	}
+	return nil
+}
+
+// TestBits returns true if all the bits in idx are set.
+func (s *MemoryBitSet) TestBits(_ context.Context, idx []uint) (bool, error) {
+	for _, i := range idx {
+		if !s.Test(i) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// grow extends the bitset, if needed, so that bit i can be set.
+func (s *MemoryBitSet) grow(i uint) {
+	if i>>3 < uint(len(s.data)) {
+		return
+	}
+	data := make([]byte, i/8+1)
+	copy(data, s.data)
+	s.data = data
+}
+
+// bitSetBytes returns the raw bits of b in Redis bit order.
+func bitSetBytes(b BitSet) []byte {
+	switch c := b.(type) {
+	case *MemoryBitSet:
+		return c.data
+	case *RedisBitSet:
+		data, _ := c.redisClient.Get(context.Background(), c.bitsetKey).Bytes()
+		return data
+	case *FileBitSet:
+		return c.bits()
+	case *CachedBitSet:
+		c.mu.RLock()
+		defer c.mu.RUnlock()
+		return append([]byte(nil), c.local.data...)
+	case *DeltaBitSet:
+		return bitSetBytes(c.b)
+	default:
+		return nil
+	}
+}
+
+// popCount returns the number of set bits in data.
+func popCount(data []byte) uint {
+	var count int
+	for len(data) >= 8 {
+		count += bits.OnesCount64(binary.BigEndian.Uint64(data))
+		data = data[8:]
+	}
+	for _, b := range data {
+		count += bits.OnesCount8(b)
+	}
+	return uint(count)
+}
@@ -0,0 +1,84 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestMemoryBitSetBasic(t *testing.T) {
+	f := New(1000, 4, NewMemoryBitSet())
+	n1 := []byte("Bess")
+	n2 := []byte("Jane")
+	n3 := []byte("Emma")
+	f.Add(n1)
+	n3a := f.TestAndAdd(n3)
+	if !f.Test(n1) {
+		t.Errorf("%v should be in.", n1)
+	}
+	if f.Test(n2) {
+		t.Errorf("%v should not be in.", n2)
+	}
+	if n3a {
+		t.Errorf("%v should not be in the first time we look.", n3)
+	}
+	if !f.Test(n3) {
+		t.Errorf("%v should be in the second time we look.", n3)
+	}
+}
+
+func TestMemoryBitSetMatchesRedis(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitSetKey := uuid.New().String()
+	r := New(1000, 4, NewRedisBitSet(redisClient, bitSetKey, time.Minute))
+	m := New(1000, 4, NewMemoryBitSet())
+	for _, s := range []string{"one", "two", "three"} {
+		r.AddString(s)
+		m.AddString(s)
+	}
+	if !m.BitSet().Equal(r.BitSet()) {
+		t.Error("memory and redis bitsets should hold the same bits")
+	}
+	data, _ := redisClient.Get(context.Background(), bitSetKey).Bytes()
+	if !bytes.Equal(data, m.BitSet().(*MemoryBitSet).Bytes()) {
+		t.Error("memory bitset should use the redis bit order")
+	}
+
+	r.BitSet().From([]uint64{0x0102030405060708})
+	m.BitSet().From([]uint64{0x0102030405060708})
+	if r.BitSet().Count() != m.BitSet().Count() || !m.BitSet().Equal(r.BitSet()) {
+		t.Error("From should produce the same bits on both backends")
+	}
+}
+
+func TestMemoryBitSetReadWriteBinary(t *testing.T) {
+	f := New(1000, 4, NewMemoryBitSet())
+	f.AddString("one")
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesWritten != int64(buf.Len()) {
+		t.Errorf("incorrect write length %d != %d", bytesWritten, buf.Len())
+	}
+
+	g := New(0, 0, NewMemoryBitSet())
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if !g.Equal(f) {
+		t.Error("filters should be equal")
+	}
+	if !g.TestString("one") {
+		t.Error("missing value 'one'")
+	}
+}
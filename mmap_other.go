@@ -0,0 +1,22 @@
+//go:build !(darwin || dragonfly || freebsd || linux || openbsd)
+
+package bloom
+
+import (
+	"errors"
+	"os"
+)
+
+var errMmapUnsupported = errors.New("bloom: memory-mapped files are not supported on this platform")
+
+func mmapFile(*os.File, int, bool) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmap([]byte) error {
+	return errMmapUnsupported
+}
+
+func msync([]byte) error {
+	return errMmapUnsupported
+}
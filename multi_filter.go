@@ -0,0 +1,200 @@
+package bloom
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// hashLocator is implemented by the filters computing their bit locations
+// from the base hash values of a key.
+type hashLocator interface {
+	hashLocations(h [4]uint64, dst []uint) []uint
+}
+
+// redisBitLocator is implemented by the bitsets stored in Redis strings. It
+// returns the client, the key and the offset holding bit i.
+type redisBitLocator interface {
+	redisBit(i uint) (redis.UniversalClient, string, int64)
+}
+
+// redisBitWriter is implemented by the bitsets stored in Redis whose writes
+// can share a pipeline with those of other bitsets.
+type redisBitWriter interface {
+	redisBitLocator
+	queueSetBits(ctx context.Context, pipe redis.Pipeliner, idx []uint) error
+}
+
+func (r *RedisBitSet) redisBit(i uint) (redis.UniversalClient, string, int64) {
+	return r.redisClient, r.bitsetKey, int64(i)
+}
+
+func (s *ShardedRedisBitSet) redisBit(i uint) (redis.UniversalClient, string, int64) {
+	key, offset := s.locate(i)
+	return s.redisClient, key, offset
+}
+
+// MultiFilter tests a key against many filters at once, such as one filter
+// per tenant, and returns the IDs of the filters that may contain it.
+//
+// The key is hashed once for all the filters, whatever their m and k. The
+// bits of the filters stored in Redis (RedisBitSet and ShardedRedisBitSet)
+// are read with a single pipeline per Redis client, so testing a key
+// against any number of Redis filters costs one round trip. Filters that
+// cannot be tested from hashes, such as a RedisBloomFilter, are tested one
+// by one.
+//
+// A MultiFilter is safe for concurrent use.
+type MultiFilter struct {
+	mu      sync.RWMutex
+	ids     []string
+	filters []BloomFilter
+}
+
+// NewMultiFilter creates an empty MultiFilter.
+func NewMultiFilter() *MultiFilter {
+	return &MultiFilter{}
+}
+
+// Set adds the filter f under id, replacing the filter already there.
+func (mf *MultiFilter) Set(id string, f BloomFilter) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	for i, other := range mf.ids {
+		if other == id {
+			mf.filters[i] = f
+			return
+		}
+	}
+	mf.ids = append(mf.ids, id)
+	mf.filters = append(mf.filters, f)
+}
+
+// Remove removes the filter of id, if any.
+func (mf *MultiFilter) Remove(id string) {
+	mf.mu.Lock()
+	defer mf.mu.Unlock()
+	for i, other := range mf.ids {
+		if other == id {
+			mf.ids = append(mf.ids[:i], mf.ids[i+1:]...)
+			mf.filters = append(mf.filters[:i], mf.filters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns the filter of id, or nil.
+func (mf *MultiFilter) Get(id string) BloomFilter {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	for i, other := range mf.ids {
+		if other == id {
+			return mf.filters[i]
+		}
+	}
+	return nil
+}
+
+// IDs returns the IDs of the filters, in the order they were added.
+func (mf *MultiFilter) IDs() []string {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+	return append([]string(nil), mf.ids...)
+}
+
+// Test returns the IDs of the filters that may contain data, in the order
+// they were added.
+func (mf *MultiFilter) Test(ctx context.Context, data []byte) ([]string, error) {
+	return mf.test(ctx, baseHashes(data), data)
+}
+
+// TestString returns the IDs of the filters that may contain data, see Test.
+func (mf *MultiFilter) TestString(ctx context.Context, data string) ([]string, error) {
+	return mf.Test(ctx, stringBytes(data))
+}
+
+// TestHashes returns the IDs of the filters that may contain the key of
+// base hash values h, as returned by Hashes. It fails if one of the filters
+// cannot be tested from hashes.
+func (mf *MultiFilter) TestHashes(ctx context.Context, h [4]uint64) ([]string, error) {
+	return mf.test(ctx, h, nil)
+}
+
+// redisQuery is the GETBITs of a filter queued in the pipeline of its
+// client.
+type redisQuery struct {
+	filter int
+	cmds   []*redis.IntCmd
+}
+
+// test tests the key of hashes h, and of bytes data if known.
+func (mf *MultiFilter) test(ctx context.Context, h [4]uint64, data []byte) ([]string, error) {
+	mf.mu.RLock()
+	defer mf.mu.RUnlock()
+
+	present := make([]bool, len(mf.filters))
+	pipes := make(map[redis.UniversalClient]redis.Pipeliner)
+	var queries []redisQuery
+	var locs []uint
+	for i, f := range mf.filters {
+		locator, ok := f.(hashLocator)
+		if !ok {
+			hashed, ok := f.(HashedBloomFilter)
+			switch {
+			case data != nil:
+				present[i] = f.Test(data)
+			case ok:
+				present[i] = hashed.TestHashes(h)
+			default:
+				return nil, fmt.Errorf("bloom: filter %s cannot be tested from hashes", mf.ids[i])
+			}
+			continue
+		}
+
+		locs = locator.hashLocations(h, locs[:0])
+		bits, ok := f.BitSet().(redisBitLocator)
+		if !ok {
+			var err error
+			if present[i], err = testBits(ctx, f.BitSet(), locs); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		query := redisQuery{filter: i, cmds: make([]*redis.IntCmd, len(locs))}
+		for j, l := range locs {
+			client, key, offset := bits.redisBit(l)
+			pipe, ok := pipes[client]
+			if !ok {
+				pipe = client.Pipeline()
+				pipes[client] = pipe
+			}
+			query.cmds[j] = pipe.GetBit(ctx, key, offset)
+		}
+		queries = append(queries, query)
+	}
+
+	for _, pipe := range pipes {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, err
+		}
+	}
+	for _, query := range queries {
+		present[query.filter] = true
+		for _, cmd := range query.cmds {
+			if cmd.Val() != 1 {
+				present[query.filter] = false
+				break
+			}
+		}
+	}
+
+	var ids []string
+	for i, ok := range present {
+		if ok {
+			ids = append(ids, mf.ids[i])
+		}
+	}
+	return ids, nil
+}
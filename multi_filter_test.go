@@ -0,0 +1,89 @@
+package bloom
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestMultiFilter(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	ctx := context.Background()
+
+	mf := NewMultiFilter()
+	mf.Set("memory", NewWithEstimates(1000, 0.001, NewMemoryBitSet()))
+	mf.Set("redis", NewWithEstimates(500, 0.01, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute)))
+	mf.Set("sharded", New(100000, 4, NewShardedRedisBitSet(redisClient, uuid.New().String(), 4, time.Minute, SpreadShardKeys)))
+	mf.Set("blocked", NewBlocked(10000, 6, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute)))
+
+	mf.Get("memory").AddString("Bess")
+	mf.Get("redis").AddString("Bess")
+	mf.Get("redis").AddString("Jane")
+	mf.Get("sharded").AddString("Jane")
+	mf.Get("blocked").AddString("Bess")
+
+	ids, err := mf.TestString(ctx, "Bess")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"memory", "redis", "blocked"}) {
+		t.Errorf("unexpected filters for Bess %v", ids)
+	}
+	ids, err = mf.TestHashes(ctx, HashesString("Jane"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"redis", "sharded"}) {
+		t.Errorf("unexpected filters for Jane %v", ids)
+	}
+	if ids, _ := mf.Test(ctx, []byte("Emma")); len(ids) != 0 {
+		t.Errorf("Emma should not be in any filter, got %v", ids)
+	}
+
+	mf.Remove("redis")
+	mf.Set("memory", NewWithEstimates(1000, 0.001, NewMemoryBitSet()))
+	ids, _ = mf.TestString(ctx, "Bess")
+	if !reflect.DeepEqual(ids, []string{"blocked"}) {
+		t.Errorf("unexpected filters after Remove and Set %v", ids)
+	}
+	if !reflect.DeepEqual(mf.IDs(), []string{"memory", "sharded", "blocked"}) {
+		t.Errorf("unexpected IDs %v", mf.IDs())
+	}
+}
+
+func TestMultiFilterRedisBloom(t *testing.T) {
+	standIn := newRedisBloomStandIn(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{standIn.addr}})
+	ctx := context.Background()
+	f, err := NewRedisBloomFilter(ctx, redisClient, uuid.New().String(), 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddString("Bess")
+
+	mf := NewMultiFilter()
+	mf.Set("bf", f)
+	if ids, err := mf.TestString(ctx, "Bess"); err != nil || len(ids) != 1 {
+		t.Errorf("unexpected result %v %v", ids, err)
+	}
+	if _, err := mf.TestHashes(ctx, HashesString("Bess")); err == nil {
+		t.Error("a RedisBloomFilter cannot be tested from hashes")
+	}
+}
+
+func BenchmarkMultiFilterRedis(b *testing.B) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	ctx := context.Background()
+	mf := NewMultiFilter()
+	for i := 0; i < 200; i++ {
+		mf.Set(uuid.New().String(), NewWithEstimates(10000, 0.01, NewRedisBitSet(redisClient, uuid.New().String(), time.Minute)))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _ = mf.TestString(ctx, "Love")
+	}
+}
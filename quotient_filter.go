@@ -0,0 +1,882 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Layout of a quotient filter table: q, r and the number of fingerprints,
+// big-endian, followed by 2^q slots of r+3 bits packed in Redis bit order.
+// The same bytes are stored in Redis and written by WriteTo.
+const (
+	qfHeaderSize = 24
+	qfMaxQ       = 48
+	qfMaxR       = 61
+	// qfMaxLoad is the load factor the filters are sized for.
+	qfMaxLoad = 0.75
+)
+
+// The metadata bits of a slot, below its remainder.
+const (
+	qfOccupied     = 1 << 0
+	qfContinuation = 1 << 1
+	qfShifted      = 1 << 2
+)
+
+// ErrQuotientFilterFull is returned when inserting into a quotient filter
+// whose slots are all used. Resize it.
+var ErrQuotientFilterFull = errors.New("bloom: quotient filter is full")
+
+// ErrInvalidQuotientFilter is returned when reading a quotient filter from a
+// stream that does not hold one.
+var ErrInvalidQuotientFilter = errors.New("bloom: invalid quotient filter")
+
+// QuotientFilter is a quotient filter (Bender et al., "Don't Thrash: How to
+// Cache Your Hash on Flash"). A key is reduced to a fingerprint of q+r bits:
+// the q high bits, the quotient, select a slot among 2^q, and the r low bits,
+// the remainder, are stored in the slot, or in the next free ones, sorted,
+// with three bits locating them back.
+//
+// Unlike a Bloom filter, fingerprints can be removed, and since a key
+// inserted twice is stored twice, removing it once keeps it. Removing a key
+// never inserted may remove another key sharing its fingerprint. Resize
+// doubles the number of slots by moving a bit of each remainder to its
+// quotient, without the original keys, and Merge combines filters by merging
+// their sorted fingerprints. The false positive rate is about 2^-r.
+//
+// The slots are stored in memory or in a Redis string (NewRedisQuotientFilter).
+// An in-memory filter is not safe for concurrent use.
+type QuotientFilter struct {
+	store quotientStore
+}
+
+// EstimateQuotientParameters returns the number of quotient bits q and of
+// remainder bits r of a quotient filter for about n keys with fp false
+// positive rate.
+func EstimateQuotientParameters(n uint, fp float64) (q, r uint) {
+	q = uint(math.Ceil(math.Log2(float64(max(1, n)) / qfMaxLoad)))
+	r = uint(math.Ceil(-math.Log2(fp)))
+	return qfParams(q, r)
+}
+
+// qfParams clamps q and r to the sizes supported.
+func qfParams(q, r uint) (uint, uint) {
+	q = max(1, q)
+	if q > qfMaxQ {
+		q = qfMaxQ
+	}
+	r = max(1, r)
+	if r > qfMaxR {
+		r = qfMaxR
+	}
+	if q+r > 64 {
+		r = 64 - q
+	}
+	return q, r
+}
+
+// NewQuotientFilter creates an in-memory quotient filter of 2^q slots holding
+// r-bit remainders.
+func NewQuotientFilter(q, r uint) *QuotientFilter {
+	q, r = qfParams(q, r)
+	return &QuotientFilter{store: &memoryQuotientStore{data: newQuotientTable(q, r)}}
+}
+
+// NewQuotientFilterWithEstimates creates an in-memory quotient filter for
+// about n keys with fp false positive rate.
+func NewQuotientFilterWithEstimates(n uint, fp float64) *QuotientFilter {
+	return NewQuotientFilter(EstimateQuotientParameters(n, fp))
+}
+
+// NewRedisQuotientFilter creates a quotient filter stored in the Redis string
+// key, of 2^q slots holding r-bit remainders. If key already holds a filter,
+// its own q and r are used. An operation reads and writes only the chunks of
+// the string around the slots of the key, in a WATCH/MULTI transaction, so
+// that several processes can share the filter.
+func NewRedisQuotientFilter(redisClient redis.UniversalClient, key string, q, r uint) *QuotientFilter {
+	q, r = qfParams(q, r)
+	return &QuotientFilter{store: &redisQuotientStore{redisClient: redisClient, key: key, q: q, r: r}}
+}
+
+// fingerprint returns the fingerprint of the key of hash h in a table of
+// 2^q slots with r-bit remainders.
+func fingerprint(h uint64, q, r uint) uint64 {
+	return h >> (64 - q - r)
+}
+
+// Params returns the number of quotient bits q and of remainder bits r of
+// the filter.
+func (f *QuotientFilter) Params(ctx context.Context) (q, r uint, err error) {
+	err = f.store.view(ctx, false, func(t qfTable) error {
+		q, r = t.params()
+		return nil
+	})
+	return q, r, err
+}
+
+// Count returns the number of fingerprints in the filter.
+func (f *QuotientFilter) Count(ctx context.Context) (uint, error) {
+	var count uint64
+	err := f.store.view(ctx, false, func(t qfTable) error {
+		count = t.count()
+		return nil
+	})
+	return uint(count), err
+}
+
+// Insert inserts data into the filter. It fails with ErrQuotientFilterFull
+// if no slot is free.
+func (f *QuotientFilter) Insert(ctx context.Context, data []byte) error {
+	return f.insert(ctx, baseHashes(data)[0])
+}
+
+// InsertString inserts data into the filter, see Insert.
+func (f *QuotientFilter) InsertString(ctx context.Context, data string) error {
+	return f.insert(ctx, HashesString(data)[0])
+}
+
+func (f *QuotientFilter) insert(ctx context.Context, h uint64) error {
+	return f.store.view(ctx, true, func(t qfTable) error {
+		s := newQFSlots(t)
+		return s.insert(fingerprint(h, s.q, s.r))
+	})
+}
+
+// Contains returns true if data may be in the filter, false if it definitely
+// is not.
+func (f *QuotientFilter) Contains(ctx context.Context, data []byte) (bool, error) {
+	return f.contains(ctx, baseHashes(data)[0])
+}
+
+// ContainsString returns true if data may be in the filter, see Contains.
+func (f *QuotientFilter) ContainsString(ctx context.Context, data string) (bool, error) {
+	return f.contains(ctx, HashesString(data)[0])
+}
+
+func (f *QuotientFilter) contains(ctx context.Context, h uint64) (present bool, err error) {
+	err = f.store.view(ctx, false, func(t qfTable) error {
+		s := newQFSlots(t)
+		present = s.contains(fingerprint(h, s.q, s.r))
+		return nil
+	})
+	return present, err
+}
+
+// Remove removes data from the filter. It returns false if the fingerprint
+// of data was not found.
+func (f *QuotientFilter) Remove(ctx context.Context, data []byte) (bool, error) {
+	return f.remove(ctx, baseHashes(data)[0])
+}
+
+// RemoveString removes data from the filter, see Remove.
+func (f *QuotientFilter) RemoveString(ctx context.Context, data string) (bool, error) {
+	return f.remove(ctx, HashesString(data)[0])
+}
+
+func (f *QuotientFilter) remove(ctx context.Context, h uint64) (removed bool, err error) {
+	err = f.store.view(ctx, true, func(t qfTable) error {
+		s := newQFSlots(t)
+		removed = s.remove(fingerprint(h, s.q, s.r))
+		return nil
+	})
+	return removed, err
+}
+
+// Resize doubles the number of slots of the filter, taking one bit from the
+// remainders, which raises the false positive rate. It fails once the
+// remainders are down to one bit.
+func (f *QuotientFilter) Resize(ctx context.Context) error {
+	return f.store.replace(ctx, func(data []byte) ([]byte, error) {
+		s := newQFSlots(newPackedTable(data))
+		if s.r == 1 {
+			return nil, fmt.Errorf("bloom: cannot resize a quotient filter with 1-bit remainders")
+		}
+		if s.q == qfMaxQ {
+			return nil, fmt.Errorf("bloom: cannot resize a quotient filter of 2^%d slots", qfMaxQ)
+		}
+		return buildQuotientTable(s.q+1, s.r-1, s.fingerprints())
+	})
+}
+
+// Merge inserts the fingerprints of g into the filter. Both filters must have
+// fingerprints of the same size, q+r bits. The filter is resized, if needed,
+// to keep its load under 75%.
+func (f *QuotientFilter) Merge(ctx context.Context, g *QuotientFilter) error {
+	other, err := g.store.bytes(ctx)
+	if err != nil {
+		return err
+	}
+	gs := newQFSlots(newPackedTable(other))
+	gfps := gs.fingerprints()
+	return f.store.replace(ctx, func(data []byte) ([]byte, error) {
+		s := newQFSlots(newPackedTable(data))
+		if s.q+s.r != gs.q+gs.r {
+			return nil, fmt.Errorf("bloom: cannot merge quotient filters with fingerprints of %d and %d bits", s.q+s.r, gs.q+gs.r)
+		}
+		fps := mergeSorted(s.fingerprints(), gfps)
+		q, r := s.q, s.r
+		for float64(len(fps)) > qfMaxLoad*float64(uint64(1)<<q) && r > 1 && q < qfMaxQ {
+			q, r = q+1, r-1
+		}
+		return buildQuotientTable(q, r, fps)
+	})
+}
+
+// mergeSorted merges the sorted slices a and b, keeping duplicates.
+func mergeSorted(a, b []uint64) []uint64 {
+	merged := make([]uint64, 0, len(a)+len(b))
+	for len(a) > 0 && len(b) > 0 {
+		if a[0] <= b[0] {
+			merged, a = append(merged, a[0]), a[1:]
+		} else {
+			merged, b = append(merged, b[0]), b[1:]
+		}
+	}
+	merged = append(merged, a...)
+	return append(merged, b...)
+}
+
+// WriteTo writes the filter to an i/o stream: q, r and the number of
+// fingerprints as big-endian uint64, then the packed slots. It returns the
+// number of bytes written.
+func (f *QuotientFilter) WriteTo(stream io.Writer) (int64, error) {
+	data, err := f.store.bytes(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	n, err := stream.Write(data)
+	return int64(n), err
+}
+
+// ReadFrom reads a filter written by WriteTo from an i/o stream, replacing
+// the content of the filter. It returns the number of bytes read.
+func (f *QuotientFilter) ReadFrom(stream io.Reader) (int64, error) {
+	var header [qfHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	q := binary.BigEndian.Uint64(header[:])
+	r := binary.BigEndian.Uint64(header[8:])
+	count := binary.BigEndian.Uint64(header[16:])
+	if q < 1 || q > qfMaxQ || r < 1 || r > qfMaxR || q+r > 64 || count > 1<<q ||
+		(uint64(1)<<q)*(r+3) > 1<<39 {
+		return int64(n), ErrInvalidQuotientFilter
+	}
+	data := append([]byte(nil), header[:]...)
+	size := uint64(qfTableSize(uint(q), uint(r)) - qfHeaderSize)
+	m, err := readRecords(stream, size, 1, func(chunk []byte) {
+		data = append(data, chunk...)
+	})
+	if err != nil {
+		return int64(n) + m, err
+	}
+	err = f.store.replace(context.Background(), func([]byte) ([]byte, error) {
+		return data, nil
+	})
+	return int64(n) + m, err
+}
+
+// qfTable gives access to the header and slots of a quotient filter table.
+type qfTable interface {
+	params() (q, r uint)
+	count() uint64
+	setCount(n uint64)
+	slot(i uint64) uint64
+	setSlot(i uint64, v uint64)
+}
+
+// qfTableSize returns the size, in bytes, of a table of 2^q slots with r-bit
+// remainders.
+func qfTableSize(q, r uint) int64 {
+	return qfHeaderSize + int64(((uint64(1)<<q)*uint64(r+3)+7)/8)
+}
+
+// newQuotientTable returns an empty table of 2^q slots with r-bit remainders.
+func newQuotientTable(q, r uint) []byte {
+	data := make([]byte, qfTableSize(q, r))
+	binary.BigEndian.PutUint64(data, uint64(q))
+	binary.BigEndian.PutUint64(data[8:], uint64(r))
+	return data
+}
+
+// slotBit returns the offset of the first bit of slot i, for slots of r-bit
+// remainders.
+func slotBit(i uint64, r uint) uint64 {
+	return qfHeaderSize*8 + i*uint64(r+3)
+}
+
+// readSlot returns the width bits of data starting at bit offset bit, in
+// Redis bit order.
+func readSlot(data []byte, bit uint64, width uint) uint64 {
+	var v uint64
+	for i := uint(0); i < width; {
+		off := uint(bit & 7)
+		n := 8 - off
+		if n > width-i {
+			n = width - i
+		}
+		v = v<<n | uint64(data[bit>>3]>>(8-off-n))&(1<<n-1)
+		i += n
+		bit += uint64(n)
+	}
+	return v
+}
+
+// writeSlot writes the width low bits of v to data at bit offset bit, in
+// Redis bit order.
+func writeSlot(data []byte, bit uint64, width uint, v uint64) {
+	for i := uint(0); i < width; {
+		off := uint(bit & 7)
+		n := 8 - off
+		if n > width-i {
+			n = width - i
+		}
+		shift := 8 - off - n
+		mask := byte(1<<n-1) << shift
+		chunk := byte(v>>(width-i-n)) << shift & mask
+		data[bit>>3] = data[bit>>3]&^mask | chunk
+		i += n
+		bit += uint64(n)
+	}
+}
+
+// packedTable is a table held in a byte slice.
+type packedTable struct {
+	data []byte
+	q, r uint
+}
+
+func newPackedTable(data []byte) *packedTable {
+	return &packedTable{
+		data: data,
+		q:    uint(binary.BigEndian.Uint64(data)),
+		r:    uint(binary.BigEndian.Uint64(data[8:])),
+	}
+}
+
+func (t *packedTable) params() (uint, uint) {
+	return t.q, t.r
+}
+
+func (t *packedTable) count() uint64 {
+	return binary.BigEndian.Uint64(t.data[16:])
+}
+
+func (t *packedTable) setCount(n uint64) {
+	binary.BigEndian.PutUint64(t.data[16:], n)
+}
+
+func (t *packedTable) slot(i uint64) uint64 {
+	return readSlot(t.data, slotBit(i, t.r), t.r+3)
+}
+
+func (t *packedTable) setSlot(i uint64, v uint64) {
+	writeSlot(t.data, slotBit(i, t.r), t.r+3, v)
+}
+
+// qfSlots runs the quotient filter algorithms on a table. Fingerprints with
+// equal remainders are kept side by side in their run, so that the filter
+// counts them.
+type qfSlots struct {
+	qfTable
+	q, r uint
+	mask uint64
+}
+
+func newQFSlots(t qfTable) qfSlots {
+	q, r := t.params()
+	return qfSlots{qfTable: t, q: q, r: r, mask: 1<<q - 1}
+}
+
+func (s qfSlots) incr(i uint64) uint64 {
+	return (i + 1) & s.mask
+}
+
+func (s qfSlots) decr(i uint64) uint64 {
+	return (i - 1) & s.mask
+}
+
+// split returns the quotient and the remainder of fp.
+func (s qfSlots) split(fp uint64) (uint64, uint64) {
+	return fp >> s.r, fp & (1<<s.r - 1)
+}
+
+// findRun returns the slot where the run of quotient fq starts, or would
+// start.
+func (s qfSlots) findRun(fq uint64) uint64 {
+	// walk back to the start of the cluster
+	b := fq
+	for s.slot(b)&qfShifted != 0 {
+		b = s.decr(b)
+	}
+	// then forward, one run per occupied quotient
+	run := b
+	for b != fq {
+		for {
+			run = s.incr(run)
+			if s.slot(run)&qfContinuation == 0 {
+				break
+			}
+		}
+		for {
+			b = s.incr(b)
+			if s.slot(b)&qfOccupied != 0 {
+				break
+			}
+		}
+	}
+	return run
+}
+
+// insertAt stores entry in slot i, shifting the following entries up to the
+// next empty slot. The occupied bits stay in place.
+func (s qfSlots) insertAt(i uint64, entry uint64) {
+	for {
+		prev := s.slot(i)
+		empty := prev&7 == 0
+		if !empty {
+			prev |= qfShifted
+			if prev&qfOccupied != 0 {
+				entry |= qfOccupied
+				prev &^= qfOccupied
+			}
+		}
+		s.setSlot(i, entry)
+		if empty {
+			return
+		}
+		entry = prev
+		i = s.incr(i)
+	}
+}
+
+func (s qfSlots) insert(fp uint64) error {
+	count := s.count()
+	if count > s.mask {
+		return ErrQuotientFilterFull
+	}
+	fq, fr := s.split(fp)
+	canonical := s.slot(fq)
+	entry := fr << 3
+	if canonical&7 == 0 {
+		s.setSlot(fq, entry|qfOccupied)
+		s.setCount(count + 1)
+		return nil
+	}
+	if canonical&qfOccupied == 0 {
+		s.setSlot(fq, canonical|qfOccupied)
+	}
+
+	start := s.findRun(fq)
+	i := start
+	if canonical&qfOccupied != 0 {
+		// keep the run sorted
+		for {
+			if s.slot(i)>>3 >= fr {
+				break
+			}
+			i = s.incr(i)
+			if s.slot(i)&qfContinuation == 0 {
+				break
+			}
+		}
+		if i == start {
+			// the old start of the run becomes a continuation
+			s.setSlot(start, s.slot(start)|qfContinuation)
+		} else {
+			entry |= qfContinuation
+		}
+	}
+	if i != fq {
+		entry |= qfShifted
+	}
+	s.insertAt(i, entry)
+	s.setCount(count + 1)
+	return nil
+}
+
+func (s qfSlots) contains(fp uint64) bool {
+	fq, fr := s.split(fp)
+	if s.slot(fq)&qfOccupied == 0 {
+		return false
+	}
+	i := s.findRun(fq)
+	for {
+		rem := s.slot(i) >> 3
+		if rem == fr {
+			return true
+		}
+		if rem > fr {
+			return false
+		}
+		i = s.incr(i)
+		if s.slot(i)&qfContinuation == 0 {
+			return false
+		}
+	}
+}
+
+func (s qfSlots) remove(fp uint64) bool {
+	fq, fr := s.split(fp)
+	canonical := s.slot(fq)
+	if canonical&qfOccupied == 0 {
+		return false
+	}
+	i := s.findRun(fq)
+	for {
+		rem := s.slot(i) >> 3
+		if rem == fr {
+			break
+		}
+		if rem > fr {
+			return false
+		}
+		i = s.incr(i)
+		if s.slot(i)&qfContinuation == 0 {
+			return false
+		}
+	}
+
+	runStart := s.slot(i)&qfContinuation == 0
+	if runStart && s.slot(s.incr(i))&qfContinuation == 0 {
+		// the last entry of the run
+		canonical &^= qfOccupied
+		s.setSlot(fq, canonical)
+	}
+	s.deleteAt(i, fq)
+	if runStart {
+		next := s.slot(i)
+		updated := next
+		if next&qfContinuation != 0 {
+			// the new start of the run
+			updated &^= qfContinuation
+		}
+		if i == fq && updated&qfContinuation == 0 && updated&(qfOccupied|qfShifted) != 0 {
+			// back in its canonical slot
+			updated &^= qfShifted
+		}
+		if updated != next {
+			s.setSlot(i, updated)
+		}
+	}
+	s.setCount(s.count() - 1)
+	return true
+}
+
+// deleteAt removes the entry in slot i, of quotient fq, shifting the
+// following entries of the cluster down.
+func (s qfSlots) deleteAt(i uint64, fq uint64) {
+	curr := s.slot(i)
+	next := s.incr(i)
+	orig := i
+	for {
+		nextEntry := s.slot(next)
+		currOccupied := curr&qfOccupied != 0
+		clusterStart := nextEntry&(qfContinuation|qfShifted) == 0
+		if nextEntry&7 == 0 || clusterStart || next == orig {
+			s.setSlot(i, 0)
+			return
+		}
+		updated := nextEntry
+		if nextEntry&qfContinuation == 0 {
+			// the start of the run of the next occupied quotient
+			for {
+				fq = s.incr(fq)
+				if s.slot(fq)&qfOccupied != 0 {
+					break
+				}
+			}
+			if currOccupied && fq == i {
+				updated &^= qfShifted
+			}
+		}
+		if currOccupied {
+			updated |= qfOccupied
+		} else {
+			updated &^= qfOccupied
+		}
+		s.setSlot(i, updated)
+		i = next
+		next = s.incr(next)
+		curr = nextEntry
+	}
+}
+
+// fingerprints returns the fingerprints of the table, sorted.
+func (s qfSlots) fingerprints() []uint64 {
+	fps := make([]uint64, 0, s.count())
+	if s.count() == 0 {
+		return fps
+	}
+	// start at the start of a cluster, an entry in its canonical slot
+	start := uint64(0)
+	for e := s.slot(start); e&7 == 0 || e&qfShifted != 0; e = s.slot(start) {
+		start = s.incr(start)
+	}
+	fq := start
+	i := start
+	for n := uint64(0); n <= s.mask; n++ {
+		e := s.slot(i)
+		switch {
+		case e&7 == 0:
+		case e&qfShifted == 0:
+			fq = i
+		case e&qfContinuation == 0:
+			for {
+				fq = s.incr(fq)
+				if s.slot(fq)&qfOccupied != 0 {
+					break
+				}
+			}
+		}
+		if e&7 != 0 {
+			fps = append(fps, fq<<s.r|e>>3)
+		}
+		i = s.incr(i)
+	}
+	sort.Slice(fps, func(i, j int) bool { return fps[i] < fps[j] })
+	return fps
+}
+
+// buildQuotientTable returns a table of 2^q slots with r-bit remainders
+// holding the sorted fingerprints fps.
+func buildQuotientTable(q, r uint, fps []uint64) ([]byte, error) {
+	data := newQuotientTable(q, r)
+	s := newQFSlots(newPackedTable(data))
+	for _, fp := range fps {
+		if err := s.insert(fp); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// quotientStore stores the table of a QuotientFilter.
+type quotientStore interface {
+	// view calls fn with the table. If write is true, the changes fn makes
+	// are saved, atomically.
+	view(ctx context.Context, write bool, fn func(t qfTable) error) error
+	// bytes returns the whole table. It must not be modified.
+	bytes(ctx context.Context) ([]byte, error)
+	// replace replaces the table by the one fn returns from the current one,
+	// atomically.
+	replace(ctx context.Context, fn func(data []byte) ([]byte, error)) error
+}
+
+// memoryQuotientStore keeps the table in memory.
+type memoryQuotientStore struct {
+	data []byte
+}
+
+func (s *memoryQuotientStore) view(_ context.Context, _ bool, fn func(t qfTable) error) error {
+	return fn(newPackedTable(s.data))
+}
+
+func (s *memoryQuotientStore) bytes(context.Context) ([]byte, error) {
+	return s.data, nil
+}
+
+func (s *memoryQuotientStore) replace(_ context.Context, fn func(data []byte) ([]byte, error)) error {
+	data, err := fn(s.data)
+	if err != nil {
+		return err
+	}
+	s.data = data
+	return nil
+}
+
+// Redis quotient filters are read and written in chunks of qfChunkSize
+// bytes, with GETRANGE and SETRANGE.
+const qfChunkSize = 512
+
+// redisQuotientStore keeps the table in a Redis string. A missing key is an
+// empty table of 2^q slots with r-bit remainders.
+type redisQuotientStore struct {
+	redisClient redis.UniversalClient
+	key         string
+	q, r        uint
+}
+
+func (s *redisQuotientStore) view(ctx context.Context, write bool, fn func(t qfTable) error) error {
+	return watchKey(ctx, s.redisClient, s.key, func(tx *redis.Tx) error {
+		t := &redisQuotientTable{ctx: ctx, tx: tx, key: s.key, chunks: make(map[int64][]byte), dirty: make(map[int64]bool)}
+		t.init(s.q, s.r)
+		if t.err != nil {
+			return t.err
+		}
+		if err := fn(t); err != nil {
+			return err
+		}
+		if t.err != nil {
+			return t.err
+		}
+		// the chunks read must not have changed, even to only read them
+		_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if !write || len(t.dirty) == 0 {
+				pipe.Ping(ctx)
+				return nil
+			}
+			for c := range t.dirty {
+				pipe.SetRange(ctx, s.key, c*qfChunkSize, string(t.chunks[c]))
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// get returns the table stored in Redis, or an empty one.
+func (s *redisQuotientStore) get(ctx context.Context, cmd redis.Cmdable) ([]byte, error) {
+	data, err := cmd.Get(ctx, s.key).Bytes()
+	if err == redis.Nil || err == nil && len(data) < qfHeaderSize {
+		return newQuotientTable(s.q, s.r), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if size := qfTableSize(newPackedTable(data).params()); int64(len(data)) < size {
+		data = append(data, make([]byte, size-int64(len(data)))...)
+	}
+	return data, nil
+}
+
+func (s *redisQuotientStore) bytes(ctx context.Context) ([]byte, error) {
+	return s.get(ctx, s.redisClient)
+}
+
+func (s *redisQuotientStore) replace(ctx context.Context, fn func(data []byte) ([]byte, error)) error {
+	return watchKey(ctx, s.redisClient, s.key, func(tx *redis.Tx) error {
+		data, err := s.get(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if data, err = fn(data); err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, s.key, data, redis.KeepTTL)
+			return nil
+		})
+		return err
+	})
+}
+
+// redisQuotientTable is a table stored in Redis, read by chunks as the slots
+// are accessed. The first error is kept in err; the slots read after it are
+// empty.
+type redisQuotientTable struct {
+	ctx    context.Context
+	tx     *redis.Tx
+	key    string
+	size   int64
+	q, r   uint
+	chunks map[int64][]byte
+	dirty  map[int64]bool
+	err    error
+}
+
+// init reads the header, in the first chunk. A missing key is an empty table
+// of 2^q slots with r-bit remainders, whose header is written with the first
+// change.
+func (t *redisQuotientTable) init(q, r uint) {
+	head, err := t.tx.GetRange(t.ctx, t.key, 0, qfChunkSize-1).Bytes()
+	if err != nil {
+		t.err = err
+		return
+	}
+	if len(head) < qfHeaderSize {
+		head = newQuotientTable(q, r)
+		t.dirty[0] = true
+	}
+	t.q, t.r = newPackedTable(head).params()
+	t.size = qfTableSize(t.q, t.r)
+	chunk := make([]byte, minInt64(qfChunkSize, t.size))
+	copy(chunk, head)
+	t.chunks[0] = chunk
+}
+
+func minInt64(x, y int64) int64 {
+	if x < y {
+		return x
+	}
+	return y
+}
+
+// chunk returns chunk c, reading it if needed.
+func (t *redisQuotientTable) chunk(c int64) []byte {
+	if data, ok := t.chunks[c]; ok {
+		return data
+	}
+	start := c * qfChunkSize
+	data := make([]byte, minInt64(qfChunkSize, t.size-start))
+	if t.err == nil {
+		s, err := t.tx.GetRange(t.ctx, t.key, start, start+int64(len(data))-1).Bytes()
+		if err != nil {
+			t.err = err
+		}
+		copy(data, s)
+	}
+	t.chunks[c] = data
+	return data
+}
+
+// load copies the bytes of the table from offset start into buf.
+func (t *redisQuotientTable) load(start int64, buf []byte) {
+	for i := range buf {
+		j := start + int64(i)
+		buf[i] = t.chunk(j / qfChunkSize)[j%qfChunkSize]
+	}
+}
+
+// store copies buf into the bytes of the table from offset start.
+func (t *redisQuotientTable) store(start int64, buf []byte) {
+	for i, b := range buf {
+		j := start + int64(i)
+		t.chunk(j / qfChunkSize)[j%qfChunkSize] = b
+		t.dirty[j/qfChunkSize] = true
+	}
+}
+
+func (t *redisQuotientTable) params() (uint, uint) {
+	return t.q, t.r
+}
+
+func (t *redisQuotientTable) count() uint64 {
+	return binary.BigEndian.Uint64(t.chunks[0][16:])
+}
+
+func (t *redisQuotientTable) setCount(n uint64) {
+	binary.BigEndian.PutUint64(t.chunks[0][16:], n)
+	t.dirty[0] = true
+}
+
+// slotBytes returns the offset of the first byte of slot i and the number of
+// bytes it spans.
+func (t *redisQuotientTable) slotBytes(i uint64) (int64, int) {
+	bit := slotBit(i, t.r)
+	last := bit + uint64(t.r+3) - 1
+	return int64(bit >> 3), int(last>>3-bit>>3) + 1
+}
+
+func (t *redisQuotientTable) slot(i uint64) uint64 {
+	var buf [9]byte
+	start, n := t.slotBytes(i)
+	t.load(start, buf[:n])
+	return readSlot(buf[:n], slotBit(i, t.r)&7, t.r+3)
+}
+
+func (t *redisQuotientTable) setSlot(i uint64, v uint64) {
+	var buf [9]byte
+	start, n := t.slotBytes(i)
+	t.load(start, buf[:n])
+	writeSlot(buf[:n], slotBit(i, t.r)&7, t.r+3, v)
+	t.store(start, buf[:n])
+}
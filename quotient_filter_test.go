@@ -0,0 +1,252 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestQuotientSlots(t *testing.T) {
+	// small remainders and a nearly full table, for long clusters wrapping
+	// around and many duplicates
+	rng := rand.New(rand.NewSource(1))
+	s := newQFSlots(newPackedTable(newQuotientTable(6, 3)))
+	model := make(map[uint64]int)
+	var count uint64
+	for n := 0; n < 5000; n++ {
+		fp := uint64(rng.Intn(1 << 9))
+		if rng.Intn(2) == 0 && count < 60 {
+			if err := s.insert(fp); err != nil {
+				t.Fatal(err)
+			}
+			model[fp]++
+			count++
+		} else {
+			removed := s.remove(fp)
+			if removed != (model[fp] > 0) {
+				t.Fatalf("step %d: remove of %d returned %v", n, fp, removed)
+			}
+			if removed {
+				model[fp]--
+				count--
+			}
+		}
+		for probe := uint64(0); probe < 1<<9; probe++ {
+			if s.contains(probe) != (model[probe] > 0) {
+				t.Fatalf("step %d: unexpected membership of %d", n, probe)
+			}
+		}
+	}
+
+	expected := []uint64{}
+	for fp, c := range model {
+		for i := 0; i < c; i++ {
+			expected = append(expected, fp)
+		}
+	}
+	sort.Slice(expected, func(i, j int) bool { return expected[i] < expected[j] })
+	if fps := s.fingerprints(); !reflect.DeepEqual(fps, expected) {
+		t.Errorf("unexpected fingerprints %v, expected %v", fps, expected)
+	}
+	if s.count() != count {
+		t.Errorf("unexpected count %d != %d", s.count(), count)
+	}
+}
+
+func TestSlotPacking(t *testing.T) {
+	data := make([]byte, 16)
+	for width := uint(1); width <= 64; width++ {
+		for _, bit := range []uint64{0, 3, 7, 8, 13} {
+			v := uint64(0xa5a5a5a5a5a5a5a5) >> (64 - width)
+			writeSlot(data, bit, width, v)
+			if got := readSlot(data, bit, width); got != v {
+				t.Fatalf("width %d bit %d: read %x, wrote %x", width, bit, got, v)
+			}
+			writeSlot(data, bit, width, 0)
+			if !bytes.Equal(data, make([]byte, 16)) {
+				t.Fatalf("width %d bit %d: bits left after clearing", width, bit)
+			}
+		}
+	}
+}
+
+func testQuotientFilter(t *testing.T, f *QuotientFilter) {
+	ctx := context.Background()
+	for i := 0; i < 500; i++ {
+		if err := f.InsertString(ctx, "key"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a key inserted twice stays after one removal
+	f.Insert(ctx, []byte("key0"))
+	if removed, err := f.RemoveString(ctx, "key0"); err != nil || !removed {
+		t.Fatalf("key0 should be removed, got %v %v", removed, err)
+	}
+	for i := 0; i < 500; i++ {
+		if ok, err := f.ContainsString(ctx, "key"+strconv.Itoa(i)); err != nil || !ok {
+			t.Fatalf("key%d should be in, got %v %v", i, ok, err)
+		}
+	}
+	for i := 0; i < 250; i++ {
+		if removed, _ := f.RemoveString(ctx, "key"+strconv.Itoa(i)); !removed {
+			t.Fatalf("key%d should be removed", i)
+		}
+	}
+	fp := 0
+	for i := 0; i < 250; i++ {
+		if ok, _ := f.Contains(ctx, []byte("key"+strconv.Itoa(i))); ok {
+			fp++
+		}
+		if ok, _ := f.ContainsString(ctx, "key"+strconv.Itoa(250+i)); !ok {
+			t.Fatalf("key%d should still be in", 250+i)
+		}
+	}
+	if fp > 5 {
+		t.Errorf("too many false positives after removal: %d", fp)
+	}
+	if count, _ := f.Count(ctx); count != 250 {
+		t.Errorf("unexpected count %d", count)
+	}
+
+	// resizing keeps the keys without rehashing them
+	q, r, _ := f.Params(ctx)
+	if err := f.Resize(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if q2, r2, _ := f.Params(ctx); q2 != q+1 || r2 != r-1 {
+		t.Errorf("unexpected parameters after Resize %d, %d", q2, r2)
+	}
+	for i := 250; i < 500; i++ {
+		if ok, _ := f.ContainsString(ctx, "key"+strconv.Itoa(i)); !ok {
+			t.Fatalf("key%d should be in after Resize", i)
+		}
+	}
+	if count, _ := f.Count(ctx); count != 250 {
+		t.Errorf("unexpected count after Resize %d", count)
+	}
+}
+
+func TestQuotientFilter(t *testing.T) {
+	testQuotientFilter(t, NewQuotientFilterWithEstimates(500, 0.001))
+}
+
+func TestRedisQuotientFilter(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(context.Background(), key)
+	q, r := EstimateQuotientParameters(500, 0.001)
+	testQuotientFilter(t, NewRedisQuotientFilter(redisClient, key, q, r))
+
+	// another process sees the filter, resized, whatever its parameters
+	g := NewRedisQuotientFilter(redisClient, key, 1, 1)
+	if ok, err := g.ContainsString(context.Background(), "key499"); err != nil || !ok {
+		t.Errorf("key499 should be in, got %v %v", ok, err)
+	}
+
+	// concurrent writers do not lose fingerprints
+	other := uuid.New().String()
+	defer redisClient.Del(context.Background(), other)
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			f := NewRedisQuotientFilter(redisClient, other, 8, 8)
+			for i := 0; i < 25; i++ {
+				if err := f.InsertString(context.Background(), strconv.Itoa(w*25+i)); err != nil {
+					t.Error(err)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if count, _ := NewRedisQuotientFilter(redisClient, other, 8, 8).Count(context.Background()); count != 100 {
+		t.Errorf("unexpected count after concurrent inserts %d", count)
+	}
+}
+
+func TestQuotientFilterMerge(t *testing.T) {
+	ctx := context.Background()
+	f := NewQuotientFilter(6, 10)
+	g := NewQuotientFilter(8, 8)
+	for i := 0; i < 40; i++ {
+		f.InsertString(ctx, "f"+strconv.Itoa(i))
+		g.InsertString(ctx, "g"+strconv.Itoa(i))
+	}
+	if err := f.Merge(ctx, g); err != nil {
+		t.Fatal(err)
+	}
+	if q, r, _ := f.Params(ctx); q != 7 || r != 9 {
+		t.Errorf("the filter should grow to hold 80 keys, got q=%d r=%d", q, r)
+	}
+	for i := 0; i < 40; i++ {
+		for _, key := range []string{"f" + strconv.Itoa(i), "g" + strconv.Itoa(i)} {
+			if ok, _ := f.ContainsString(ctx, key); !ok {
+				t.Fatalf("%s should be in", key)
+			}
+		}
+	}
+	if err := f.Merge(ctx, NewQuotientFilter(8, 9)); err == nil {
+		t.Error("merging fingerprints of another size should fail")
+	}
+
+	full := NewQuotientFilter(1, 8)
+	full.InsertString(ctx, "a")
+	full.InsertString(ctx, "b")
+	if err := full.InsertString(ctx, "c"); err != ErrQuotientFilterFull {
+		t.Errorf("expected ErrQuotientFilterFull, got %v", err)
+	}
+}
+
+func TestQuotientFilterReadWrite(t *testing.T) {
+	ctx := context.Background()
+	f := NewQuotientFilter(10, 7)
+	for i := 0; i < 500; i++ {
+		f.InsertString(ctx, strconv.Itoa(i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(ctx, key)
+	g := NewRedisQuotientFilter(redisClient, key, 4, 4)
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if count, _ := g.Count(ctx); count != 500 {
+		t.Errorf("unexpected count %d", count)
+	}
+	for i := 0; i < 500; i++ {
+		if ok, _ := g.ContainsString(ctx, strconv.Itoa(i)); !ok {
+			t.Fatalf("%d should be in", i)
+		}
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, qfHeaderSize))); err != ErrInvalidQuotientFilter {
+		t.Errorf("expected ErrInvalidQuotientFilter, got %v", err)
+	}
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(48, 16, 0))); err != ErrInvalidQuotientFilter {
+		t.Errorf("expected ErrInvalidQuotientFilter, got %v", err)
+	}
+	// the slots are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(32, 29, 0))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
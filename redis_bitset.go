@@ -9,18 +9,31 @@ import (
 	"github.com/go-redis/redis/v9"
 )
 
+// NewRedisBitSet creates a BitSet stored in the Redis string bitsetKey,
+// which expires expiration after it is created, see FixedExpiration.
 func NewRedisBitSet(redisClient redis.UniversalClient, bitsetKey string, expiration time.Duration) BitSet {
+	r := NewRedisBitSetWithPolicy(redisClient, bitsetKey, FixedExpiration(expiration)).(*RedisBitSet)
+	// without an expiration, ReadFrom takes the one of the dump
+	r.defaultPolicy = expiration <= 0
+	return r
+}
+
+// NewRedisBitSetWithPolicy creates a BitSet stored in the Redis string
+// bitsetKey, expiring as decided by policy.
+func NewRedisBitSetWithPolicy(redisClient redis.UniversalClient, bitsetKey string, policy ExpirationPolicy) BitSet {
 	return &RedisBitSet{
 		redisClient: redisClient,
-		bitsetKey: bitsetKey,
-		expiration: expiration,
+		bitsetKey:   bitsetKey,
+		policy:      policy,
 	}
 }
 
 type RedisBitSet struct {
 	redisClient redis.UniversalClient
 	bitsetKey   string
-	expiration  time.Duration
+	policy      ExpirationPolicy
+	// defaultPolicy tells that the policy was not chosen by the caller
+	defaultPolicy bool
 }
 
 func (r *RedisBitSet)Init(length uint) BitSet  {
@@ -29,17 +42,26 @@ func (r *RedisBitSet)Init(length uint) BitSet  {
 }
 
 func (r *RedisBitSet) UnSet(i uint) BitSet {
-	r.redisClient.SetBit(context.Background(), r.bitsetKey, int64(i), 0)
+	ctx := context.Background()
+	_ = r.write(ctx, false, func(pipe redis.Pipeliner) {
+		pipe.SetBit(ctx, r.bitsetKey, int64(i), 0)
+	})
 	return r
 }
 
 func (r *RedisBitSet) Set(i uint) BitSet {
-	r.redisClient.SetBit(context.Background(), r.bitsetKey, int64(i), 1)
+	ctx := context.Background()
+	_ = r.write(ctx, false, func(pipe redis.Pipeliner) {
+		pipe.SetBit(ctx, r.bitsetKey, int64(i), 1)
+	})
 	return r
 }
 
 func (r *RedisBitSet) InPlaceUnion(compare BitSet) {
-	r.redisClient.BitOpOr(context.Background(), r.bitsetKey, compare.GetBitSetKey())
+	ctx := context.Background()
+	_ = r.write(ctx, true, func(pipe redis.Pipeliner) {
+		pipe.BitOpOr(ctx, r.bitsetKey, r.bitsetKey, compare.GetBitSetKey())
+	})
 }
 
 func (r *RedisBitSet) Test(i uint) bool {
@@ -47,7 +69,10 @@ func (r *RedisBitSet) Test(i uint) bool {
 }
 
 func (r *RedisBitSet) ClearAll() BitSet {
-	r.redisClient.Set(context.Background(), r.bitsetKey, "", r.expiration)
+	ctx := context.Background()
+	_ = r.write(ctx, true, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, r.bitsetKey, "", 0)
+	})
 	return r
 }
 
@@ -61,7 +86,7 @@ func (r *RedisBitSet) WriteTo(stream io.Writer) (int64, error) {
 		return 0, err
 	}
 	n, err := stream.Write([]byte(r.bitsetKey))
-	err = binary.Write(stream, binary.BigEndian, uint64(r.expiration))
+	err = binary.Write(stream, binary.BigEndian, uint64(r.policy.ttl))
 	if err != nil {
 		return 0, err
 	}
@@ -100,7 +125,11 @@ func (r *RedisBitSet) ReadFrom(stream io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	r.expiration = time.Duration(expiration)
+	// a bitset created without a policy takes the expiration of the dump
+	if r.defaultPolicy {
+		r.policy = FixedExpiration(time.Duration(expiration))
+		r.defaultPolicy = false
+	}
 
 	err = binary.Read(stream, binary.BigEndian, &bitsetValLen)
 	if err != nil {
@@ -112,7 +141,10 @@ func (r *RedisBitSet) ReadFrom(stream io.Reader) (int64, error) {
 		return 0, err
 	}
 
-	r.redisClient.Set(context.Background(), r.bitsetKey, data, r.expiration)
+	ctx := context.Background()
+	_ = r.write(ctx, true, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, r.bitsetKey, data, 0)
+	})
 
 	return int64(n + m + 3*binary.Size(uint64(0))), nil
 }
@@ -125,6 +157,68 @@ func (r *RedisBitSet) From(buf []uint64) BitSet {
 		byteAr = append(byteAr, b...)
 	}
 
-	r.redisClient.Set(context.Background(), r.bitsetKey, string(byteAr), r.expiration)
+	ctx := context.Background()
+	_ = r.write(ctx, true, func(pipe redis.Pipeliner) {
+		pipe.Set(ctx, r.bitsetKey, string(byteAr), 0)
+	})
 	return r
 }
+
+// SetBits sets all the bits in idx in a single pipelined round trip.
+func (r *RedisBitSet) SetBits(ctx context.Context, idx []uint) error {
+	return r.write(ctx, false, func(pipe redis.Pipeliner) {
+		for _, i := range idx {
+			pipe.SetBit(ctx, r.bitsetKey, int64(i), 1)
+		}
+	})
+}
+
+// TestBits returns true if all the bits in idx are set, using a single
+// pipelined round trip.
+func (r *RedisBitSet) TestBits(ctx context.Context, idx []uint) (bool, error) {
+	cmds := make([]*redis.IntCmd, len(idx))
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for j, i := range idx {
+			cmds[j] = pipe.GetBit(ctx, r.bitsetKey, int64(i))
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Val() != 1 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// ExpirationPolicy returns the expiration policy of the bitset.
+func (r *RedisBitSet) ExpirationPolicy() ExpirationPolicy {
+	return r.policy
+}
+
+// TTL returns the remaining time to live of the key, 0 if it does not
+// expire, or redis.Nil if it does not exist.
+func (r *RedisBitSet) TTL(ctx context.Context) (time.Duration, error) {
+	ttl, err := r.redisClient.PTTL(ctx, r.bitsetKey).Result()
+	if err != nil {
+		return 0, err
+	}
+	switch ttl {
+	case -2:
+		return 0, redis.Nil
+	case -1:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Persist removes the expiration of the key and switches the bitset to
+// NoExpiration, so that later writes do not set it again.
+func (r *RedisBitSet) Persist(ctx context.Context) error {
+	r.policy = NoExpiration()
+	r.defaultPolicy = false
+	return r.redisClient.Persist(ctx, r.bitsetKey).Err()
+}
@@ -0,0 +1,422 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// HasRedisBloom reports whether the RedisBloom module, which provides the
+// BF.* commands, is loaded on the server, using MODULE LIST.
+func HasRedisBloom(ctx context.Context, redisClient redis.UniversalClient) (bool, error) {
+	modules, err := redisClient.Do(ctx, "MODULE", "LIST").Slice()
+	if err != nil {
+		return false, err
+	}
+	for _, module := range modules {
+		name, _ := replyField(module, "name").(string)
+		if strings.EqualFold(name, "bf") || strings.EqualFold(name, "bloom") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// NewRedisBloomFilter creates a Bloom filter stored by the RedisBloom module
+// under key, reserved with BF.RESERVE for about capacity items with errorRate
+// false positive rate. If key already holds a RedisBloom filter it is used
+// as is, and its capacity is read back with BF.INFO.
+func NewRedisBloomFilter(ctx context.Context, redisClient redis.UniversalClient, key string, capacity uint, errorRate float64) (*RedisBloomFilter, error) {
+	f := &RedisBloomFilter{
+		redisClient: redisClient,
+		key:         key,
+		capacity:    max(1, capacity),
+		errorRate:   errorRate,
+	}
+	err := f.reserve(ctx)
+	if err != nil && strings.Contains(err.Error(), "exists") {
+		info, infoErr := f.Info(ctx)
+		if infoErr != nil {
+			return nil, infoErr
+		}
+		f.capacity = info.Capacity
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// RedisBloomFilter is a BloomFilter delegating to the BF.* commands of the
+// RedisBloom module. The module owns the bits, so BitSet returns nil and
+// TestLocations is not supported; Cap and K are those a filter of this
+// package would use for the same capacity and error rate. The filter may
+// scale beyond its capacity, as RedisBloom stacks sub-filters when it fills
+// up.
+type RedisBloomFilter struct {
+	redisClient redis.UniversalClient
+	key         string
+	capacity    uint
+	errorRate   float64
+}
+
+// Limits of a filter read by ReadFrom: the chunks, like the key, are Redis
+// strings, of at most maxShardBits bits.
+const (
+	redisBloomMaxKey    = 1 << 16
+	redisBloomMaxChunks = 1 << 16
+)
+
+// ErrInvalidRedisBloomFilter is returned when reading a RedisBloomFilter from
+// a stream that does not hold one.
+var ErrInvalidRedisBloomFilter = errors.New("bloom: invalid RedisBloom filter")
+
+// RedisBloomInfo is the reply of BF.INFO.
+type RedisBloomInfo struct {
+	Capacity      uint
+	Size          uint
+	Filters       uint
+	Items         uint
+	ExpansionRate uint
+}
+
+func (f *RedisBloomFilter) reserve(ctx context.Context) error {
+	return f.redisClient.Do(ctx, "BF.RESERVE", f.key, f.errorRate, f.capacity).Err()
+}
+
+// Key returns the Redis key of the filter.
+func (f *RedisBloomFilter) Key() string {
+	return f.key
+}
+
+// Capacity returns the number of items the filter was reserved for.
+func (f *RedisBloomFilter) Capacity() uint {
+	return f.capacity
+}
+
+// ErrorRate returns the false positive rate the filter was reserved for.
+func (f *RedisBloomFilter) ErrorRate() float64 {
+	return f.errorRate
+}
+
+// Info returns the BF.INFO of the filter.
+func (f *RedisBloomFilter) Info(ctx context.Context) (RedisBloomInfo, error) {
+	reply, err := f.redisClient.Do(ctx, "BF.INFO", f.key).Result()
+	if err != nil {
+		return RedisBloomInfo{}, err
+	}
+	field := func(name string) uint {
+		v, _ := replyField(reply, name).(int64)
+		return uint(v)
+	}
+	return RedisBloomInfo{
+		Capacity:      field("Capacity"),
+		Size:          field("Size"),
+		Filters:       field("Number of filters"),
+		Items:         field("Number of items inserted"),
+		ExpansionRate: field("Expansion rate"),
+	}, nil
+}
+
+// AddMany adds all the items with a single BF.MADD. The result tells, for
+// every item, whether it was newly added, that is whether it was not in the
+// filter before.
+func (f *RedisBloomFilter) AddMany(ctx context.Context, data [][]byte) ([]bool, error) {
+	args := make([]interface{}, 0, 2+len(data))
+	args = append(args, "BF.MADD", f.key)
+	for _, d := range data {
+		args = append(args, d)
+	}
+	return f.redisClient.Do(ctx, args...).BoolSlice()
+}
+
+// TestMany tests all the items with a single BF.MEXISTS.
+func (f *RedisBloomFilter) TestMany(ctx context.Context, data [][]byte) ([]bool, error) {
+	args := make([]interface{}, 0, 2+len(data))
+	args = append(args, "BF.MEXISTS", f.key)
+	for _, d := range data {
+		args = append(args, d)
+	}
+	return f.redisClient.Do(ctx, args...).BoolSlice()
+}
+
+func (f *RedisBloomFilter) Cap() uint {
+	m, _ := EstimateParameters(f.capacity, f.errorRate)
+	return m
+}
+
+func (f *RedisBloomFilter) K() uint {
+	_, k := EstimateParameters(f.capacity, f.errorRate)
+	return k
+}
+
+// BitSet returns nil, the bits are owned by the RedisBloom module and cannot
+// be read or written as a BitSet. Comparing the filter with a filter of this
+// package with Equal returns false.
+func (f *RedisBloomFilter) BitSet() BitSet {
+	return nil
+}
+
+func (f *RedisBloomFilter) Add(data []byte) BloomFilter {
+	f.redisClient.Do(context.Background(), "BF.ADD", f.key, data)
+	return f
+}
+
+func (f *RedisBloomFilter) AddString(data string) BloomFilter {
+	return f.Add([]byte(data))
+}
+
+func (f *RedisBloomFilter) Test(data []byte) bool {
+	exists, _ := f.redisClient.Do(context.Background(), "BF.EXISTS", f.key, data).Bool()
+	return exists
+}
+
+func (f *RedisBloomFilter) TestString(data string) bool {
+	return f.Test([]byte(data))
+}
+
+// TestLocations cannot be answered by RedisBloom, which hashes the items
+// itself: it always returns true, the item may be in the set, so that
+// callers never get a false negative. Use Test instead.
+func (f *RedisBloomFilter) TestLocations(locs []uint64) bool {
+	return true
+}
+
+// TestAndAdd uses the reply of a single BF.ADD, which is 0 when the item was
+// already in the filter.
+func (f *RedisBloomFilter) TestAndAdd(data []byte) bool {
+	added, err := f.redisClient.Do(context.Background(), "BF.ADD", f.key, data).Bool()
+	return err == nil && !added
+}
+
+func (f *RedisBloomFilter) TestAndAddString(data string) bool {
+	return f.TestAndAdd([]byte(data))
+}
+
+// TestOrAdd is the same as TestAndAdd: BF.ADD leaves a present item alone.
+func (f *RedisBloomFilter) TestOrAdd(data []byte) bool {
+	return f.TestAndAdd(data)
+}
+
+func (f *RedisBloomFilter) TestOrAddString(data string) bool {
+	return f.TestAndAdd([]byte(data))
+}
+
+// ClearAll deletes the filter and reserves it again.
+func (f *RedisBloomFilter) ClearAll() BloomFilter {
+	ctx := context.Background()
+	f.redisClient.Del(ctx, f.key)
+	_ = f.reserve(ctx)
+	return f
+}
+
+// ApproximatedSize returns the number of items inserted, from BF.INFO.
+func (f *RedisBloomFilter) ApproximatedSize() uint32 {
+	info, _ := f.Info(context.Background())
+	return uint32(info.Items)
+}
+
+// redisBloomChunk is a chunk of a BF.SCANDUMP.
+type redisBloomChunk struct {
+	Iter int64  `json:"iter"`
+	Data []byte `json:"data"`
+}
+
+// dump returns the chunks of BF.SCANDUMP.
+func (f *RedisBloomFilter) dump(ctx context.Context) ([]redisBloomChunk, error) {
+	var chunks []redisBloomChunk
+	iter := int64(0)
+	for {
+		reply, err := f.redisClient.Do(ctx, "BF.SCANDUMP", f.key, iter).Slice()
+		if err != nil {
+			return nil, err
+		}
+		if len(reply) != 2 {
+			return nil, fmt.Errorf("bloom: unexpected BF.SCANDUMP reply %v", reply)
+		}
+		iter, _ = reply[0].(int64)
+		if iter == 0 {
+			return chunks, nil
+		}
+		data, _ := reply[1].(string)
+		chunks = append(chunks, redisBloomChunk{iter, []byte(data)})
+	}
+}
+
+// load replaces the filter with the chunks of a BF.SCANDUMP.
+func (f *RedisBloomFilter) load(ctx context.Context, chunks []redisBloomChunk) error {
+	if err := f.redisClient.Del(ctx, f.key).Err(); err != nil {
+		return err
+	}
+	for _, c := range chunks {
+		if err := f.redisClient.Do(ctx, "BF.LOADCHUNK", f.key, c.Iter, c.Data).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redisBloomJSON is an unexported type for marshaling/unmarshaling
+// RedisBloomFilter struct.
+type redisBloomJSON struct {
+	Key       string            `json:"key"`
+	Capacity  uint              `json:"capacity"`
+	ErrorRate float64           `json:"error_rate"`
+	Chunks    []redisBloomChunk `json:"chunks"`
+}
+
+func (f *RedisBloomFilter) MarshalJSON() ([]byte, error) {
+	chunks, err := f.dump(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(redisBloomJSON{f.key, f.capacity, f.errorRate, chunks})
+}
+
+// UnmarshalJSON loads the filter under the key recorded in data.
+func (f *RedisBloomFilter) UnmarshalJSON(data []byte) error {
+	var j redisBloomJSON
+	err := json.Unmarshal(data, &j)
+	if err != nil {
+		return err
+	}
+	f.key = j.Key
+	f.capacity = j.Capacity
+	f.errorRate = j.ErrorRate
+	return f.load(context.Background(), j.Chunks)
+}
+
+// WriteTo writes the key, capacity and error rate of the filter followed by
+// its BF.SCANDUMP chunks.
+func (f *RedisBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	chunks, err := f.dump(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var buf bytes.Buffer
+	_ = binary.Write(&buf, binary.BigEndian, uint64(len(f.key)))
+	buf.WriteString(f.key)
+	_ = binary.Write(&buf, binary.BigEndian, []uint64{uint64(f.capacity), math.Float64bits(f.errorRate), uint64(len(chunks))})
+	for _, c := range chunks {
+		_ = binary.Write(&buf, binary.BigEndian, []uint64{uint64(c.Iter), uint64(len(c.Data))})
+		buf.Write(c.Data)
+	}
+	return buf.WriteTo(stream)
+}
+
+// ReadFrom reads a filter written by WriteTo and loads it, with
+// BF.LOADCHUNK, under the key it was written from.
+func (f *RedisBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	var keyLen uint64
+	err := binary.Read(stream, binary.BigEndian, &keyLen)
+	if err != nil {
+		return 0, err
+	}
+	if keyLen > redisBloomMaxKey {
+		return 0, ErrInvalidRedisBloomFilter
+	}
+	key := make([]byte, keyLen)
+	if _, err = io.ReadFull(stream, key); err != nil {
+		return 0, err
+	}
+	var header [3]uint64
+	if err = binary.Read(stream, binary.BigEndian, &header); err != nil {
+		return 0, err
+	}
+	if header[2] > redisBloomMaxChunks {
+		return 0, ErrInvalidRedisBloomFilter
+	}
+	read := int64(len(key) + 4*binary.Size(uint64(0)))
+	var chunks []redisBloomChunk
+	for i := uint64(0); i < header[2]; i++ {
+		var chunkHeader [2]uint64
+		if err = binary.Read(stream, binary.BigEndian, &chunkHeader); err != nil {
+			return 0, err
+		}
+		if chunkHeader[1] > maxShardBits/8 {
+			return 0, ErrInvalidRedisBloomFilter
+		}
+		c := redisBloomChunk{Iter: int64(chunkHeader[0])}
+		m, err := readRecords(stream, chunkHeader[1], 1, func(data []byte) {
+			c.Data = append(c.Data, data...)
+		})
+		if err != nil {
+			return 0, err
+		}
+		chunks = append(chunks, c)
+		read += m + int64(2*binary.Size(uint64(0)))
+	}
+	f.key = string(key)
+	f.capacity = uint(header[0])
+	f.errorRate = math.Float64frombits(header[1])
+	if err = f.load(context.Background(), chunks); err != nil {
+		return 0, err
+	}
+	return read, nil
+}
+
+func (f *RedisBloomFilter) GobEncode() ([]byte, error) {
+	var buf bytes.Buffer
+	_, err := f.WriteTo(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *RedisBloomFilter) GobDecode(data []byte) error {
+	_, err := f.ReadFrom(bytes.NewBuffer(data))
+	return err
+}
+
+// Equal is true if g is a RedisBloomFilter with the same parameters and the
+// same content.
+func (f *RedisBloomFilter) Equal(g BloomFilter) bool {
+	other, ok := g.(*RedisBloomFilter)
+	if !ok || other.capacity != f.capacity || other.errorRate != f.errorRate {
+		return false
+	}
+	chunks, err := f.dump(context.Background())
+	if err != nil {
+		return false
+	}
+	otherChunks, err := other.dump(context.Background())
+	if err != nil || len(chunks) != len(otherChunks) {
+		return false
+	}
+	for i := range chunks {
+		if chunks[i].Iter != otherChunks[i].Iter || !bytes.Equal(chunks[i].Data, otherChunks[i].Data) {
+			return false
+		}
+	}
+	return true
+}
+
+// replyField returns the value of a field of a reply that is either a RESP3
+// map or a RESP2 flat array of name, value pairs.
+func replyField(reply interface{}, name string) interface{} {
+	switch r := reply.(type) {
+	case map[interface{}]interface{}:
+		for k, v := range r {
+			if s, ok := k.(string); ok && strings.EqualFold(s, name) {
+				return v
+			}
+		}
+	case []interface{}:
+		for i := 0; i+1 < len(r); i += 2 {
+			if s, ok := r[i].(string); ok && strings.EqualFold(s, name) {
+				return r[i+1]
+			}
+		}
+	}
+	return nil
+}
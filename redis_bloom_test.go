@@ -0,0 +1,305 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HoangViet144/bloom/internal/resp"
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+// redisBloomStandIn is a local RESP stand-in for a Redis server with the
+// RedisBloom module loaded. Its BF.* commands are backed by in-memory filters
+// of this package.
+type redisBloomStandIn struct {
+	mu      sync.Mutex
+	filters map[string]*standInFilter
+	server  *resp.Server
+	addr    string
+}
+
+type standInFilter struct {
+	filter    BloomFilter
+	capacity  uint
+	errorRate float64
+	items     uint
+}
+
+func newRedisBloomStandIn(t *testing.T) *redisBloomStandIn {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &redisBloomStandIn{
+		filters: make(map[string]*standInFilter),
+		server:  resp.NewServer(),
+		addr:    l.Addr().String(),
+	}
+	s.server.Handle("MODULE", func(w *resp.Writer, args [][]byte) {
+		w.Array(1)
+		w.Array(4)
+		w.BulkString("name")
+		w.BulkString("bf")
+		w.BulkString("ver")
+		w.Int(20612)
+	})
+	s.server.Handle("DEL", s.locked(func(w *resp.Writer, args [][]byte) {
+		deleted := int64(0)
+		for _, key := range args[1:] {
+			if _, ok := s.filters[string(key)]; ok {
+				delete(s.filters, string(key))
+				deleted++
+			}
+		}
+		w.Int(deleted)
+	}))
+	s.server.Handle("BF.RESERVE", s.locked(func(w *resp.Writer, args [][]byte) {
+		if _, ok := s.filters[string(args[1])]; ok {
+			w.Error("ERR item exists")
+			return
+		}
+		errorRate, _ := strconv.ParseFloat(string(args[2]), 64)
+		capacity, _ := strconv.ParseUint(string(args[3]), 10, 64)
+		s.filters[string(args[1])] = newStandInFilter(uint(capacity), errorRate)
+		w.SimpleString("OK")
+	}))
+	s.server.Handle("BF.ADD", s.locked(func(w *resp.Writer, args [][]byte) {
+		w.Bool(s.add(string(args[1]), args[2]))
+	}))
+	s.server.Handle("BF.MADD", s.locked(func(w *resp.Writer, args [][]byte) {
+		w.Array(len(args) - 2)
+		for _, item := range args[2:] {
+			w.Bool(s.add(string(args[1]), item))
+		}
+	}))
+	s.server.Handle("BF.EXISTS", s.locked(func(w *resp.Writer, args [][]byte) {
+		f, ok := s.filters[string(args[1])]
+		w.Bool(ok && f.filter.Test(args[2]))
+	}))
+	s.server.Handle("BF.MEXISTS", s.locked(func(w *resp.Writer, args [][]byte) {
+		f, ok := s.filters[string(args[1])]
+		w.Array(len(args) - 2)
+		for _, item := range args[2:] {
+			w.Bool(ok && f.filter.Test(item))
+		}
+	}))
+	s.server.Handle("BF.INFO", s.locked(func(w *resp.Writer, args [][]byte) {
+		f, ok := s.filters[string(args[1])]
+		if !ok {
+			w.Error("ERR not found")
+			return
+		}
+		w.Array(10)
+		w.SimpleString("Capacity")
+		w.Int(int64(f.capacity))
+		w.SimpleString("Size")
+		w.Int(int64(f.filter.Cap() / 8))
+		w.SimpleString("Number of filters")
+		w.Int(1)
+		w.SimpleString("Number of items inserted")
+		w.Int(int64(f.items))
+		w.SimpleString("Expansion rate")
+		w.Int(2)
+	}))
+	s.server.Handle("BF.SCANDUMP", s.locked(func(w *resp.Writer, args [][]byte) {
+		f, ok := s.filters[string(args[1])]
+		if !ok {
+			w.Error("ERR not found")
+			return
+		}
+		w.Array(2)
+		if string(args[2]) != "0" {
+			w.Int(0)
+			w.BulkString("")
+			return
+		}
+		var buf bytes.Buffer
+		_ = binary.Write(&buf, binary.BigEndian, []uint64{uint64(f.capacity), math.Float64bits(f.errorRate), uint64(f.items)})
+		_, _ = f.filter.WriteTo(&buf)
+		w.Int(1)
+		w.Bulk(buf.Bytes())
+	}))
+	s.server.Handle("BF.LOADCHUNK", s.locked(func(w *resp.Writer, args [][]byte) {
+		var header [3]uint64
+		buf := bytes.NewReader(args[3])
+		if err := binary.Read(buf, binary.BigEndian, &header); err != nil {
+			w.Error("ERR invalid chunk")
+			return
+		}
+		f := newStandInFilter(uint(header[0]), math.Float64frombits(header[1]))
+		f.items = uint(header[2])
+		if _, err := f.filter.ReadFrom(buf); err != nil {
+			w.Error("ERR invalid chunk")
+			return
+		}
+		s.filters[string(args[1])] = f
+		w.SimpleString("OK")
+	}))
+	go s.server.Serve(l)
+	t.Cleanup(func() { s.server.Close() })
+	return s
+}
+
+func newStandInFilter(capacity uint, errorRate float64) *standInFilter {
+	return &standInFilter{
+		filter:    NewWithEstimates(capacity, errorRate, NewMemoryBitSet()),
+		capacity:  capacity,
+		errorRate: errorRate,
+	}
+}
+
+// locked serializes the handler with the other commands of the stand-in.
+func (s *redisBloomStandIn) locked(h resp.HandlerFunc) resp.HandlerFunc {
+	return func(w *resp.Writer, args [][]byte) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if len(args) < 2 {
+			w.Error(resp.WrongArity(args))
+			return
+		}
+		h(w, args)
+	}
+}
+
+// add adds item to the filter stored under key, creating it with the
+// RedisBloom defaults if needed, and returns whether it was newly added.
+func (s *redisBloomStandIn) add(key string, item []byte) bool {
+	f, ok := s.filters[key]
+	if !ok {
+		f = newStandInFilter(100, 0.01)
+		s.filters[key] = f
+	}
+	if f.filter.TestOrAdd(item) {
+		return false
+	}
+	f.items++
+	return true
+}
+
+func TestRedisBloomFilter(t *testing.T) {
+	standIn := newRedisBloomStandIn(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{standIn.addr}})
+	ctx := context.Background()
+
+	ok, err := HasRedisBloom(ctx, redisClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		t.Fatal("the RedisBloom module should be detected")
+	}
+
+	f, err := NewRedisBloomFilter(ctx, redisClient, uuid.New().String(), 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n1 := []byte("Bess")
+	n2 := []byte("Jane")
+	n3 := []byte("Emma")
+	f.Add(n1)
+	n3a := f.TestAndAdd(n3)
+	if !f.Test(n1) {
+		t.Errorf("%v should be in.", n1)
+	}
+	if f.Test(n2) {
+		t.Errorf("%v should not be in.", n2)
+	}
+	if n3a {
+		t.Errorf("%v should not be in the first time we look.", n3)
+	}
+	if !f.Test(n3) {
+		t.Errorf("%v should be in the second time we look.", n3)
+	}
+
+	added, err := f.AddMany(ctx, [][]byte{n1, n2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added[0] || !added[1] {
+		t.Errorf("unexpected BF.MADD result %v", added)
+	}
+	exists, err := f.TestMany(ctx, [][]byte{n1, []byte("Anna")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !exists[0] || exists[1] {
+		t.Errorf("unexpected BF.MEXISTS result %v", exists)
+	}
+	if f.ApproximatedSize() != 3 {
+		t.Errorf("%d should equal 3.", f.ApproximatedSize())
+	}
+	if !f.TestLocations(Locations(n2, f.K())) {
+		t.Error("TestLocations should never return a false negative")
+	}
+	local := New(f.Cap(), f.K(), NewRedisBitSet(redisClient, uuid.New().String(), time.Minute))
+	if local.Equal(f) || f.Equal(local) {
+		t.Error("a filter of the module should not equal a local filter")
+	}
+
+	g, err := NewRedisBloomFilter(ctx, redisClient, f.Key(), 10, 0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g.Capacity() != 1000 {
+		t.Errorf("an existing filter should keep its capacity, got %d", g.Capacity())
+	}
+}
+
+func TestRedisBloomFilterReadWrite(t *testing.T) {
+	standIn := newRedisBloomStandIn(t)
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{standIn.addr}})
+	ctx := context.Background()
+
+	f, err := NewRedisBloomFilter(ctx, redisClient, uuid.New().String(), 1000, 0.001)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddString("one").AddString("two")
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesWritten != int64(buf.Len()) {
+		t.Errorf("incorrect write length %d != %d", bytesWritten, buf.Len())
+	}
+
+	f.ClearAll()
+	if f.TestString("one") {
+		t.Error("the filter should be empty after ClearAll")
+	}
+
+	g := &RedisBloomFilter{redisClient: redisClient}
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if !g.TestString("one") || !g.TestString("two") {
+		t.Error("the restored filter should contain the keys")
+	}
+	if !g.Equal(f) {
+		t.Error("the restored filter should be equal to the original")
+	}
+
+	for _, header := range [][]uint64{{1 << 40}, {0, 1000, 0, 1 << 40}, {0, 1000, 0, 1, 1, 1 << 40}} {
+		if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(header...))); err != ErrInvalidRedisBloomFilter {
+			t.Errorf("expected ErrInvalidRedisBloomFilter, got %v", err)
+		}
+	}
+	// the chunks are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(0, 1000, 0, 1, 1, 1<<29))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,144 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// ErrDeadlinePassed is returned by the writes of a RedisBitSet whose
+// DeadlineExpiration has passed.
+var ErrDeadlinePassed = errors.New("bloom: expiration deadline has passed")
+
+type expirationKind int
+
+const (
+	expireNever expirationKind = iota
+	expireFixed
+	expireSliding
+	expireAt
+)
+
+// ExpirationPolicy decides when the key of a RedisBitSet expires. It is
+// applied by every write of the bitset, in the same pipeline as the write.
+type ExpirationPolicy struct {
+	kind     expirationKind
+	ttl      time.Duration
+	deadline time.Time
+}
+
+// NoExpiration never sets an expiration on the key. Writes replacing the
+// whole value (ClearAll, From, ReadFrom, InPlaceUnion) remove the
+// expiration the key may have.
+func NoExpiration() ExpirationPolicy {
+	return ExpirationPolicy{}
+}
+
+// FixedExpiration expires the key ttl after it is created, writes do not
+// extend its lifetime. A ttl of 0 or less means no expiration.
+func FixedExpiration(ttl time.Duration) ExpirationPolicy {
+	if ttl <= 0 {
+		return NoExpiration()
+	}
+	return ExpirationPolicy{kind: expireFixed, ttl: ttl}
+}
+
+// SlidingExpiration expires the key ttl after the last write. The refresh is
+// pipelined with the write, once per call: SetBits refreshes once for the
+// whole batch. A ttl of 0 or less means no expiration.
+func SlidingExpiration(ttl time.Duration) ExpirationPolicy {
+	if ttl <= 0 {
+		return NoExpiration()
+	}
+	return ExpirationPolicy{kind: expireSliding, ttl: ttl}
+}
+
+// DeadlineExpiration expires the key at deadline, whenever it was created.
+// Once the deadline has passed, writes fail with ErrDeadlinePassed instead
+// of creating a key that expires at once.
+func DeadlineExpiration(deadline time.Time) ExpirationPolicy {
+	return ExpirationPolicy{kind: expireAt, deadline: deadline}
+}
+
+// TTL returns the time to live of a fixed or sliding policy, 0 for the
+// other policies.
+func (p ExpirationPolicy) TTL() time.Duration {
+	return p.ttl
+}
+
+// Deadline returns the deadline of a deadline policy, the zero time for the
+// other policies.
+func (p ExpirationPolicy) Deadline() time.Time {
+	return p.deadline
+}
+
+// write runs the write commands queued by fn in a single pipeline, with the
+// commands applying the expiration policy. replaces tells that the commands
+// replace the whole value of the key, dropping its expiration.
+//
+// With a fixed expiration, a write that does not replace the value is
+// preceded by a SET NX of the key with its expiration, so that a key created
+// by the write expires, while an existing key keeps its time to live. A
+// replacing write reads the time to live before and after the write, and
+// restores it in a second round trip.
+func (r *RedisBitSet) write(ctx context.Context, replaces bool, fn func(pipe redis.Pipeliner)) error {
+	if r.policy.kind == expireAt && !time.Now().Before(r.policy.deadline) {
+		return ErrDeadlinePassed
+	}
+	var before, after *redis.DurationCmd
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		before, after = r.queueWrite(ctx, pipe, replaces, fn)
+		return nil
+	})
+	if err != nil || after == nil || after.Val() != -1 {
+		return err
+	}
+	// the key has no expiration: it was just created, or its value replaced
+	ttl := r.policy.ttl
+	if before != nil && before.Val() > 0 {
+		ttl = before.Val()
+	}
+	return r.redisClient.PExpire(ctx, r.bitsetKey, ttl).Err()
+}
+
+// queueWrite queues in pipe the commands of fn and those applying the
+// expiration policy, see write. It returns the PTTL commands read before and
+// after a replacing write with a fixed expiration.
+func (r *RedisBitSet) queueWrite(ctx context.Context, pipe redis.Pipeliner, replaces bool, fn func(pipe redis.Pipeliner)) (before, after *redis.DurationCmd) {
+	if r.policy.kind == expireFixed {
+		if replaces {
+			before = pipe.PTTL(ctx, r.bitsetKey)
+		} else {
+			pipe.SetNX(ctx, r.bitsetKey, "", r.policy.ttl)
+		}
+	}
+	fn(pipe)
+	switch r.policy.kind {
+	case expireFixed:
+		if replaces {
+			after = pipe.PTTL(ctx, r.bitsetKey)
+		}
+	case expireSliding:
+		pipe.PExpire(ctx, r.bitsetKey, r.policy.ttl)
+	case expireAt:
+		pipe.PExpireAt(ctx, r.bitsetKey, r.policy.deadline)
+	}
+	return before, after
+}
+
+// queueSetBits queues in pipe the commands setting the bits in idx, with
+// the expiration policy, so that they share a round trip with the writes of
+// other bitsets.
+func (r *RedisBitSet) queueSetBits(ctx context.Context, pipe redis.Pipeliner, idx []uint) error {
+	if r.policy.kind == expireAt && !time.Now().Before(r.policy.deadline) {
+		return ErrDeadlinePassed
+	}
+	r.queueWrite(ctx, pipe, false, func(pipe redis.Pipeliner) {
+		for _, i := range idx {
+			pipe.SetBit(ctx, r.bitsetKey, int64(i), 1)
+		}
+	})
+	return nil
+}
@@ -0,0 +1,158 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func newPolicyBitSet(t *testing.T, policy ExpirationPolicy) (*RedisBitSet, redis.UniversalClient) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	b := NewRedisBitSetWithPolicy(redisClient, uuid.New().String(), policy).(*RedisBitSet)
+	t.Cleanup(func() { redisClient.Del(context.Background(), b.GetBitSetKey()) })
+	return b, redisClient
+}
+
+func TestFixedExpiration(t *testing.T) {
+	ctx := context.Background()
+	b, redisClient := newPolicyBitSet(t, FixedExpiration(time.Hour))
+
+	b.Set(10)
+	ttl, err := b.TTL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Errorf("a key created by SETBIT should expire in an hour, got %v", ttl)
+	}
+
+	redisClient.PExpire(ctx, b.GetBitSetKey(), time.Minute)
+	b.Set(20)
+	if err := b.SetBits(ctx, []uint{30, 40}); err != nil {
+		t.Fatal(err)
+	}
+	b.ClearAll()
+	if ttl, _ := b.TTL(ctx); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("writes should not extend a fixed expiration, got %v", ttl)
+	}
+}
+
+func TestSlidingExpiration(t *testing.T) {
+	ctx := context.Background()
+	b, redisClient := newPolicyBitSet(t, SlidingExpiration(time.Hour))
+
+	b.Set(10)
+	redisClient.PExpire(ctx, b.GetBitSetKey(), time.Minute)
+	if err := b.SetBits(ctx, []uint{20, 30}); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := b.TTL(ctx); ttl <= 59*time.Minute {
+		t.Errorf("a write should refresh a sliding expiration, got %v", ttl)
+	}
+}
+
+func TestDeadlineExpiration(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newPolicyBitSet(t, DeadlineExpiration(time.Now().Add(10*time.Minute)))
+
+	b.From([]uint64{1, 2})
+	if ttl, _ := b.TTL(ctx); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("the key should expire at the deadline, got %v", ttl)
+	}
+}
+
+func TestDeadlinePassed(t *testing.T) {
+	ctx := context.Background()
+	b, redisClient := newPolicyBitSet(t, DeadlineExpiration(time.Now().Add(-time.Minute)))
+	if err := b.SetBits(ctx, []uint{1, 2}); err != ErrDeadlinePassed {
+		t.Errorf("expected ErrDeadlinePassed, got %v", err)
+	}
+	b.Set(3)
+	if redisClient.Exists(ctx, b.GetBitSetKey()).Val() != 0 {
+		t.Error("writes after the deadline should not create the key")
+	}
+}
+
+func TestReadFromExpiration(t *testing.T) {
+	ctx := context.Background()
+	a, _ := newPolicyBitSet(t, FixedExpiration(time.Hour))
+	a.Set(10)
+	var dump bytes.Buffer
+	if _, err := a.WriteTo(&dump); err != nil {
+		t.Fatal(err)
+	}
+
+	// an explicit policy is kept
+	b, _ := newPolicyBitSet(t, NoExpiration())
+	if _, err := b.ReadFrom(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := b.TTL(ctx); ttl != 0 || b.ExpirationPolicy().TTL() != 0 {
+		t.Errorf("a bitset without expiration should keep it, got %v", ttl)
+	}
+
+	// no policy takes the one of the dump
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	c := NewRedisBitSet(redisClient, uuid.New().String(), 0).(*RedisBitSet)
+	if _, err := c.ReadFrom(bytes.NewReader(dump.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, _ := c.TTL(ctx); ttl <= 59*time.Minute || c.ExpirationPolicy().TTL() != time.Hour {
+		t.Errorf("a bitset created without expiration should take the one of the dump, got %v", ttl)
+	}
+}
+
+func TestSlidingExpirationAdd(t *testing.T) {
+	ctx := context.Background()
+	b, redisClient := newPolicyBitSet(t, SlidingExpiration(time.Hour))
+	f := New(1000, 5, b)
+	redisClient.PExpire(ctx, b.GetBitSetKey(), time.Minute)
+	f.AddString("Bess")
+	if ttl, _ := b.TTL(ctx); ttl <= 59*time.Minute {
+		t.Errorf("an add should refresh a sliding expiration, got %v", ttl)
+	}
+}
+
+func TestNoExpirationAndPersist(t *testing.T) {
+	ctx := context.Background()
+	b, _ := newPolicyBitSet(t, NoExpiration())
+	if _, err := b.TTL(ctx); err != redis.Nil {
+		t.Errorf("a missing key should return redis.Nil, got %v", err)
+	}
+	b.Set(10)
+	if ttl, err := b.TTL(ctx); ttl != 0 || err != nil {
+		t.Errorf("the key should not expire, got %v %v", ttl, err)
+	}
+
+	c, _ := newPolicyBitSet(t, FixedExpiration(time.Hour))
+	c.Set(10)
+	if err := c.Persist(ctx); err != nil {
+		t.Fatal(err)
+	}
+	c.Set(20)
+	c.ClearAll()
+	if ttl, _ := c.TTL(ctx); ttl != 0 {
+		t.Errorf("a persisted key should not expire, got %v", ttl)
+	}
+}
+
+func TestRedisBitSetInPlaceUnion(t *testing.T) {
+	ctx := context.Background()
+	a, redisClient := newPolicyBitSet(t, FixedExpiration(time.Hour))
+	b, _ := newPolicyBitSet(t, NoExpiration())
+	a.Set(1)
+	b.Set(100)
+	redisClient.PExpire(ctx, a.GetBitSetKey(), time.Minute)
+
+	a.InPlaceUnion(b)
+	if !a.Test(1) || !a.Test(100) {
+		t.Error("the union should keep the bits of both bitsets")
+	}
+	if ttl, _ := a.TTL(ctx); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("the union should keep the remaining time to live, got %v", ttl)
+	}
+}
@@ -0,0 +1,224 @@
+package bloom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// HasherMurmur3 is the hasher of the filters of this package: 128 bit
+// murmur3, double hashed into k locations.
+const HasherMurmur3 = "murmur3"
+
+var (
+	// ErrFilterNotFound is returned by a Registry for a name it does not know.
+	ErrFilterNotFound = errors.New("bloom: filter not found")
+	// ErrFilterExists is returned by Registry.Create for a name already taken.
+	ErrFilterExists = errors.New("bloom: filter already exists")
+)
+
+// FilterInfo is the metadata of a filter kept by a Registry.
+type FilterInfo struct {
+	// Name of the filter in the registry
+	Name string
+	// Key is the Redis key of the bitset of the filter
+	Key string
+	// M is the number of bits of the filter
+	M uint
+	// K is the number of hash functions
+	K uint
+	// Hasher names the hash function the filter was built with
+	Hasher string
+	// CreatedAt is when the filter was created
+	CreatedAt time.Time
+	// TTL is the time to live of the filter, 0 if it does not expire
+	TTL time.Duration
+	// Description is free text about the filter
+	Description string
+}
+
+// Registry keeps track of named filters backed by Redis bitsets, along with
+// the parameters needed to open them, so that services only need a name.
+//
+// The metadata of a filter named name is stored in the Redis hash
+// prefix+"meta:{"+name+"}", its bits in the RedisBitSet
+// prefix+"bits:{"+name+"}", sharing a hash tag so that they live in the same
+// slot of a Redis Cluster, and the names in the set prefix+"filters".
+type Registry struct {
+	redisClient redis.UniversalClient
+	prefix      string
+}
+
+// NewRegistry creates a Registry storing its filters under the Redis keys
+// starting with prefix.
+func NewRegistry(redisClient redis.UniversalClient, prefix string) *Registry {
+	return &Registry{redisClient: redisClient, prefix: prefix}
+}
+
+func (r *Registry) metaKey(name string) string {
+	return r.prefix + "meta:{" + name + "}"
+}
+
+func (r *Registry) bitsKey(name string) string {
+	return r.prefix + "bits:{" + name + "}"
+}
+
+func (r *Registry) indexKey() string {
+	return r.prefix + "filters"
+}
+
+// Create creates an empty filter named info.Name with info.M bits and info.K
+// hash functions, which expires after info.TTL if it is not 0. Key, Hasher
+// and CreatedAt are filled in by the registry. It returns ErrFilterExists if
+// the name is taken.
+func (r *Registry) Create(ctx context.Context, info FilterInfo) (BloomFilter, error) {
+	info.Key = r.bitsKey(info.Name)
+	info.M = max(1, info.M)
+	info.K = max(1, info.K)
+	info.Hasher = HasherMurmur3
+	info.CreatedAt = time.Now().UTC()
+
+	// the metadata is checked and written, and a leftover bitset of a filter
+	// that expired deleted, in a single WATCH/MULTI transaction on its key,
+	// so that a failed Create leaves nothing behind and never deletes the
+	// bits of the Create that won
+	metaKey := r.metaKey(info.Name)
+	err := watchKey(ctx, r.redisClient, metaKey, func(tx *redis.Tx) error {
+		n, err := tx.Exists(ctx, metaKey).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrFilterExists
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, info.Key)
+			pipe.HSet(ctx, metaKey, map[string]interface{}{
+				"key":         info.Key,
+				"m":           strconv.FormatUint(uint64(info.M), 10),
+				"k":           strconv.FormatUint(uint64(info.K), 10),
+				"hasher":      info.Hasher,
+				"created_at":  info.CreatedAt.Format(time.RFC3339Nano),
+				"ttl":         info.TTL.String(),
+				"description": info.Description,
+			})
+			if info.TTL > 0 {
+				pipe.Expire(ctx, metaKey, info.TTL)
+			}
+			return nil
+		})
+		return err
+	})
+	if err != nil && err != ErrFilterExists {
+		return nil, err
+	}
+	// the index may live in another slot of a Redis Cluster: it is updated
+	// after the transaction, and a name missing from it after a failure is
+	// added back by any later Create of the name
+	if err := r.redisClient.SAdd(ctx, r.indexKey(), info.Name).Err(); err != nil {
+		return nil, err
+	}
+	if err == ErrFilterExists {
+		return nil, err
+	}
+	return New(info.M, info.K, NewRedisBitSet(r.redisClient, info.Key, info.TTL)), nil
+}
+
+// CreateWithEstimates creates a filter named info.Name sized for about n
+// items with fp false positive rate, see Create.
+func (r *Registry) CreateWithEstimates(ctx context.Context, info FilterInfo, n uint, fp float64) (BloomFilter, error) {
+	info.M, info.K = EstimateParameters(n, fp)
+	return r.Create(ctx, info)
+}
+
+// Info returns the metadata of the filter named name.
+func (r *Registry) Info(ctx context.Context, name string) (FilterInfo, error) {
+	fields, err := r.redisClient.HGetAll(ctx, r.metaKey(name)).Result()
+	if err != nil {
+		return FilterInfo{}, err
+	}
+	if len(fields) == 0 {
+		return FilterInfo{}, ErrFilterNotFound
+	}
+	info := FilterInfo{
+		Name:        name,
+		Key:         fields["key"],
+		Hasher:      fields["hasher"],
+		Description: fields["description"],
+	}
+	m, err := strconv.ParseUint(fields["m"], 10, 64)
+	if err != nil {
+		return FilterInfo{}, fmt.Errorf("bloom: invalid m of filter %s: %v", name, err)
+	}
+	k, err := strconv.ParseUint(fields["k"], 10, 64)
+	if err != nil {
+		return FilterInfo{}, fmt.Errorf("bloom: invalid k of filter %s: %v", name, err)
+	}
+	info.M, info.K = uint(m), uint(k)
+	if info.CreatedAt, err = time.Parse(time.RFC3339Nano, fields["created_at"]); err != nil {
+		return FilterInfo{}, fmt.Errorf("bloom: invalid creation time of filter %s: %v", name, err)
+	}
+	if info.TTL, err = time.ParseDuration(fields["ttl"]); err != nil {
+		return FilterInfo{}, fmt.Errorf("bloom: invalid ttl of filter %s: %v", name, err)
+	}
+	return info, nil
+}
+
+// Open returns the filter named name, with the parameters it was created
+// with.
+func (r *Registry) Open(ctx context.Context, name string) (BloomFilter, error) {
+	info, err := r.Info(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.Hasher != HasherMurmur3 {
+		return nil, fmt.Errorf("bloom: filter %s uses the unsupported hasher %q", name, info.Hasher)
+	}
+	return New(info.M, info.K, NewRedisBitSet(r.redisClient, info.Key, info.TTL)), nil
+}
+
+// List returns the metadata of the filters of the registry, sorted by name.
+// Expired filters are removed from the registry.
+func (r *Registry) List(ctx context.Context) ([]FilterInfo, error) {
+	names, err := r.redisClient.SMembers(ctx, r.indexKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	infos := make([]FilterInfo, 0, len(names))
+	for _, name := range names {
+		info, err := r.Info(ctx, name)
+		if err == ErrFilterNotFound {
+			// expired
+			r.redisClient.SRem(ctx, r.indexKey(), name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// Delete deletes the filter named name, its metadata and its bits.
+func (r *Registry) Delete(ctx context.Context, name string) error {
+	info, err := r.Info(ctx, name)
+	if err != nil {
+		return err
+	}
+	// one DEL per key, the keys may live in different slots of a Redis
+	// Cluster
+	_, err = r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, r.metaKey(name))
+		pipe.Del(ctx, info.Key)
+		pipe.SRem(ctx, r.indexKey(), name)
+		return nil
+	})
+	return err
+}
@@ -0,0 +1,121 @@
+package bloom
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestRegistry(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	ctx := context.Background()
+	r := NewRegistry(redisClient, uuid.New().String()+":")
+
+	f, err := r.CreateWithEstimates(ctx, FilterInfo{Name: "users", TTL: time.Minute, Description: "known users"}, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddString("Bess")
+	if _, err := r.Create(ctx, FilterInfo{Name: "users", M: 10, K: 1}); err != ErrFilterExists {
+		t.Errorf("creating an existing filter should fail, got %v", err)
+	}
+	if _, err := r.Create(ctx, FilterInfo{Name: "admins", M: 1000, K: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := r.Open(ctx, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, k := EstimateParameters(1000, 0.01)
+	if g.Cap() != m || g.K() != k {
+		t.Errorf("unexpected parameters m=%d k=%d", g.Cap(), g.K())
+	}
+	if !g.TestString("Bess") {
+		t.Error("Bess should be in the opened filter")
+	}
+
+	info, err := r.Info(ctx, "users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Hasher != HasherMurmur3 || info.TTL != time.Minute || info.Description != "known users" ||
+		time.Since(info.CreatedAt) > time.Minute || info.Key != f.BitSet().GetBitSetKey() {
+		t.Errorf("unexpected info %+v", info)
+	}
+	if ttl := redisClient.TTL(ctx, info.Key).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("the bitset should expire within a minute, got %v", ttl)
+	}
+
+	infos, err := r.List(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != 2 || infos[0].Name != "admins" || infos[1].Name != "users" {
+		t.Errorf("unexpected filters %+v", infos)
+	}
+
+	if err := r.Delete(ctx, "users"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Open(ctx, "users"); err != ErrFilterNotFound {
+		t.Errorf("a deleted filter should not be found, got %v", err)
+	}
+	if redisClient.Exists(ctx, info.Key).Val() != 0 {
+		t.Error("the bits of a deleted filter should be deleted")
+	}
+	if err := r.Delete(ctx, "users"); err != ErrFilterNotFound {
+		t.Errorf("deleting a missing filter should fail, got %v", err)
+	}
+	if infos, _ := r.List(ctx); len(infos) != 1 {
+		t.Errorf("unexpected filters %+v", infos)
+	}
+}
+
+func TestRegistryConcurrentCreate(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	ctx := context.Background()
+	r := NewRegistry(redisClient, uuid.New().String()+":")
+
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var f BloomFilter
+			// the bits of the winner are added while the others may still
+			// be trying
+			if f, errs[i] = r.Create(ctx, FilterInfo{Name: "users", M: 1000, K: 3, TTL: time.Minute}); errs[i] == nil {
+				f.AddString("Bess")
+			}
+		}(i)
+	}
+	wg.Wait()
+	created := 0
+	for _, err := range errs {
+		switch err {
+		case nil:
+			created++
+		case ErrFilterExists:
+		default:
+			t.Fatal(err)
+		}
+	}
+	if created != 1 {
+		t.Errorf("%d filters created, expected 1", created)
+	}
+	if ttl := redisClient.TTL(ctx, r.metaKey("users")).Val(); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("the metadata should expire within a minute, got %v", ttl)
+	}
+	if infos, err := r.List(ctx); err != nil || len(infos) != 1 {
+		t.Errorf("unexpected filters %+v, %v", infos, err)
+	}
+	if f, err := r.Open(ctx, "users"); err != nil || !f.TestString("Bess") {
+		t.Errorf("the bits of the filter created should be kept, %v", err)
+	}
+}
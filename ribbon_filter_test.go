@@ -0,0 +1,167 @@
+package bloom
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestRibbonFilter(t *testing.T) {
+	keys := xorKeys("key", 100000)
+	for _, fp := range []float64{0.01, 0.001} {
+		// duplicates are ignored
+		f := BuildRibbonFilter(append(keys, keys[:10]...), fp)
+		if f.ResultBits() != RibbonResultBits(fp) {
+			t.Errorf("unexpected result bits %d", f.ResultBits())
+		}
+		if perKey := float64(8*f.NumBytes()) / float64(len(keys)); perKey > 1.12*float64(f.ResultBits()) {
+			t.Errorf("fp %f: the filter takes %f bits per key", fp, perKey)
+		}
+		for _, key := range keys {
+			if !f.Contains(key) {
+				t.Fatalf("%s should be in", key)
+			}
+		}
+		count := 0
+		for i := 0; i < 200000; i++ {
+			if f.ContainsString("other" + strconv.Itoa(i)) {
+				count++
+			}
+		}
+		if actual := float64(count) / 200000; actual > fp {
+			t.Errorf("excessive fpp %f, expected %f", actual, fp)
+		}
+	}
+
+	for n := 0; n < 4; n++ {
+		f := BuildRibbonFilter(xorKeys("small", n), 0.01)
+		for _, key := range xorKeys("small", n) {
+			if !f.Contains(key) {
+				t.Errorf("%s should be in a filter of %d keys", key, n)
+			}
+		}
+	}
+
+	f := BuildRibbonFilterFromHashes([][4]uint64{HashesString("Love")}, 0.001)
+	if !f.ContainsHashes(Hashes([]byte("Love"))) {
+		t.Error("Love should be in")
+	}
+}
+
+func TestRibbonFilterLarge(t *testing.T) {
+	keys := xorKeys("key", 1000000)
+	for _, fp := range []float64{1e-5, 1e-9} {
+		f := BuildRibbonFilter(keys, fp)
+		for _, key := range keys {
+			if !f.Contains(key) {
+				t.Fatalf("%s should be in", key)
+			}
+		}
+		// the false positive rate is 2^-r whatever the number of keys
+		expected := math.Pow(2, -float64(f.ResultBits()))
+		count := 0
+		for i := 0; i < 2000000; i++ {
+			if f.ContainsString("other" + strconv.Itoa(i)) {
+				count++
+			}
+		}
+		if actual := float64(count) / 2000000; actual > 3*expected+1e-6 {
+			t.Errorf("excessive fpp %g, expected %g", actual, expected)
+		}
+	}
+}
+
+func TestRibbonFilterReadWrite(t *testing.T) {
+	f := BuildRibbonFilter(xorKeys("key", 1000), 0.0001)
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing data")
+
+	g := &RibbonFilter{}
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if buf.String() != "trailing data" || !g.Equal(f) || !g.ContainsString("key999") {
+		t.Error("the filter read should be the one written")
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, ribbonHeaderSize))); err != ErrInvalidRibbonFilter {
+		t.Errorf("expected ErrInvalidRibbonFilter, got %v", err)
+	}
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(0, 1<<40, 32))); err != ErrInvalidRibbonFilter {
+		t.Errorf("expected ErrInvalidRibbonFilter, got %v", err)
+	}
+	// the words are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(0, 1<<34, 32))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+	if !g.Equal(f) {
+		t.Error("a failed read should not change the filter")
+	}
+}
+
+// The benchmarks below compare a Ribbon filter to a Bloom filter of the same
+// false positive rate, and report the bits per key of both.
+
+const benchmarkStaticKeys = 1000000
+
+func BenchmarkRibbonBuild(b *testing.B) {
+	keys := xorKeys("key", benchmarkStaticKeys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		BuildRibbonFilter(keys, 0.01)
+	}
+}
+
+func BenchmarkMemoryBuild(b *testing.B) {
+	keys := xorKeys("key", benchmarkStaticKeys)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f := NewWithEstimates(benchmarkStaticKeys, 0.01, NewMemoryBitSet())
+		for _, key := range keys {
+			f.Add(key)
+		}
+	}
+}
+
+func BenchmarkRibbonContains(b *testing.B) {
+	for _, fp := range []float64{0.01, 0.001} {
+		b.Run(strconv.FormatFloat(fp, 'g', -1, 64), func(b *testing.B) {
+			f := BuildRibbonFilter(xorKeys("key", benchmarkStaticKeys), fp)
+			keys := xorKeys("other", 1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Contains(keys[i%len(keys)])
+			}
+			b.ReportMetric(float64(8*f.NumBytes())/benchmarkStaticKeys, "bits/key")
+		})
+	}
+}
+
+func BenchmarkMemoryContains(b *testing.B) {
+	for _, fp := range []float64{0.01, 0.001} {
+		b.Run(strconv.FormatFloat(fp, 'g', -1, 64), func(b *testing.B) {
+			f := NewWithEstimates(benchmarkStaticKeys, fp, NewMemoryBitSet())
+			for _, key := range xorKeys("key", benchmarkStaticKeys) {
+				f.Add(key)
+			}
+			keys := xorKeys("other", 1024)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				f.Test(keys[i%len(keys)])
+			}
+			b.ReportMetric(float64(f.Cap())/benchmarkStaticKeys, "bits/key")
+		})
+	}
+}
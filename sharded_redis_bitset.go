@@ -0,0 +1,418 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// maxShardBits is the largest number of bits a single Redis string can hold.
+const maxShardBits = 1 << 32
+
+// shardAlignment is the number of bits every shard size is a multiple of, so
+// that a 512-bit block never straddles two shards.
+const shardAlignment = 512
+
+// Limits of a bitset read by ReadFrom.
+const (
+	shardedMaxKey    = 1 << 16
+	shardedMaxShards = 1 << 16
+)
+
+// ErrInvalidShardedRedisBitSet is returned when reading a ShardedRedisBitSet
+// from a stream that does not hold one.
+var ErrInvalidShardedRedisBitSet = errors.New("bloom: invalid sharded Redis bitset")
+
+// ShardKeyFunc returns the Redis key holding the given shard of a sharded
+// bitset. It decides, through Redis Cluster hash tags, which slots the shards
+// live in.
+type ShardKeyFunc func(bitsetKey string, shard uint) string
+
+// SpreadShardKeys names shards "<bitsetKey>:{<shard>}", spreading the shards
+// of a bitset over the cluster. Shard i of every bitset using SpreadShardKeys
+// shares a slot, so two such bitsets with the same number of shards can be
+// combined with InPlaceUnion.
+func SpreadShardKeys(bitsetKey string, shard uint) string {
+	return fmt.Sprintf("%s:{%d}", bitsetKey, shard)
+}
+
+// ColocateShardKeys names shards "{<bitsetKey>}:<shard>", keeping all the
+// shards of a bitset in the same slot, and thus on the same node.
+func ColocateShardKeys(bitsetKey string, shard uint) string {
+	return fmt.Sprintf("{%s}:%d", bitsetKey, shard)
+}
+
+// NewShardedRedisBitSet creates a BitSet splitting its bits across shards
+// Redis keys named by shardKey (SpreadShardKeys if nil). Bits are assigned to
+// shards by contiguous ranges of indexes.
+func NewShardedRedisBitSet(redisClient redis.UniversalClient, bitsetKey string, shards uint, expiration time.Duration, shardKey ShardKeyFunc) BitSet {
+	if shardKey == nil {
+		shardKey = SpreadShardKeys
+	}
+	return &ShardedRedisBitSet{
+		redisClient: redisClient,
+		bitsetKey:   bitsetKey,
+		shards:      max(1, shards),
+		expiration:  expiration,
+		shardKey:    shardKey,
+	}
+}
+
+// ShardedRedisBitSet is a BitSet stored in several Redis keys.
+//
+// A single Redis string holds at most 2^32 bits and lives in a single slot of
+// a Redis Cluster. A ShardedRedisBitSet splits the bits over several keys,
+// which lifts the size limit and spreads the load over the cluster. Shards
+// are created lazily, by the first write to each of them, and expire
+// expiration after they are created.
+type ShardedRedisBitSet struct {
+	redisClient redis.UniversalClient
+	bitsetKey   string
+	shards      uint
+	shardBits   uint
+	expiration  time.Duration
+	shardKey    ShardKeyFunc
+}
+
+// Init computes the size of the shards for length bits.
+// If a shard would exceed the 2^32 bits of a Redis string, this function
+// will panic: use more shards.
+func (s *ShardedRedisBitSet) Init(length uint) BitSet {
+	s.setLength(max(1, length))
+	return s
+}
+
+// setLength sizes the shards to hold length bits.
+func (s *ShardedRedisBitSet) setLength(length uint) {
+	shardBits := (length + s.shards - 1) / s.shards
+	shardBits = (shardBits + shardAlignment - 1) / shardAlignment * shardAlignment
+	if uint64(shardBits) > maxShardBits {
+		panic(fmt.Sprintf("bloom: %d bits do not fit in %d shards of at most 2^32 bits", length, s.shards))
+	}
+	s.shardBits = max(shardAlignment, shardBits)
+}
+
+// Shards returns the number of shards.
+func (s *ShardedRedisBitSet) Shards() uint {
+	return s.shards
+}
+
+// ShardKey returns the Redis key holding shard i.
+func (s *ShardedRedisBitSet) ShardKey(i uint) string {
+	return s.shardKey(s.bitsetKey, i)
+}
+
+// locate returns the key of the shard holding bit i and the offset of the bit
+// in that shard.
+func (s *ShardedRedisBitSet) locate(i uint) (string, int64) {
+	if s.shardBits == 0 {
+		panic("bloom: ShardedRedisBitSet used before Init")
+	}
+	shard := i / s.shardBits
+	if shard >= s.shards {
+		panic(fmt.Sprintf("bloom: bit %d out of range", i))
+	}
+	return s.ShardKey(shard), int64(i % s.shardBits)
+}
+
+// create queues the creation of the shard key with its expiration, unless
+// it exists, so that a SETBIT queued after it never creates a key that does
+// not expire.
+func (s *ShardedRedisBitSet) create(ctx context.Context, pipe redis.Pipeliner, key string) {
+	if s.expiration > 0 {
+		pipe.SetNX(ctx, key, "", s.expiration)
+	}
+}
+
+// setBit sets bit i to value, creating its shard if needed.
+func (s *ShardedRedisBitSet) setBit(i uint, value int) {
+	ctx := context.Background()
+	key, offset := s.locate(i)
+	_, _ = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		s.create(ctx, pipe, key)
+		pipe.SetBit(ctx, key, offset, value)
+		return nil
+	})
+}
+
+func (s *ShardedRedisBitSet) Set(i uint) BitSet {
+	s.setBit(i, 1)
+	return s
+}
+
+func (s *ShardedRedisBitSet) UnSet(i uint) BitSet {
+	s.setBit(i, 0)
+	return s
+}
+
+// InPlaceUnion ORs compare into s. compare must be a ShardedRedisBitSet with
+// the same number of shards, whose shards live in the same slots as those of
+// s when running on a Redis Cluster (see SpreadShardKeys). Otherwise the
+// union is a no-op.
+func (s *ShardedRedisBitSet) InPlaceUnion(compare BitSet) {
+	c, ok := compare.(*ShardedRedisBitSet)
+	if !ok || c.shards != s.shards {
+		return
+	}
+	ctx := context.Background()
+	_, _ = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := uint(0); i < s.shards; i++ {
+			pipe.BitOpOr(ctx, s.ShardKey(i), s.ShardKey(i), c.ShardKey(i))
+		}
+		return nil
+	})
+}
+
+func (s *ShardedRedisBitSet) Test(i uint) bool {
+	key, offset := s.locate(i)
+	return s.redisClient.GetBit(context.Background(), key, offset).Val() == 1
+}
+
+func (s *ShardedRedisBitSet) ClearAll() BitSet {
+	ctx := context.Background()
+	_, _ = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := uint(0); i < s.shards; i++ {
+			pipe.Set(ctx, s.ShardKey(i), "", s.expiration)
+		}
+		return nil
+	})
+	return s
+}
+
+// Count fans out a BITCOUNT to every shard.
+func (s *ShardedRedisBitSet) Count() uint {
+	ctx := context.Background()
+	cmds := make([]*redis.IntCmd, s.shards)
+	_, _ = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range cmds {
+			cmds[i] = pipe.BitCount(ctx, s.ShardKey(uint(i)), nil)
+		}
+		return nil
+	})
+	var count uint
+	for _, cmd := range cmds {
+		count += uint(cmd.Val())
+	}
+	return count
+}
+
+// shardValues returns the content of every shard.
+func (s *ShardedRedisBitSet) shardValues() ([][]byte, error) {
+	ctx := context.Background()
+	cmds := make([]*redis.StringCmd, s.shards)
+	_, err := s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := range cmds {
+			cmds[i] = pipe.Get(ctx, s.ShardKey(uint(i)))
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([][]byte, s.shards)
+	for i, cmd := range cmds {
+		values[i], _ = cmd.Bytes()
+	}
+	return values, nil
+}
+
+func (s *ShardedRedisBitSet) WriteTo(stream io.Writer) (int64, error) {
+	values, err := s.shardValues()
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(stream, binary.BigEndian, uint64(len(s.bitsetKey)))
+	if err != nil {
+		return 0, err
+	}
+	n, err := stream.Write([]byte(s.bitsetKey))
+	if err != nil {
+		return 0, err
+	}
+	err = binary.Write(stream, binary.BigEndian, []uint64{uint64(s.expiration), uint64(s.shards), uint64(s.shardBits)})
+	if err != nil {
+		return 0, err
+	}
+	written := int64(n + 4*binary.Size(uint64(0)))
+	for _, value := range values {
+		err = binary.Write(stream, binary.BigEndian, uint64(len(value)))
+		if err != nil {
+			return written, err
+		}
+		n, err = stream.Write(value)
+		written += int64(n + binary.Size(uint64(0)))
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Equal is true if c is a ShardedRedisBitSet with the same layout and the
+// same bits set.
+func (s *ShardedRedisBitSet) Equal(c BitSet) bool {
+	other, ok := c.(*ShardedRedisBitSet)
+	if !ok || other.shards != s.shards || other.shardBits != s.shardBits {
+		return false
+	}
+	values, err := s.shardValues()
+	if err != nil {
+		return false
+	}
+	otherValues, err := other.shardValues()
+	if err != nil {
+		return false
+	}
+	for i := range values {
+		if string(values[i]) != string(otherValues[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// GetBitSetKey returns the key the shard keys are derived from.
+func (s *ShardedRedisBitSet) GetBitSetKey() string {
+	return s.bitsetKey
+}
+
+func (s *ShardedRedisBitSet) ReadFrom(stream io.Reader) (int64, error) {
+	var bitsetKeyLen uint64
+	err := binary.Read(stream, binary.BigEndian, &bitsetKeyLen)
+	if err != nil {
+		return 0, err
+	}
+	if bitsetKeyLen > shardedMaxKey {
+		return 0, ErrInvalidShardedRedisBitSet
+	}
+	bitsetKeyBytes := make([]byte, bitsetKeyLen)
+	n, err := io.ReadFull(stream, bitsetKeyBytes)
+	if err != nil {
+		return 0, err
+	}
+	var layout [3]uint64
+	err = binary.Read(stream, binary.BigEndian, &layout)
+	if err != nil {
+		return 0, err
+	}
+	shards, shardBits := layout[1], layout[2]
+	if shards < 1 || shards > shardedMaxShards || shardBits < shardAlignment || shardBits > maxShardBits ||
+		shardBits%shardAlignment != 0 {
+		return 0, ErrInvalidShardedRedisBitSet
+	}
+	read := int64(n + 4*binary.Size(uint64(0)))
+	values := make([][]byte, shards)
+	for i := range values {
+		var valueLen uint64
+		err = binary.Read(stream, binary.BigEndian, &valueLen)
+		if err != nil {
+			return 0, err
+		}
+		if valueLen > shardBits/8 {
+			return 0, ErrInvalidShardedRedisBitSet
+		}
+		m, err := readRecords(stream, valueLen, 1, func(chunk []byte) {
+			values[i] = append(values[i], chunk...)
+		})
+		if err != nil {
+			return 0, err
+		}
+		read += m + int64(binary.Size(uint64(0)))
+	}
+
+	s.bitsetKey = string(bitsetKeyBytes)
+	s.expiration = time.Duration(layout[0])
+	s.shards = uint(layout[1])
+	s.shardBits = uint(layout[2])
+	ctx := context.Background()
+	_, err = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, value := range values {
+			pipe.Set(ctx, s.ShardKey(uint(i)), value, s.expiration)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return read, nil
+}
+
+// From uses the same byte layout as RedisBitSet.From, cut into shards.
+func (s *ShardedRedisBitSet) From(buf []uint64) BitSet {
+	data := make([]byte, 8*len(buf))
+	for i, val := range buf {
+		binary.LittleEndian.PutUint64(data[8*i:], val)
+	}
+	if s.shardBits == 0 {
+		s.setLength(uint(len(buf) * 64))
+	}
+	ctx := context.Background()
+	shardBytes := int(s.shardBits / 8)
+	_, _ = s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i := uint(0); i < s.shards; i++ {
+			var value []byte
+			if start := int(i) * shardBytes; start < len(data) {
+				end := start + shardBytes
+				if end > len(data) {
+					end = len(data)
+				}
+				value = data[start:end]
+			}
+			pipe.Set(ctx, s.ShardKey(i), value, s.expiration)
+		}
+		return nil
+	})
+	return s
+}
+
+// SetBits sets all the bits in idx in a single pipeline. On a Redis Cluster
+// the pipeline is split by node, so bits of a single shard cost one round
+// trip.
+func (s *ShardedRedisBitSet) SetBits(ctx context.Context, idx []uint) error {
+	_, err := s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		return s.queueSetBits(ctx, pipe, idx)
+	})
+	return err
+}
+
+// queueSetBits queues in pipe the commands setting the bits in idx,
+// creating their shards if needed.
+func (s *ShardedRedisBitSet) queueSetBits(ctx context.Context, pipe redis.Pipeliner, idx []uint) error {
+	created := make(map[string]bool)
+	for _, i := range idx {
+		key, offset := s.locate(i)
+		if !created[key] {
+			s.create(ctx, pipe, key)
+			created[key] = true
+		}
+		pipe.SetBit(ctx, key, offset, 1)
+	}
+	return nil
+}
+
+// TestBits returns true if all the bits in idx are set, using a single
+// pipeline.
+func (s *ShardedRedisBitSet) TestBits(ctx context.Context, idx []uint) (bool, error) {
+	cmds := make([]*redis.IntCmd, len(idx))
+	_, err := s.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for j, i := range idx {
+			key, offset := s.locate(i)
+			cmds[j] = pipe.GetBit(ctx, key, offset)
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	for _, cmd := range cmds {
+		if cmd.Val() != 1 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
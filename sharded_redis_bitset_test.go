@@ -0,0 +1,120 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/bits"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func TestShardedRedisBitSet(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitset := NewShardedRedisBitSet(redisClient, uuid.New().String(), 4, time.Minute, nil)
+	f := NewWithEstimates(1000, 0.001, bitset)
+	for i := 0; i < 100; i++ {
+		f.AddString(uuid.New().String())
+	}
+	f.AddString("Bess")
+	if !f.TestString("Bess") {
+		t.Error("Bess should be in")
+	}
+	if f.TestString("Jane") {
+		t.Error("Jane should not be in")
+	}
+	used := 0
+	for i := uint(0); i < 4; i++ {
+		if redisClient.Exists(context.Background(), bitset.(*ShardedRedisBitSet).ShardKey(i)).Val() == 1 {
+			used++
+		}
+	}
+	if used != 4 {
+		t.Errorf("bits should be spread over the 4 shards, %d used", used)
+	}
+
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := New(0, 0, NewShardedRedisBitSet(redisClient, uuid.New().String(), 1, time.Minute, ColocateShardKeys))
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if g.BitSet().Count() != f.BitSet().Count() {
+		t.Error("count should be preserved")
+	}
+	if !g.TestString("Bess") {
+		t.Error("Bess should be in the copy")
+	}
+
+	b := g.BitSet().(*ShardedRedisBitSet)
+	for _, layout := range [][]uint64{{1 << 40}, {0, 0, 0, 512}, {0, 0, 1, 0}, {0, 0, 1, 100}, {0, 0, 1, 512, 1 << 20}} {
+		if _, err := b.ReadFrom(bytes.NewReader(bigEndianHeader(layout...))); err != ErrInvalidShardedRedisBitSet {
+			t.Errorf("expected ErrInvalidShardedRedisBitSet, got %v", err)
+		}
+	}
+	// the shards are allocated as they are read
+	if _, err := b.ReadFrom(bytes.NewReader(bigEndianHeader(0, 0, 1, maxShardBits, 1<<29))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestShardedRedisBitSetLarge(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitset := NewShardedRedisBitSet(redisClient, uuid.New().String(), 4, time.Minute, nil)
+	if bits.UintSize < 64 {
+		t.Skip("bit indexes beyond 2^32 need a 64-bit uint")
+	}
+	length := uint64(1) << 34
+	bitset.Init(uint(length))
+	i, shardBits := uint(length/2+7), uint(length/4)
+	if bitset.Test(i) {
+		t.Errorf("bit %d should not be set", i)
+	}
+	bitset.Set(i)
+	if !bitset.Test(i) || bitset.Count() != 1 {
+		t.Errorf("bit %d should be set", i)
+	}
+	if bitset.Test(i - shardBits) {
+		t.Errorf("bit %d should not alias bit %d", i-shardBits, i)
+	}
+}
+
+func TestShardedRedisBitSetUnion(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	f := New(10000, 4, NewShardedRedisBitSet(redisClient, uuid.New().String(), 3, time.Minute, nil))
+	g := New(10000, 4, NewShardedRedisBitSet(redisClient, uuid.New().String(), 3, time.Minute, nil))
+	f.AddString("Bess")
+	g.AddString("Jane")
+	f.BitSet().InPlaceUnion(g.BitSet())
+	if !f.TestString("Bess") || !f.TestString("Jane") {
+		t.Error("the union should contain both keys")
+	}
+}
+
+func TestShardedRedisBitSetExpiration(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	bitset := NewShardedRedisBitSet(redisClient, uuid.New().String(), 4, time.Minute, nil).(*ShardedRedisBitSet)
+	bitset.Init(4096)
+	bitset.Set(1)
+	bitset.SetBits(ctx, []uint{1030, 2050})
+	bitset.UnSet(4000)
+	for i := uint(0); i < 4; i++ {
+		if ttl := redisClient.PTTL(ctx, bitset.ShardKey(i)).Val(); ttl <= 0 || ttl > time.Minute {
+			t.Errorf("shard %d: unexpected ttl %v", i, ttl)
+		}
+	}
+	if !bitset.Test(1) || !bitset.Test(1030) || !bitset.Test(2050) || bitset.Count() != 3 {
+		t.Error("creating the shards should not change their bits")
+	}
+}
@@ -0,0 +1,417 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Sizes of a Parquet split block Bloom filter, in bytes.
+const (
+	sbbfBlockBytes = 32
+	sbbfMinBytes   = sbbfBlockBytes
+	sbbfMaxBytes   = 128 * 1024 * 1024
+	sbbfBlockWords = 8
+)
+
+// sbbfSalts are the salts of the Parquet specification, one per word of a
+// block.
+var sbbfSalts = [sbbfBlockWords]uint32{
+	0x47b6137b, 0x44974d91, 0x8824ad5b, 0xa2b7289d,
+	0x705495c7, 0x2df1424b, 0x9efc4947, 0x5c6bfb31,
+}
+
+// ErrUnsupportedSplitBlock is returned by SplitBlockBloomFilter.ReadFrom for
+// a Parquet Bloom filter header using an algorithm, hash or compression other
+// than BLOCK, XXHASH and UNCOMPRESSED, the only ones the specification defines
+// so far.
+var ErrUnsupportedSplitBlock = errors.New("bloom: unsupported parquet bloom filter")
+
+// SplitBlockNumBytes returns the size, in bytes, of a split block Bloom
+// filter for about n items with fp false positive rate, as computed by the
+// Parquet writers: a power of two between 32 bytes and 128 MiB.
+func SplitBlockNumBytes(n uint, fp float64) uint {
+	bits := -8 * float64(n) / math.Log(1-math.Pow(fp, 1.0/8))
+	return sbbfRoundBytes(uint(math.Ceil(bits / 8)))
+}
+
+// sbbfRoundBytes rounds numBytes up to a valid split block filter size.
+func sbbfRoundBytes(numBytes uint) uint {
+	if numBytes >= sbbfMaxBytes {
+		return sbbfMaxBytes
+	}
+	size := uint(sbbfMinBytes)
+	for size < numBytes {
+		size <<= 1
+	}
+	return size
+}
+
+// NewSplitBlockBloomFilter creates a Parquet split block Bloom filter of
+// numBytes bytes, rounded up to a power of two between 32 bytes and 128 MiB.
+func NewSplitBlockBloomFilter(numBytes uint) *SplitBlockBloomFilter {
+	numBytes = sbbfRoundBytes(numBytes)
+	return &SplitBlockBloomFilter{words: make([]uint32, numBytes/4)}
+}
+
+// NewSplitBlockBloomFilterWithEstimates creates a Parquet split block Bloom
+// filter for about n items with fp false positive rate.
+func NewSplitBlockBloomFilterWithEstimates(n uint, fp float64) *SplitBlockBloomFilter {
+	return NewSplitBlockBloomFilter(SplitBlockNumBytes(n, fp))
+}
+
+// SplitBlockBloomFilter is the Split Block Bloom Filter (SBBF) of the Parquet
+// specification: https://github.com/apache/parquet-format/blob/master/BloomFilter.md
+//
+// The filter is an array of 256-bit blocks of eight 32-bit words. A key is
+// hashed with xxHash64; the high 32 bits of the hash select a block, and the
+// low 32 bits, multiplied by eight salts, set one bit in every word of it.
+//
+// Parquet hashes the plain encoding of a value: the raw bytes for BYTE_ARRAY
+// and FIXED_LEN_BYTE_ARRAY columns (use Add and Test), the little-endian bytes
+// for the numeric types (use AddHash and TestHash with the xxHash64 of these
+// bytes). WriteTo and ReadFrom use the on-disk layout of a column chunk Bloom
+// filter: a Thrift BloomFilterHeader followed by the bitset.
+type SplitBlockBloomFilter struct {
+	words []uint32
+}
+
+// NumBytes returns the size of the bitset, in bytes.
+func (f *SplitBlockBloomFilter) NumBytes() uint {
+	return uint(len(f.words) * 4)
+}
+
+// block returns the words of the block selected by hash.
+func (f *SplitBlockBloomFilter) block(hash uint64) []uint32 {
+	blocks := uint64(len(f.words) / sbbfBlockWords)
+	i := ((hash >> 32) * blocks) >> 32
+	return f.words[i*sbbfBlockWords : (i+1)*sbbfBlockWords]
+}
+
+// AddHash adds a key given by its xxHash64 hash. Returns the filter (allows
+// chaining)
+func (f *SplitBlockBloomFilter) AddHash(hash uint64) *SplitBlockBloomFilter {
+	block := f.block(hash)
+	x := uint32(hash)
+	for i, salt := range sbbfSalts {
+		block[i] |= 1 << ((x * salt) >> 27)
+	}
+	return f
+}
+
+// TestHash returns true if the key given by its xxHash64 hash may be in the
+// filter, false if it definitely is not.
+func (f *SplitBlockBloomFilter) TestHash(hash uint64) bool {
+	block := f.block(hash)
+	x := uint32(hash)
+	for i, salt := range sbbfSalts {
+		if block[i]&(1<<((x*salt)>>27)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Add data to the filter, hashed the way Parquet hashes a BYTE_ARRAY value.
+// Returns the filter (allows chaining)
+func (f *SplitBlockBloomFilter) Add(data []byte) *SplitBlockBloomFilter {
+	return f.AddHash(xxhash.Sum64(data))
+}
+
+// AddString to the filter. Returns the filter (allows chaining)
+func (f *SplitBlockBloomFilter) AddString(data string) *SplitBlockBloomFilter {
+	return f.AddHash(xxhash.Sum64String(data))
+}
+
+// Test returns true if the data may be in the filter, false if it definitely
+// is not.
+func (f *SplitBlockBloomFilter) Test(data []byte) bool {
+	return f.TestHash(xxhash.Sum64(data))
+}
+
+// TestString returns true if the string may be in the filter, false if it
+// definitely is not.
+func (f *SplitBlockBloomFilter) TestString(data string) bool {
+	return f.TestHash(xxhash.Sum64String(data))
+}
+
+// ClearAll clears all the data in the filter, removing all keys
+func (f *SplitBlockBloomFilter) ClearAll() *SplitBlockBloomFilter {
+	for i := range f.words {
+		f.words[i] = 0
+	}
+	return f
+}
+
+// Bytes returns the bitset as stored in a Parquet file, words in
+// little-endian order.
+func (f *SplitBlockBloomFilter) Bytes() []byte {
+	data := make([]byte, 4*len(f.words))
+	for i, w := range f.words {
+		binary.LittleEndian.PutUint32(data[4*i:], w)
+	}
+	return data
+}
+
+// Equal tests for the equality of two split block Bloom filters
+func (f *SplitBlockBloomFilter) Equal(g *SplitBlockBloomFilter) bool {
+	if len(f.words) != len(g.words) {
+		return false
+	}
+	for i := range f.words {
+		if f.words[i] != g.words[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// sbbfHeader returns the Thrift compact encoding of a BloomFilterHeader for
+// numBytes bytes with the BLOCK algorithm, XXHASH hash and no compression.
+func sbbfHeader(numBytes uint) []byte {
+	var buf [binary.MaxVarintLen32]byte
+	n := binary.PutUvarint(buf[:], uint64(zigzag32(int32(numBytes))))
+	header := append([]byte{0x15}, buf[:n]...) // field 1, i32: numBytes
+	// fields 2, 3 and 4, structs: unions whose field 1 is an empty struct
+	for i := 0; i < 3; i++ {
+		header = append(header, 0x1c, 0x1c, 0x00, 0x00)
+	}
+	return append(header, 0x00)
+}
+
+// WriteTo writes the filter to an i/o stream in the Parquet on-disk format,
+// header then bitset. It returns the number of bytes written.
+func (f *SplitBlockBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	n, err := stream.Write(sbbfHeader(f.NumBytes()))
+	if err != nil {
+		return int64(n), err
+	}
+	m, err := stream.Write(f.Bytes())
+	return int64(n + m), err
+}
+
+// ReadFrom reads a filter in the Parquet on-disk format (such as might have
+// been written by WriteTo(), or found at the bloom_filter_offset of a column
+// chunk) from an i/o stream. It returns the number of bytes read.
+func (f *SplitBlockBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	r := &thriftReader{r: stream}
+	numBytes, err := r.readBloomFilterHeader()
+	if err != nil {
+		return r.n, err
+	}
+	if numBytes < sbbfMinBytes || numBytes > sbbfMaxBytes || numBytes&(numBytes-1) != 0 {
+		return r.n, fmt.Errorf("bloom: invalid parquet bloom filter size %d", numBytes)
+	}
+	data := make([]byte, numBytes)
+	n, err := io.ReadFull(stream, data)
+	if err != nil {
+		return r.n + int64(n), err
+	}
+	words := make([]uint32, numBytes/4)
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	f.words = words
+	return r.n + int64(n), nil
+}
+
+func zigzag32(v int32) uint32 {
+	return uint32((v << 1) ^ (v >> 31))
+}
+
+// Thrift compact protocol types.
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftByte   = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// thriftReader decodes just enough of the Thrift compact protocol to read a
+// BloomFilterHeader. It reads byte by byte, never past the header, and
+// counts the bytes it consumes.
+type thriftReader struct {
+	r   io.Reader
+	n   int64
+	buf [1]byte
+}
+
+func (t *thriftReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(t.r, t.buf[:])
+	if err != nil {
+		return 0, err
+	}
+	t.n++
+	return t.buf[0], nil
+}
+
+func (t *thriftReader) readVarint() (uint64, error) {
+	return binary.ReadUvarint(t)
+}
+
+// readFieldHeader returns the type and id of the next field, type 0 at the
+// end of a struct.
+func (t *thriftReader) readFieldHeader(lastID int16) (byte, int16, error) {
+	b, err := t.ReadByte()
+	if err != nil || b == 0 {
+		return 0, 0, err
+	}
+	typ := b & 0x0f
+	if delta := int16(b >> 4); delta != 0 {
+		return typ, lastID + delta, nil
+	}
+	v, err := t.readVarint()
+	return typ, int16(int32(v>>1) ^ -int32(v&1)), err
+}
+
+// skip skips a value of type typ.
+func (t *thriftReader) skip(typ byte) error {
+	switch typ {
+	case thriftTrue, thriftFalse:
+		return nil
+	case thriftByte:
+		_, err := t.ReadByte()
+		return err
+	case thriftI16, thriftI32, thriftI64:
+		_, err := t.readVarint()
+		return err
+	case thriftDouble:
+		for i := 0; i < 8; i++ {
+			if _, err := t.ReadByte(); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftBinary:
+		size, err := t.readVarint()
+		if err != nil {
+			return err
+		}
+		n, err := io.CopyN(ioutil.Discard, t.r, int64(size))
+		t.n += n
+		return err
+	case thriftList, thriftSet:
+		b, err := t.ReadByte()
+		if err != nil {
+			return err
+		}
+		size := uint64(b >> 4)
+		if size == 15 {
+			if size, err = t.readVarint(); err != nil {
+				return err
+			}
+		}
+		for i := uint64(0); i < size; i++ {
+			if err := t.skip(b & 0x0f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftMap:
+		size, err := t.readVarint()
+		if err != nil || size == 0 {
+			return err
+		}
+		types, err := t.ReadByte()
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < size; i++ {
+			if err := t.skip(types >> 4); err != nil {
+				return err
+			}
+			if err := t.skip(types & 0x0f); err != nil {
+				return err
+			}
+		}
+		return nil
+	case thriftStruct:
+		var id int16
+		for {
+			typ, next, err := t.readFieldHeader(id)
+			if err != nil || typ == 0 {
+				return err
+			}
+			if err := t.skip(typ); err != nil {
+				return err
+			}
+			id = next
+		}
+	default:
+		return fmt.Errorf("bloom: invalid thrift type %d", typ)
+	}
+}
+
+// readUnion reads a union and returns the id of the field that is set.
+func (t *thriftReader) readUnion() (int16, error) {
+	var id, set int16
+	for {
+		typ, next, err := t.readFieldHeader(id)
+		if err != nil {
+			return 0, err
+		}
+		if typ == 0 {
+			return set, nil
+		}
+		if err := t.skip(typ); err != nil {
+			return 0, err
+		}
+		id, set = next, next
+	}
+}
+
+// readBloomFilterHeader reads a BloomFilterHeader and returns its numBytes,
+// checking the algorithm, hash and compression are the supported ones.
+func (t *thriftReader) readBloomFilterHeader() (uint, error) {
+	var id int16
+	numBytes := int64(-1)
+	for {
+		typ, next, err := t.readFieldHeader(id)
+		if err != nil {
+			return 0, err
+		}
+		if typ == 0 {
+			break
+		}
+		id = next
+		switch {
+		case id == 1 && typ == thriftI32:
+			v, err := t.readVarint()
+			if err != nil {
+				return 0, err
+			}
+			numBytes = int64(int32(v>>1) ^ -int32(v&1))
+		case id >= 2 && id <= 4 && typ == thriftStruct:
+			// algorithm BLOCK, hash XXHASH and compression UNCOMPRESSED are
+			// all field 1 of their union
+			set, err := t.readUnion()
+			if err != nil {
+				return 0, err
+			}
+			if set != 1 {
+				return 0, ErrUnsupportedSplitBlock
+			}
+		default:
+			if err := t.skip(typ); err != nil {
+				return 0, err
+			}
+		}
+	}
+	if numBytes < 0 {
+		return 0, errors.New("bloom: parquet bloom filter header without numBytes")
+	}
+	return uint(numBytes), nil
+}
@@ -0,0 +1,75 @@
+package bloom
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+)
+
+func TestSplitBlockBloomFilterParquetLayout(t *testing.T) {
+	// bitset built by a Parquet implementation with the same keys
+	expected := "04001000000240000004400080000800000200040020008010000010020000080000000000000000000000000000000000000000000000000000000000000000"
+	f := NewSplitBlockBloomFilter(64)
+	f.AddString("hello").Add([]byte("parquet"))
+	if got := hex.EncodeToString(f.Bytes()); got != expected {
+		t.Errorf("unexpected bitset %s", got)
+	}
+
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0x15, 0x80, 0x01, 0x1c, 0x1c, 0x00, 0x00, 0x1c, 0x1c, 0x00, 0x00, 0x1c, 0x1c, 0x00, 0x00, 0x00}
+	if !bytes.HasPrefix(buf.Bytes(), header) {
+		t.Errorf("unexpected header % x", buf.Bytes()[:len(header)])
+	}
+}
+
+func TestSplitBlockBloomFilterReadWrite(t *testing.T) {
+	f := NewSplitBlockBloomFilterWithEstimates(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		f.AddString(fmt.Sprint("key", i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing data")
+
+	g := &SplitBlockBloomFilter{}
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if buf.String() != "trailing data" {
+		t.Error("ReadFrom should not read past the filter")
+	}
+	if !g.Equal(f) {
+		t.Error("filters should be equal")
+	}
+	count := 0
+	for i := 0; i < 1000; i++ {
+		if !g.TestString(fmt.Sprint("key", i)) {
+			t.Fatalf("key%d should be in", i)
+		}
+		if g.TestString(fmt.Sprint("other", i)) {
+			count++
+		}
+	}
+	if float64(count)/1000.0 > 0.02 {
+		t.Errorf("Excessive fpp %f", float64(count)/1000.0)
+	}
+}
+
+func TestSplitBlockBloomFilterUnsupported(t *testing.T) {
+	header := []byte{0x15, 0x40, 0x1c, 0x2c, 0x00, 0x00, 0x1c, 0x1c, 0x00, 0x00, 0x1c, 0x1c, 0x00, 0x00, 0x00}
+	_, err := (&SplitBlockBloomFilter{}).ReadFrom(bytes.NewReader(append(header, make([]byte, 32)...)))
+	if err != ErrUnsupportedSplitBlock {
+		t.Errorf("unexpected error %v", err)
+	}
+}
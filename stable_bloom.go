@@ -0,0 +1,419 @@
+package bloom
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// Parameters of the stable Bloom filters: the largest size of the cells, in
+// bits, the largest number of hash functions and the size of the header
+// written by WriteTo.
+const (
+	stableMaxCellBits = 8
+	stableMaxHashes   = 32
+	stableHeaderSize  = 32
+)
+
+// ErrInvalidStableBloomFilter is returned when reading a StableBloomFilter
+// from a stream that does not hold one.
+var ErrInvalidStableBloomFilter = errors.New("bloom: invalid stable bloom filter")
+
+// StableBloomFilter is a Stable Bloom filter (Deng and Rafiei, "Approximately
+// Detecting Duplicates for Streaming Data using Stable Bloom Filters"), for
+// detecting duplicates in an unbounded stream with a fixed amount of memory.
+//
+// The filter has m cells of d bits. Adding a key first decrements P cells,
+// consecutive from one picked at random, then sets the k cells of the key to
+// the maximum value, 2^d-1; a key is in the filter if none of its k cells is
+// zero. Old keys fade away as their cells are decremented, so the fraction
+// of zero cells, hence the false positive rate, converges to a stable point
+// instead of growing with the stream.
+//
+// The price is false negatives: a key is forgotten once any of its cells has
+// been decremented 2^d-1 times, that is after about (2^d-1)*m/P other keys on
+// average, and sooner for some keys. More bits per cell, or a lower P, keep
+// keys longer but raise the stable false positive rate, and NewStableBloomFilter
+// picks the largest P meeting a given rate: for a given memory, trade the
+// false positive rate against how long keys are remembered.
+//
+// The cells are stored in memory or in a Redis string
+// (NewRedisStableBloomFilter), updated with a single BITFIELD command per
+// operation. An in-memory filter is not safe for concurrent use.
+type StableBloomFilter struct {
+	m, k, d, p uint
+	locator    bloomFilterImpl
+	cells      stableCells
+}
+
+// EstimateStableParameters returns the number of hash functions k and of
+// cells decremented per key P of a stable Bloom filter of m cells of d bits
+// whose false positive rate converges to fp. k is at most 32: below a rate
+// of 2^-32, more cells are decremented per key instead.
+func EstimateStableParameters(m, d uint, fp float64) (k, p uint) {
+	m = max(2, m)
+	d = stableCellBits(d)
+	k = max(1, uint(math.Ceil(math.Log2(1/fp))))
+	if k > stableMaxHashes {
+		k = stableMaxHashes
+	}
+	if k >= m {
+		k = m - 1
+	}
+	cellMax := float64(uint(1)<<d - 1)
+	sub := math.Pow(1-math.Pow(fp, 1/float64(k)), 1/cellMax)
+	denom := (1/sub - 1) * (1/float64(k) - 1/float64(m))
+	return k, max(1, uint(1/denom))
+}
+
+func stableCellBits(d uint) uint {
+	d = max(1, d)
+	if d > stableMaxCellBits {
+		d = stableMaxCellBits
+	}
+	return d
+}
+
+// NewStableBloomFilter creates an in-memory stable Bloom filter of m cells of
+// d bits, at most 8, whose false positive rate converges to fp.
+func NewStableBloomFilter(m, d uint, fp float64) *StableBloomFilter {
+	f := newStableBloomFilter(m, d, fp)
+	f.cells = &memoryCells{data: make([]byte, cellBytes(f.m, f.d)), d: f.d}
+	return f
+}
+
+// NewRedisStableBloomFilter creates a stable Bloom filter of m cells of d
+// bits, at most 8, whose false positive rate converges to fp, stored in the
+// Redis string key. The cells are read and written with BITFIELD, the
+// decrements saturating at zero with OVERFLOW SAT, so that concurrent adds
+// are atomic.
+func NewRedisStableBloomFilter(redisClient redis.UniversalClient, key string, m, d uint, fp float64) *StableBloomFilter {
+	f := newStableBloomFilter(m, d, fp)
+	f.cells = &redisCells{redisClient: redisClient, key: key, d: f.d, size: cellBytes(f.m, f.d)}
+	return f
+}
+
+func newStableBloomFilter(m, d uint, fp float64) *StableBloomFilter {
+	m, d = max(2, m), stableCellBits(d)
+	k, p := EstimateStableParameters(m, d, fp)
+	return newStableBloomFilterWithParameters(m, k, d, p)
+}
+
+func newStableBloomFilterWithParameters(m, k, d, p uint) *StableBloomFilter {
+	if p > m {
+		p = m
+	}
+	return &StableBloomFilter{m: m, k: k, d: d, p: p, locator: bloomFilterImpl{m: m, k: k}}
+}
+
+// cellBytes returns the size, in bytes, of m cells of d bits.
+func cellBytes(m, d uint) int {
+	return int((uint64(m)*uint64(d) + 7) / 8)
+}
+
+// Cap returns the number of cells, m, of the filter.
+func (f *StableBloomFilter) Cap() uint {
+	return f.m
+}
+
+// K returns the number of hash functions of the filter.
+func (f *StableBloomFilter) K() uint {
+	return f.k
+}
+
+// P returns the number of cells decremented per key.
+func (f *StableBloomFilter) P() uint {
+	return f.p
+}
+
+// CellBits returns the size of the cells, d, in bits.
+func (f *StableBloomFilter) CellBits() uint {
+	return f.d
+}
+
+// StablePoint returns the fraction of zero cells the filter converges to.
+func (f *StableBloomFilter) StablePoint() float64 {
+	sub := float64(f.p) * (1/float64(f.k) - 1/float64(f.m))
+	return math.Pow(1/(1+1/sub), float64(uint(1)<<f.d-1))
+}
+
+// FalsePositiveRate returns the false positive rate the filter converges to.
+func (f *StableBloomFilter) FalsePositiveRate() float64 {
+	return math.Pow(1-f.StablePoint(), float64(f.k))
+}
+
+// decremented returns the cells to decrement for a new key.
+func (f *StableBloomFilter) decremented() []uint {
+	start := uint(rand.Int63n(int64(f.m)))
+	cells := make([]uint, f.p)
+	for i := range cells {
+		cells[i] = (start + uint(i)) % f.m
+	}
+	return cells
+}
+
+// Add adds data to the filter.
+func (f *StableBloomFilter) Add(ctx context.Context, data []byte) error {
+	return f.AddHashes(ctx, baseHashes(data))
+}
+
+// AddString adds data to the filter.
+func (f *StableBloomFilter) AddString(ctx context.Context, data string) error {
+	return f.AddHashes(ctx, HashesString(data))
+}
+
+// AddHashes adds the key of base hash values h to the filter.
+func (f *StableBloomFilter) AddHashes(ctx context.Context, h [4]uint64) error {
+	var buf [stableMaxHashes]uint
+	_, err := f.cells.add(ctx, f.decremented(), f.locator.hashLocations(h, buf[:0]), false)
+	return err
+}
+
+// Test returns true if data may be in the filter, false if it is not, or was
+// forgotten.
+func (f *StableBloomFilter) Test(ctx context.Context, data []byte) (bool, error) {
+	return f.TestHashes(ctx, baseHashes(data))
+}
+
+// TestString returns true if data may be in the filter, see Test.
+func (f *StableBloomFilter) TestString(ctx context.Context, data string) (bool, error) {
+	return f.TestHashes(ctx, HashesString(data))
+}
+
+// TestHashes returns true if the key of base hash values h may be in the
+// filter.
+func (f *StableBloomFilter) TestHashes(ctx context.Context, h [4]uint64) (bool, error) {
+	var buf [stableMaxHashes]uint
+	return f.cells.test(ctx, f.locator.hashLocations(h, buf[:0]))
+}
+
+// TestAndAdd is the equivalent to calling Test(data) then Add(data), in a
+// single operation. Returns the result of Test.
+func (f *StableBloomFilter) TestAndAdd(ctx context.Context, data []byte) (bool, error) {
+	return f.testAndAddHashes(ctx, baseHashes(data))
+}
+
+// TestAndAddString is the equivalent to calling Test(data) then Add(data).
+// Returns the result of Test.
+func (f *StableBloomFilter) TestAndAddString(ctx context.Context, data string) (bool, error) {
+	return f.testAndAddHashes(ctx, HashesString(data))
+}
+
+func (f *StableBloomFilter) testAndAddHashes(ctx context.Context, h [4]uint64) (bool, error) {
+	var buf [stableMaxHashes]uint
+	return f.cells.add(ctx, f.decremented(), f.locator.hashLocations(h, buf[:0]), true)
+}
+
+// ClearAll clears all the cells of the filter, removing all keys.
+func (f *StableBloomFilter) ClearAll(ctx context.Context) error {
+	return f.cells.setBytes(ctx, make([]byte, cellBytes(f.m, f.d)))
+}
+
+// WriteTo writes the filter to an i/o stream: m, k, d and P as big-endian
+// uint64, then the cells, packed in Redis bit order. It returns the number
+// of bytes written.
+func (f *StableBloomFilter) WriteTo(stream io.Writer) (int64, error) {
+	cells, err := f.cells.bytes(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	var header [stableHeaderSize]byte
+	for i, v := range []uint{f.m, f.k, f.d, f.p} {
+		binary.BigEndian.PutUint64(header[8*i:], uint64(v))
+	}
+	n, err := stream.Write(header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	c, err := stream.Write(cells)
+	return int64(n + c), err
+}
+
+// ReadFrom reads a filter written by WriteTo from an i/o stream, replacing
+// the parameters and the cells of the filter. It returns the number of bytes
+// read.
+func (f *StableBloomFilter) ReadFrom(stream io.Reader) (int64, error) {
+	var header [stableHeaderSize]byte
+	n, err := io.ReadFull(stream, header[:])
+	if err != nil {
+		return int64(n), err
+	}
+	var v [4]uint64
+	for i := range v {
+		v[i] = binary.BigEndian.Uint64(header[8*i:])
+	}
+	m, k, d, p := v[0], v[1], v[2], v[3]
+	if m < 2 || m > 1<<40 || k < 1 || k > stableMaxHashes || d < 1 || d > stableMaxCellBits || p < 1 || p > m ||
+		m*d > 1<<39 {
+		return int64(n), ErrInvalidStableBloomFilter
+	}
+	g := newStableBloomFilterWithParameters(uint(m), uint(k), uint(d), uint(p))
+	var cells []byte
+	c, err := readRecords(stream, uint64(cellBytes(g.m, g.d)), 1, func(chunk []byte) {
+		cells = append(cells, chunk...)
+	})
+	if err != nil {
+		return int64(n) + c, err
+	}
+	g.cells = f.cells.resize(g.d, len(cells))
+	if err := g.cells.setBytes(context.Background(), cells); err != nil {
+		return int64(n) + c, err
+	}
+	*f = *g
+	return int64(n) + c, nil
+}
+
+// stableCells stores the cells of a StableBloomFilter.
+type stableCells interface {
+	// add decrements the cells of decrement, saturating at zero, then sets
+	// the cells of set to the maximum value. If test is true, it returns
+	// whether none of the cells of set was zero before.
+	add(ctx context.Context, decrement, set []uint, test bool) (bool, error)
+	// test returns whether none of the cells of idx is zero.
+	test(ctx context.Context, idx []uint) (bool, error)
+	// bytes returns the cells packed in Redis bit order.
+	bytes(ctx context.Context) ([]byte, error)
+	// setBytes replaces the cells.
+	setBytes(ctx context.Context, data []byte) error
+	// resize returns a store of the same kind for cells of d bits taking
+	// size bytes, to be filled by setBytes.
+	resize(d uint, size int) stableCells
+}
+
+// memoryCells keeps the cells in memory.
+type memoryCells struct {
+	data []byte
+	d    uint
+}
+
+func (c *memoryCells) cell(i uint) uint64 {
+	return readSlot(c.data, uint64(i)*uint64(c.d), c.d)
+}
+
+func (c *memoryCells) setCell(i uint, v uint64) {
+	writeSlot(c.data, uint64(i)*uint64(c.d), c.d, v)
+}
+
+func (c *memoryCells) add(ctx context.Context, decrement, set []uint, test bool) (bool, error) {
+	present := false
+	if test {
+		present, _ = c.test(ctx, set)
+	}
+	for _, i := range decrement {
+		if v := c.cell(i); v > 0 {
+			c.setCell(i, v-1)
+		}
+	}
+	for _, i := range set {
+		c.setCell(i, 1<<c.d-1)
+	}
+	return present, nil
+}
+
+func (c *memoryCells) test(_ context.Context, idx []uint) (bool, error) {
+	for _, i := range idx {
+		if c.cell(i) == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *memoryCells) bytes(context.Context) ([]byte, error) {
+	return c.data, nil
+}
+
+func (c *memoryCells) setBytes(_ context.Context, data []byte) error {
+	c.data = data
+	return nil
+}
+
+func (c *memoryCells) resize(d uint, size int) stableCells {
+	return &memoryCells{d: d}
+}
+
+// redisCells keeps the cells in a Redis string, accessed with BITFIELD.
+type redisCells struct {
+	redisClient redis.UniversalClient
+	key         string
+	d           uint
+	size        int
+}
+
+func (c *redisCells) cellType() string {
+	return "u" + strconv.FormatUint(uint64(c.d), 10)
+}
+
+func cellOffset(i uint) string {
+	return "#" + strconv.FormatUint(uint64(i), 10)
+}
+
+func (c *redisCells) add(ctx context.Context, decrement, set []uint, test bool) (bool, error) {
+	typ := c.cellType()
+	args := make([]interface{}, 0, 3*len(set)+2+4*len(decrement)+4*len(set))
+	if test {
+		for _, i := range set {
+			args = append(args, "GET", typ, cellOffset(i))
+		}
+	}
+	args = append(args, "OVERFLOW", "SAT")
+	for _, i := range decrement {
+		args = append(args, "INCRBY", typ, cellOffset(i), -1)
+	}
+	for _, i := range set {
+		args = append(args, "SET", typ, cellOffset(i), 1<<c.d-1)
+	}
+	values, err := c.redisClient.BitField(ctx, c.key, args...).Result()
+	if err != nil || !test {
+		return false, err
+	}
+	for _, v := range values[:len(set)] {
+		if v == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *redisCells) test(ctx context.Context, idx []uint) (bool, error) {
+	typ := c.cellType()
+	args := make([]interface{}, 0, 3*len(idx))
+	for _, i := range idx {
+		args = append(args, "GET", typ, cellOffset(i))
+	}
+	values, err := c.redisClient.BitField(ctx, c.key, args...).Result()
+	if err != nil {
+		return false, err
+	}
+	for _, v := range values {
+		if v == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (c *redisCells) bytes(ctx context.Context) ([]byte, error) {
+	data, err := c.redisClient.Get(ctx, c.key).Bytes()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	if len(data) < c.size {
+		data = append(data, make([]byte, c.size-len(data))...)
+	}
+	return data[:c.size], nil
+}
+
+func (c *redisCells) setBytes(ctx context.Context, data []byte) error {
+	return c.redisClient.Set(ctx, c.key, data, redis.KeepTTL).Err()
+}
+
+func (c *redisCells) resize(d uint, size int) stableCells {
+	return &redisCells{redisClient: c.redisClient, key: c.key, d: d, size: size}
+}
@@ -0,0 +1,135 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func testStableBloomFilter(t *testing.T, f *StableBloomFilter, n int) {
+	ctx := context.Background()
+	fp := 0
+	for i := 0; i < n; i++ {
+		key := "key" + strconv.Itoa(i)
+		ok, err := f.TestAndAddString(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok {
+			fp++
+		}
+		// the latest keys are always remembered
+		if ok, err := f.TestString(ctx, key); err != nil || !ok {
+			t.Fatalf("%s should be in, got %v %v", key, ok, err)
+		}
+	}
+	// the keys are all distinct: past the stable point, any positive is a
+	// false positive
+	if rate := float64(fp) / float64(n); rate > 2*f.FalsePositiveRate()+0.005 {
+		t.Errorf("false positive rate %f over the stable rate %f", rate, f.FalsePositiveRate())
+	}
+
+	if err := f.ClearAll(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := f.Test(ctx, []byte("key"+strconv.Itoa(n-1))); ok {
+		t.Error("the filter should be empty after ClearAll")
+	}
+}
+
+func TestStableBloomFilter(t *testing.T) {
+	f := NewStableBloomFilter(10000, 3, 0.01)
+	if f.Cap() != 10000 || f.CellBits() != 3 || f.K() != 7 {
+		t.Errorf("unexpected parameters m=%d d=%d k=%d", f.Cap(), f.CellBits(), f.K())
+	}
+	if rate := f.FalsePositiveRate(); rate > 0.011 {
+		t.Errorf("stable false positive rate %f over 0.01", rate)
+	}
+	testStableBloomFilter(t, f, 100000)
+}
+
+func TestRedisStableBloomFilter(t *testing.T) {
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(context.Background(), key)
+	testStableBloomFilter(t, NewRedisStableBloomFilter(redisClient, key, 2000, 2, 0.02), 5000)
+}
+
+func TestStableBloomFilterForgets(t *testing.T) {
+	ctx := context.Background()
+	f := NewStableBloomFilter(1000, 1, 0.05)
+	f.AddString(ctx, "old")
+	for i := 0; i < 100*int(f.Cap()/f.P()); i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+	}
+	if ok, _ := f.TestString(ctx, "old"); ok {
+		t.Error("old key should be forgotten")
+	}
+}
+
+func TestStableBloomFilterLowRate(t *testing.T) {
+	k, _ := EstimateStableParameters(100000, 4, 1e-12)
+	if k != 32 {
+		t.Errorf("k should be at most 32, got %d", k)
+	}
+	f := NewStableBloomFilter(100000, 4, 1e-12)
+	if rate := f.FalsePositiveRate(); rate > 1.1e-12 {
+		t.Errorf("stable false positive rate %g over 1e-12", rate)
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewStableBloomFilter(10, 1, 0.1).ReadFrom(&buf); err != nil {
+		t.Errorf("a filter of a low rate should be read back, got %v", err)
+	}
+}
+
+func TestStableBloomFilterReadWrite(t *testing.T) {
+	ctx := context.Background()
+	f := NewStableBloomFilter(1000, 4, 0.01)
+	for i := 0; i < 100; i++ {
+		f.AddString(ctx, strconv.Itoa(i))
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(ctx, key)
+	g := NewRedisStableBloomFilter(redisClient, key, 10, 1, 0.1)
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if g.Cap() != f.Cap() || g.K() != f.K() || g.CellBits() != f.CellBits() || g.P() != f.P() {
+		t.Error("parameters should be read")
+	}
+	for i := 90; i < 100; i++ {
+		if ok, err := g.TestString(ctx, strconv.Itoa(i)); err != nil || !ok {
+			t.Fatalf("%d should be in, got %v %v", i, ok, err)
+		}
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, stableHeaderSize))); err != ErrInvalidStableBloomFilter {
+		t.Errorf("expected ErrInvalidStableBloomFilter, got %v", err)
+	}
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(1<<40, 1, 8, 1))); err != ErrInvalidStableBloomFilter {
+		t.Errorf("expected ErrInvalidStableBloomFilter, got %v", err)
+	}
+	// the cells are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(bigEndianHeader(1<<30, 1, 8, 1))); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package bloom
+
+import "math"
+
+// FilterStats describes the parameters and the load of a Bloom filter.
+type FilterStats struct {
+	// M is the number of bits of the filter
+	M uint `json:"m"`
+	// K is the number of hash functions
+	K uint `json:"k"`
+	// SetBits is the number of bits set
+	SetBits uint `json:"set_bits"`
+	// FillRatio is the proportion of bits set
+	FillRatio float64 `json:"fill_ratio"`
+	// ApproximatedSize approximates the number of items, see
+	// BloomFilter.ApproximatedSize
+	ApproximatedSize uint32 `json:"approximated_size"`
+	// FalsePositiveRate is the current false positive rate, estimated as
+	// FillRatio^K
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+}
+
+// Stats returns the parameters and the load of f. Counting the bits set
+// reads the whole bitset (a BITCOUNT for a Redis bitset). Filters that do not
+// expose their bits, such as a RedisBloomFilter, only report M, K and
+// ApproximatedSize.
+func Stats(f BloomFilter) FilterStats {
+	stats := FilterStats{
+		M:                f.Cap(),
+		K:                f.K(),
+		ApproximatedSize: f.ApproximatedSize(),
+	}
+	if f.BitSet() == nil || stats.M == 0 {
+		return stats
+	}
+	stats.SetBits = f.BitSet().Count()
+	stats.FillRatio = float64(stats.SetBits) / float64(stats.M)
+	stats.FalsePositiveRate = math.Pow(stats.FillRatio, float64(stats.K))
+	return stats
+}
@@ -0,0 +1,22 @@
+package bloom
+
+import "testing"
+
+func TestStats(t *testing.T) {
+	f := New(1000, 4, NewMemoryBitSet())
+	f.AddString("Love")
+	f.AddString("is")
+	stats := Stats(f)
+	if stats.M != 1000 || stats.K != 4 {
+		t.Errorf("unexpected parameters %+v", stats)
+	}
+	if stats.SetBits == 0 || stats.SetBits > 8 {
+		t.Errorf("unexpected number of bits set %d", stats.SetBits)
+	}
+	if stats.ApproximatedSize != 2 {
+		t.Errorf("%d should equal 2.", stats.ApproximatedSize)
+	}
+	if stats.FalsePositiveRate <= 0 || stats.FalsePositiveRate >= stats.FillRatio {
+		t.Errorf("unexpected false positive rate %f", stats.FalsePositiveRate)
+	}
+}
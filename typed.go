@@ -0,0 +1,141 @@
+package bloom
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/google/uuid"
+)
+
+// maxPooledBuffer is the largest encoding buffer kept for reuse, so that an
+// occasional huge key does not pin its buffer forever.
+const maxPooledBuffer = 64 * 1024
+
+// encodeBuffers holds the buffers keys are encoded into. Reusing them keeps
+// the encoding of fixed-size keys free of allocations.
+var encodeBuffers = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 64)
+		return &b
+	},
+}
+
+// Encoder encodes the keys of a TypedFilter into bytes. Encode appends the
+// encoding of v to dst and returns the extended slice. Two keys must have the
+// same encoding if and only if they are equal.
+type Encoder[T any] interface {
+	Encode(dst []byte, v T) []byte
+}
+
+// EncoderFunc adapts a function to the Encoder interface.
+type EncoderFunc[T any] func(dst []byte, v T) []byte
+
+func (f EncoderFunc[T]) Encode(dst []byte, v T) []byte {
+	return f(dst, v)
+}
+
+// Integer is the set of the integer types, and the types based on them.
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 |
+		~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntegerEncoder encodes integers in big-endian order on their size, so
+// that a uint32 is encoded like binary.BigEndian.PutUint32 does.
+func IntegerEncoder[T Integer]() Encoder[T] {
+	return integerEncoder[T]{}
+}
+
+type integerEncoder[T Integer] struct{}
+
+func (integerEncoder[T]) Encode(dst []byte, v T) []byte {
+	u := uint64(v)
+	for i := int(unsafe.Sizeof(v)) - 1; i >= 0; i-- {
+		dst = append(dst, byte(u>>(8*uint(i))))
+	}
+	return dst
+}
+
+// StringEncoder encodes strings as their bytes, like AddString does.
+func StringEncoder[T ~string]() Encoder[T] {
+	return stringEncoder[T]{}
+}
+
+type stringEncoder[T ~string] struct{}
+
+func (stringEncoder[T]) Encode(dst []byte, v T) []byte {
+	return append(dst, v...)
+}
+
+// Bytes16Encoder encodes 16 byte arrays, such as hashes or identifiers, as
+// their bytes.
+func Bytes16Encoder[T ~[16]byte]() Encoder[T] {
+	return bytes16Encoder[T]{}
+}
+
+type bytes16Encoder[T ~[16]byte] struct{}
+
+func (bytes16Encoder[T]) Encode(dst []byte, v T) []byte {
+	b := [16]byte(v)
+	return append(dst, b[:]...)
+}
+
+// UUIDEncoder encodes UUIDs as their 16 bytes.
+func UUIDEncoder() Encoder[uuid.UUID] {
+	return bytes16Encoder[uuid.UUID]{}
+}
+
+// TypedFilter is a BloomFilter taking keys of type T, encoded into bytes by
+// an Encoder. Encoding into pooled buffers does not allocate.
+type TypedFilter[T any] struct {
+	filter  BloomFilter
+	encoder Encoder[T]
+}
+
+// NewTypedFilter wraps filter to take keys of type T encoded by encoder.
+func NewTypedFilter[T any](filter BloomFilter, encoder Encoder[T]) *TypedFilter[T] {
+	return &TypedFilter[T]{filter: filter, encoder: encoder}
+}
+
+// Filter returns the underlying filter.
+func (f *TypedFilter[T]) Filter() BloomFilter {
+	return f.filter
+}
+
+// Add adds v to the filter. Returns the filter (allows chaining)
+func (f *TypedFilter[T]) Add(v T) *TypedFilter[T] {
+	f.with(v, func(data []byte) { f.filter.Add(data) })
+	return f
+}
+
+// Test returns true if v is in the filter, false otherwise. If true, the
+// result might be a false positive.
+func (f *TypedFilter[T]) Test(v T) (present bool) {
+	f.with(v, func(data []byte) { present = f.filter.Test(data) })
+	return present
+}
+
+// TestAndAdd is the equivalent to calling Test(v) then Add(v). Returns the
+// result of Test.
+func (f *TypedFilter[T]) TestAndAdd(v T) (present bool) {
+	f.with(v, func(data []byte) { present = f.filter.TestAndAdd(data) })
+	return present
+}
+
+// TestOrAdd is the equivalent to calling Test(v) then if not present Add(v).
+// Returns the result of Test.
+func (f *TypedFilter[T]) TestOrAdd(v T) (present bool) {
+	f.with(v, func(data []byte) { present = f.filter.TestOrAdd(data) })
+	return present
+}
+
+// with calls fn with the encoding of v in a pooled buffer.
+func (f *TypedFilter[T]) with(v T, fn func(data []byte)) {
+	buf := encodeBuffers.Get().(*[]byte)
+	data := f.encoder.Encode((*buf)[:0], v)
+	fn(data)
+	if cap(data) <= maxPooledBuffer {
+		*buf = data[:0]
+		encodeBuffers.Put(buf)
+	}
+}
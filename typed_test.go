@@ -0,0 +1,96 @@
+package bloom
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestTypedFilterIntegers(t *testing.T) {
+	f := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), IntegerEncoder[uint32]())
+	f.Add(100).Add(200)
+	if !f.Test(100) || !f.Test(200) {
+		t.Error("added integers should be in")
+	}
+	if f.Test(300) {
+		t.Error("300 should not be in")
+	}
+	if f.TestOrAdd(300) || !f.Test(300) {
+		t.Error("TestOrAdd should add 300")
+	}
+
+	// the encoding is the one the README used to recommend
+	n := make([]byte, 4)
+	binary.BigEndian.PutUint32(n, 100)
+	if !f.Filter().Test(n) {
+		t.Error("a uint32 should be encoded in big-endian order")
+	}
+
+	g := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), IntegerEncoder[int8]())
+	g.Add(-1)
+	if !g.Filter().Test([]byte{0xff}) {
+		t.Error("an int8 should be encoded on one byte")
+	}
+}
+
+func TestTypedFilterStringsAndUUIDs(t *testing.T) {
+	type name string
+	s := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), StringEncoder[name]())
+	s.Add("Bess")
+	if !s.Test("Bess") || !s.Filter().TestString("Bess") || s.Test("Jane") {
+		t.Error("strings should be encoded as their bytes")
+	}
+
+	id := uuid.New()
+	u := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), UUIDEncoder())
+	if u.TestAndAdd(id) || !u.Test(id) || !u.Filter().Test(id[:]) {
+		t.Error("UUIDs should be encoded as their bytes")
+	}
+
+	h := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), Bytes16Encoder[[16]byte]())
+	h.Add([16]byte(id))
+	if !h.Test([16]byte(id)) || h.Test([16]byte{}) {
+		t.Error("unexpected [16]byte membership")
+	}
+}
+
+func TestTypedFilterComposite(t *testing.T) {
+	type edge struct {
+		from, to uint32
+	}
+	encoder := EncoderFunc[edge](func(dst []byte, e edge) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint32(b[:4], e.from)
+		binary.BigEndian.PutUint32(b[4:], e.to)
+		return append(dst, b[:]...)
+	})
+	f := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), Encoder[edge](encoder))
+	f.Add(edge{1, 2})
+	if !f.Test(edge{1, 2}) || f.Test(edge{2, 1}) {
+		t.Error("unexpected edge membership")
+	}
+}
+
+func TestTypedFilterAllocations(t *testing.T) {
+	f := NewTypedFilter(NewWithEstimates(1000, 0.001, NewMemoryBitSet()), IntegerEncoder[uint64]())
+	key := make([]byte, 8)
+	raw := testing.AllocsPerRun(100, func() {
+		f.Filter().Test(key)
+	})
+	typed := testing.AllocsPerRun(100, func() {
+		f.Test(42)
+	})
+	if typed > raw {
+		t.Errorf("encoding should not allocate: %v allocations per test, %v without encoding", typed, raw)
+	}
+}
+
+func BenchmarkTypedFilterAdd(b *testing.B) {
+	f := NewTypedFilter(NewWithEstimates(uint(b.N), 0.01, NewMemoryBitSet()), IntegerEncoder[uint64]())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f.Add(uint64(i))
+	}
+}
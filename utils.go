@@ -1,5 +1,26 @@
 package bloom
 
+import (
+	"context"
+	"io"
+	"math/rand"
+	"time"
+	"unsafe"
+
+	"github.com/go-redis/redis/v9"
+)
+
+// A WATCH/MULTI transaction conflicting with another one is retried up to
+// watchMaxRetries times, after a random delay of up to watchRetryDelay,
+// doubled at each retry.
+const (
+	watchMaxRetries = 16
+	watchRetryDelay = time.Millisecond
+)
+
+// readChunkSize is the largest number of bytes readRecords reads at a time.
+const readChunkSize = 64 << 10
+
 func max(x, y uint) uint {
 	if x > y {
 		return x
@@ -7,6 +28,33 @@ func max(x, y uint) uint {
 	return y
 }
 
+// readRecords reads n records of size bytes from stream, passing them to fn
+// by chunks of up to readChunkSize bytes, so that the memory allocated
+// follows the data read, not the length claimed by a header. It returns the
+// number of bytes read.
+func readRecords(stream io.Reader, n uint64, size int, fn func(chunk []byte)) (int64, error) {
+	perChunk := uint64(max(1, readChunkSize/uint(size)))
+	if n < perChunk {
+		perChunk = n
+	}
+	buf := make([]byte, int(perChunk)*size)
+	var total int64
+	for n > 0 {
+		chunk := buf
+		if n < perChunk {
+			chunk = buf[:int(n)*size]
+		}
+		m, err := io.ReadFull(stream, chunk)
+		total += int64(m)
+		if err != nil {
+			return total, err
+		}
+		fn(chunk)
+		n -= uint64(len(chunk) / size)
+	}
+	return total, nil
+}
+
 // baseHashes returns the four hash values of data that are used to create k
 // hashes
 func baseHashes(data []byte) [4]uint64 {
@@ -23,15 +71,63 @@ func location(h [4]uint64, i uint) uint64 {
 	return h[ii%2] + ii*h[2+(((ii+(ii%2))%4)/2)]
 }
 
+// Hashes returns the four base hash values of data, from which the k
+// locations of data are derived. A key hashed once can be added to, or
+// tested against, any number of filters with AddHashes and TestHashes.
+func Hashes(data []byte) [4]uint64 {
+	return baseHashes(data)
+}
+
+// HashesString returns the four base hash values of data, like Hashes,
+// without copying the string.
+func HashesString(data string) [4]uint64 {
+	return baseHashes(stringBytes(data))
+}
+
 // Locations returns a list of hash locations representing a data item.
 func Locations(data []byte, k uint) []uint64 {
-	locs := make([]uint64, k)
+	return AppendLocations(make([]uint64, 0, k), baseHashes(data), k)
+}
 
-	// calculate locations
-	h := baseHashes(data)
+// AppendLocations appends the k hash locations derived from the base hash
+// values h to dst, so that the locations of a key can be cached without
+// allocating.
+func AppendLocations(dst []uint64, h [4]uint64, k uint) []uint64 {
 	for i := uint(0); i < k; i++ {
-		locs[i] = location(h, i)
+		dst = append(dst, location(h, i))
 	}
+	return dst
+}
 
-	return locs
-}
\ No newline at end of file
+// stringBytes returns the bytes of s without copying them. The slice must
+// not be modified.
+func stringBytes(s string) []byte {
+	return *(*[]byte)(unsafe.Pointer(&struct {
+		string
+		cap int
+	}{s, len(s)}))
+}
+
+// watchKey runs fn in a WATCH/MULTI transaction on key, retrying it while it
+// conflicts with another one.
+func watchKey(ctx context.Context, redisClient redis.UniversalClient, key string, fn func(tx *redis.Tx) error) error {
+	var err error
+	delay := watchRetryDelay
+	for i := 0; i < watchMaxRetries; i++ {
+		if i > 0 {
+			select {
+			case <-time.After(time.Duration(rand.Int63n(int64(delay)))):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			if delay < time.Second {
+				delay *= 2
+			}
+		}
+		err = redisClient.Watch(ctx, fn, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return err
+}
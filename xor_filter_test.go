@@ -0,0 +1,196 @@
+package bloom
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"testing"
+
+	"github.com/go-redis/redis/v9"
+	"github.com/google/uuid"
+)
+
+func xorKeys(prefix string, n int) [][]byte {
+	keys := make([][]byte, n)
+	for i := range keys {
+		keys[i] = []byte(prefix + strconv.Itoa(i))
+	}
+	return keys
+}
+
+func TestXorFilter(t *testing.T) {
+	keys := xorKeys("key", 100000)
+	for _, tc := range []struct {
+		build  func([][]byte) (*XorFilter, error)
+		bits   uint
+		maxFpp float64
+	}{
+		{BuildXorFilter, 8, 0.006},
+		{BuildXorFilter16, 16, 0.0002},
+	} {
+		// duplicates are ignored
+		f, err := tc.build(append(keys, keys[:10]...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.FingerprintBits() != tc.bits {
+			t.Errorf("unexpected fingerprint size %d", f.FingerprintBits())
+		}
+		if perKey := float64(8*f.NumBytes()) / float64(len(keys)); perKey > 1.2*float64(tc.bits) {
+			t.Errorf("%d-bit filter takes %f bits per key", tc.bits, perKey)
+		}
+		for _, key := range keys {
+			if !f.Contains(key) {
+				t.Fatalf("%s should be in", key)
+			}
+		}
+		count := 0
+		for i := 0; i < 100000; i++ {
+			if f.ContainsString("other" + strconv.Itoa(i)) {
+				count++
+			}
+		}
+		if fpp := float64(count) / 100000; fpp > tc.maxFpp {
+			t.Errorf("%d-bit filter: excessive fpp %f", tc.bits, fpp)
+		}
+	}
+
+	for n := 0; n < 4; n++ {
+		f, err := BuildXorFilter(xorKeys("small", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range xorKeys("small", n) {
+			if !f.Contains(key) {
+				t.Errorf("%s should be in a filter of %d keys", key, n)
+			}
+		}
+	}
+
+	f, _ := BuildXorFilterFromHashes([][4]uint64{HashesString("Love")}, 16)
+	if !f.ContainsHashes(Hashes([]byte("Love"))) || f.FingerprintBits() != 16 {
+		t.Error("Love should be in")
+	}
+}
+
+func TestXorFilterReadWrite(t *testing.T) {
+	f, err := BuildXorFilter16(xorKeys("key", 1000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	bytesWritten, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing data")
+
+	g := &XorFilter{}
+	bytesRead, err := g.ReadFrom(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytesRead != bytesWritten {
+		t.Errorf("read unexpected number of bytes %d != %d", bytesRead, bytesWritten)
+	}
+	if buf.String() != "trailing data" || !g.Equal(f) || !g.ContainsString("key999") {
+		t.Error("the filter read should be the one written")
+	}
+
+	if _, err := g.ReadFrom(bytes.NewReader(make([]byte, xorHeaderSize))); err != ErrInvalidXorFilter {
+		t.Errorf("expected ErrInvalidXorFilter, got %v", err)
+	}
+	if _, err := g.ReadFrom(bytes.NewReader(overflowingXorHeader())); err != ErrInvalidXorFilter {
+		t.Errorf("expected ErrInvalidXorFilter for an overflowing segment count, got %v", err)
+	}
+	// the fingerprints are allocated as they are read
+	if _, err := g.ReadFrom(bytes.NewReader(largeXorHeader())); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// largeXorHeader returns the header of a filter of the largest segments and
+// 16-bit fingerprints, with nearly 2^32 slots.
+func largeXorHeader() []byte {
+	data := make([]byte, xorHeaderSize)
+	binary.BigEndian.PutUint32(data[8:], xorMaxSegmentLength)
+	binary.BigEndian.PutUint32(data[12:], 1<<32/xorMaxSegmentLength-3)
+	binary.BigEndian.PutUint32(data[16:], 16)
+	binary.BigEndian.PutUint32(data[20:], (1<<32/xorMaxSegmentLength-1)*xorMaxSegmentLength)
+	return data
+}
+
+// overflowingXorHeader returns the header of a filter of 0xFFFFFFFF segments
+// of length 4, whose segment count plus two overflows to 1 in 32 bits, and of
+// 4 slots, followed by the 4 fingerprints.
+func overflowingXorHeader() []byte {
+	data := make([]byte, xorHeaderSize+4)
+	binary.BigEndian.PutUint32(data[8:], 4)
+	binary.BigEndian.PutUint32(data[12:], 0xFFFFFFFF)
+	binary.BigEndian.PutUint32(data[16:], 8)
+	binary.BigEndian.PutUint32(data[20:], 4)
+	return data
+}
+
+func TestRedisXorFilter(t *testing.T) {
+	ctx := context.Background()
+	redisClient := redis.NewUniversalClient(&redis.UniversalOptions{Addrs: []string{":6379"}})
+	key := uuid.New().String()
+	defer redisClient.Del(ctx, key)
+	if _, err := NewRedisXorFilter(ctx, redisClient, key); err != redis.Nil {
+		t.Errorf("expected redis.Nil for a missing key, got %v", err)
+	}
+
+	f, _ := BuildXorFilter(xorKeys("day1-", 1000))
+	if err := f.Store(ctx, redisClient, key, 0); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRedisXorFilter(ctx, redisClient, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		ok, err := r.ContainsString(ctx, "day1-"+strconv.Itoa(i))
+		if err != nil || !ok {
+			t.Fatalf("day1-%d should be in, got %v %v", i, ok, err)
+		}
+	}
+
+	// a rebuild replacing the filter is picked up
+	g, _ := BuildXorFilter16(xorKeys("day2-", 5000))
+	if err := g.Store(ctx, redisClient, key, 0); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5000; i++ {
+		ok, err := r.Contains(ctx, []byte("day2-"+strconv.Itoa(i)))
+		if err != nil || !ok {
+			t.Fatalf("day2-%d should be in, got %v %v", i, ok, err)
+		}
+	}
+	count := 0
+	for i := 0; i < 1000; i++ {
+		if ok, _ := r.ContainsString(ctx, "day1-"+strconv.Itoa(i)); ok {
+			count++
+		}
+	}
+	if count > 5 {
+		t.Errorf("the old keys should be gone, %d found", count)
+	}
+
+	redisClient.Del(ctx, key)
+	if _, err := r.ContainsString(ctx, "day2-1"); err != redis.Nil {
+		t.Errorf("expected redis.Nil once the key is deleted, got %v", err)
+	}
+
+	redisClient.Set(ctx, key, overflowingXorHeader(), 0)
+	if _, err := NewRedisXorFilter(ctx, redisClient, key); err != ErrInvalidXorFilter {
+		t.Errorf("expected ErrInvalidXorFilter for an overflowing segment count, got %v", err)
+	}
+	// only the header of the filter is read
+	redisClient.Set(ctx, key, largeXorHeader(), 0)
+	if _, err := NewRedisXorFilter(ctx, redisClient, key); err != nil {
+		t.Error(err)
+	}
+}